@@ -0,0 +1,42 @@
+package tsdb
+
+import (
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// anyValuePattern is a regexp matcher accepting any value of its label, like
+// `l=~".+"`. Lookups resolve it from all the postings of the label name with
+// plain string checks, rather than evaluating the regexp against each value.
+type anyValuePattern struct {
+	// matchesEmpty is set for `*` repetitions, which accept the empty value.
+	matchesEmpty bool
+	// matchesNewline is set if the s flag is set: the dot of Prometheus
+	// regexps doesn't match newlines by default.
+	matchesNewline bool
+}
+
+var anyValuePatterns = map[string]anyValuePattern{
+	".*":      {matchesEmpty: true},
+	".+":      {},
+	"(?s:.*)": {matchesEmpty: true, matchesNewline: true},
+	"(?s:.+)": {matchesNewline: true},
+	"(?s).*":  {matchesEmpty: true, matchesNewline: true},
+	"(?s).+":  {matchesNewline: true},
+}
+
+// parseAnyValuePattern returns the pattern of matcher if it's a regexp
+// matcher accepting any value.
+func parseAnyValuePattern(matcher *labels.Matcher) (anyValuePattern, bool) {
+	if matcher.Type != labels.MatchRegexp {
+		return anyValuePattern{}, false
+	}
+	p, ok := anyValuePatterns[matcher.Value]
+	return p, ok
+}
+
+// matches reports whether the pattern accepts value, same as the regexp.
+func (p anyValuePattern) matches(value string) bool {
+	return (p.matchesEmpty || value != "") && (p.matchesNewline || strings.IndexByte(value, '\n') < 0)
+}
@@ -0,0 +1,58 @@
+package tsdb
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// AtomicIndex holds an InvertedIndex which can be atomically replaced,
+// for instance by an index rebuilt off to the side.
+// Queries read the current index without locking, so they observe either
+// the previous or the new index, never a partially built one.
+// Writers may mutate the index returned by Load, or a staged one
+// before swapping it in with Store.
+type AtomicIndex struct {
+	v atomic.Value // *InvertedIndex
+}
+
+func NewAtomicIndex(ii *InvertedIndex) *AtomicIndex {
+	a := &AtomicIndex{}
+	a.Store(ii)
+	return a
+}
+
+// Load returns the current index.
+func (a *AtomicIndex) Load() *InvertedIndex {
+	return a.v.Load().(*InvertedIndex)
+}
+
+// Store replaces the current index.
+func (a *AtomicIndex) Store(ii *InvertedIndex) {
+	a.v.Store(ii)
+}
+
+// Lookup all fingerprints for the provided matchers in the current index.
+func (a *AtomicIndex) Lookup(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	return a.Load().Lookup(matchers, shard)
+}
+
+// LabelNames returns all label names of the current index.
+func (a *AtomicIndex) LabelNames(shard *shard.Annotation) ([]string, error) {
+	return a.Load().LabelNames(shard)
+}
+
+// LabelValues returns the values for the given label in the current index.
+func (a *AtomicIndex) LabelValues(name string, shard *shard.Annotation) ([]string, error) {
+	return a.Load().LabelValues(name, shard)
+}
+
+// MatchSeries returns the labels of all series of the current index
+// matching at least one of the matcher sets.
+func (a *AtomicIndex) MatchSeries(matcherSets [][]*labels.Matcher, shard *shard.Annotation) ([]phlaremodel.Labels, error) {
+	return a.Load().MatchSeries(matcherSets, shard)
+}
@@ -0,0 +1,46 @@
+package tsdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+)
+
+func Test_AtomicIndex(t *testing.T) {
+	build := func(n int) *InvertedIndex {
+		ii := NewWithShards(4)
+		for i := 0; i < n; i++ {
+			ii.Add([]*commonv1.LabelPair{{Name: "pod", Value: fmt.Sprint(i)}}, model.Fingerprint(i))
+		}
+		return ii
+	}
+
+	a := NewAtomicIndex(build(10))
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ids, err := a.Lookup(matchers, nil)
+			require.NoError(t, err)
+			require.Contains(t, []int{10, 20}, len(ids))
+		}
+	}()
+	a.Store(build(20))
+	wg.Wait()
+
+	values, err := a.LabelValues("pod", nil)
+	require.NoError(t, err)
+	require.Len(t, values, 20)
+	names, err := a.LabelNames(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod"}, names)
+}
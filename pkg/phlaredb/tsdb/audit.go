@@ -0,0 +1,50 @@
+package tsdb
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// QueryAudit describes a query completed by the index, see
+// IndexOptions.QueryLogger.
+type QueryAudit struct {
+	// Method is "Lookup", "LabelNames" or "LabelValues".
+	Method string
+	// Matchers renders the matchers of a lookup as a selector, sorted so
+	// that equivalent queries render the same, e.g. `{env="prod",pod=~"a.*"}`.
+	Matchers string
+	// LabelName is the label whose values were queried by LabelValues.
+	LabelName string
+	// Shard is the shard annotation of the query, nil for all shards.
+	Shard    *shard.Annotation
+	Results  int
+	Duration time.Duration
+	Err      error
+}
+
+// auditQuery reports a query started at start to the query logger, which
+// must be set.
+func (ii *InvertedIndex) auditQuery(audit QueryAudit, start time.Time) {
+	audit.Duration = time.Since(start)
+	ii.opts.QueryLogger(audit)
+}
+
+// matchersString renders the matchers as a selector, sorted by their own
+// rendering, which starts with their label name.
+func matchersString(matchers []*labels.Matcher) string {
+	rendered := make([]string, len(matchers))
+	for i, m := range matchers {
+		if m == nil {
+			rendered[i] = "<nil>"
+			continue
+		}
+		rendered[i] = m.String()
+	}
+	sort.Strings(rendered)
+	return "{" + strings.Join(rendered, ",") + "}"
+}
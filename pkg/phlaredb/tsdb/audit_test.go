@@ -0,0 +1,59 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_QueryLogger(t *testing.T) {
+	var audits []QueryAudit
+	ii := NewWithOptions(4, IndexOptions{QueryLogger: func(a QueryAudit) {
+		require.GreaterOrEqual(t, a.Duration, time.Duration(0))
+		a.Duration = 0
+		audits = append(audits, a)
+	}})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "b"), 2)
+
+	_, err := ii.Lookup([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "pod", "a|b"),
+		labels.MustNewMatcher(labels.MatchEqual, "env", "prod"),
+	}, nil)
+	require.NoError(t, err)
+	// matchers render the same whatever their order
+	_, err = ii.Lookup([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "env", "prod"),
+		labels.MustNewMatcher(labels.MatchRegexp, "pod", "a|b"),
+	}, &shard.Annotation{Shard: 1, Of: 2})
+	require.NoError(t, err)
+	_, err = ii.LabelNames(nil)
+	require.NoError(t, err)
+	_, err = ii.LabelValues("pod", nil)
+	require.NoError(t, err)
+	invalid := &shard.Annotation{Shard: 0, Of: 3}
+	_, err = ii.LabelValues("pod", invalid)
+	require.Error(t, err)
+
+	require.Len(t, audits, 5)
+	require.Equal(t, QueryAudit{Method: "Lookup", Matchers: `{env="prod",pod=~"a|b"}`, Results: 2}, audits[0])
+	require.Equal(t, `{env="prod",pod=~"a|b"}`, audits[1].Matchers)
+	require.Equal(t, &shard.Annotation{Shard: 1, Of: 2}, audits[1].Shard)
+	require.Equal(t, QueryAudit{Method: "LabelNames", Results: 2}, audits[2])
+	require.Equal(t, QueryAudit{Method: "LabelValues", LabelName: "pod", Results: 2}, audits[3])
+	require.Equal(t, QueryAudit{Method: "LabelValues", LabelName: "pod", Shard: invalid, Err: err}, audits[4])
+}
+
+func Test_MatchersString(t *testing.T) {
+	require.Equal(t, "{}", matchersString(nil))
+	require.Equal(t, `{<nil>,a!="1",b=~".+"}`, matchersString([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "b", ".+"),
+		nil,
+		labels.MustNewMatcher(labels.MatchNotEqual, "a", "1"),
+	}))
+}
@@ -0,0 +1,375 @@
+package tsdb
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// benchmarkSeries returns a synthetic label distribution resembling
+// profiles: a few profile types and namespaces, tens of services and
+// thousands of pods, every pod reporting every profile type.
+func benchmarkSeries() []phlaremodel.Labels {
+	profileTypes := []string{"cpu", "alloc_space", "alloc_objects", "inuse_space", "inuse_objects"}
+	var series []phlaremodel.Labels
+	for pod := 0; pod < 2000; pod++ {
+		service := pod % 40
+		for _, profileType := range profileTypes {
+			series = append(series, phlaremodel.LabelsFromStrings(
+				phlaremodel.LabelNameProfileType, profileType,
+				"namespace", fmt.Sprint("ns-", service%4),
+				"pod", fmt.Sprintf("svc-%d-pod-%d", service, pod),
+				"service_name", fmt.Sprint("svc-", service),
+			))
+		}
+	}
+	return series
+}
+
+func benchmarkIndex(series []phlaremodel.Labels) *InvertedIndex {
+	return benchmarkIndexWithOptions(series, IndexOptions{})
+}
+
+func benchmarkIndexWithOptions(series []phlaremodel.Labels, opts IndexOptions) *InvertedIndex {
+	ii := NewWithOptions(DefaultIndexShards, opts)
+	for i, lbs := range series {
+		ii.Add(lbs, model.Fingerprint(lbs.Hash()+uint64(i)))
+	}
+	return ii
+}
+
+func BenchmarkLookup(b *testing.B) {
+	series := benchmarkSeries()
+	for _, postings := range []struct {
+		name string
+		opts IndexOptions
+	}{
+		{"slice", IndexOptions{}},
+		{"bitmap", IndexOptions{BitmapPostings: true}},
+	} {
+		b.Run(postings.name, func(b *testing.B) {
+			benchmarkLookup(b, benchmarkIndexWithOptions(series, postings.opts))
+		})
+	}
+}
+
+func benchmarkLookup(b *testing.B, ii *InvertedIndex) {
+	for _, bc := range []struct {
+		name     string
+		matchers []*labels.Matcher
+	}{
+		{"equal/selective", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "pod", "svc-1-pod-41"),
+		}},
+		{"equal/broad", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, "cpu"),
+		}},
+		{"set", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "service_name", "^(?:svc-1|svc-2|svc-3)$"),
+		}},
+		{"regex", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "pod", "svc-1-pod-.*"),
+		}},
+		{"not-equal", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchNotEqual, "namespace", "ns-0"),
+		}},
+		// equality matchers are reordered by selectivity, the selective
+		// one is evaluated first even if it comes last.
+		{"intersect/broad-first", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, "cpu"),
+			labels.MustNewMatcher(labels.MatchEqual, "namespace", "ns-1"),
+			labels.MustNewMatcher(labels.MatchEqual, "pod", "svc-1-pod-41"),
+		}},
+		{"intersect/selective-first", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "pod", "svc-1-pod-41"),
+			labels.MustNewMatcher(labels.MatchEqual, "namespace", "ns-1"),
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, "cpu"),
+		}},
+		{"intersect/broad", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, "cpu"),
+			labels.MustNewMatcher(labels.MatchEqual, "namespace", "ns-1"),
+		}},
+		{"intersect/equal-regex", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, "cpu"),
+			labels.MustNewMatcher(labels.MatchRegexp, "pod", "svc-1-pod-.*"),
+		}},
+		// match-all regexps also match the series without the label
+		{"any-value/present", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "pod", ".*"),
+		}},
+		{"any-value/missing", []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchRegexp, "missing", ".*"),
+		}},
+		{"all", nil},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := ii.Lookup(bc.matchers, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBulkAdd(b *testing.B) {
+	series := benchmarkSeries()
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		benchmarkIndex(series)
+	}
+}
+
+// BenchmarkExists checks indexed fingerprints, found after half the
+// shards on average, and missing ones, checked against every shard.
+func BenchmarkExists(b *testing.B) {
+	series := benchmarkSeries()
+	ii := benchmarkIndex(series)
+	for _, bc := range []struct {
+		name   string
+		offset uint64
+	}{
+		{"present", 0},
+		{"missing", 1 << 32},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				i := n % len(series)
+				ii.Exists(model.Fingerprint(series[i].Hash() + uint64(i) + bc.offset))
+			}
+		})
+	}
+}
+
+// BenchmarkSeriesMemory reports the heap size per series of the index, and
+// the part of it held by the reverse maps of the shards from fingerprints
+// to labels (series and refs). The labels returned by Add are either kept
+// by the caller, as the head does, or dropped.
+func BenchmarkSeriesMemory(b *testing.B) {
+	series := benchmarkSeries()
+	heapAlloc := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+	for _, keep := range []bool{true, false} {
+		b.Run(fmt.Sprintf("keep=%v", keep), func(b *testing.B) {
+			var total, reverse uint64
+			for n := 0; n < b.N; n++ {
+				before := heapAlloc()
+				ii := NewWithShards(DefaultIndexShards)
+				kept := make([]phlaremodel.Labels, 0, len(series))
+				for i, lbs := range series {
+					if lbs = ii.Add(lbs, model.Fingerprint(lbs.Hash()+uint64(i))); keep {
+						kept = append(kept, lbs)
+					}
+				}
+				with := heapAlloc()
+				for _, s := range ii.shards {
+					s.series, s.refs = nil, nil
+				}
+				without := heapAlloc()
+				total, reverse = with-before, with-without
+				runtime.KeepAlive(ii)
+				runtime.KeepAlive(kept)
+			}
+			b.ReportMetric(float64(total)/float64(len(series)), "bytes/series")
+			b.ReportMetric(float64(reverse)/float64(len(series)), "reverse-bytes/series")
+		})
+	}
+	// the bitprefix index of the head has no reverse maps
+	b.Run("bitprefix", func(b *testing.B) {
+		var total uint64
+		for n := 0; n < b.N; n++ {
+			before := heapAlloc()
+			ii, err := NewBitPrefixWithShards(DefaultIndexShards)
+			if err != nil {
+				b.Fatal(err)
+			}
+			kept := make([]phlaremodel.Labels, 0, len(series))
+			for i, lbs := range series {
+				kept = append(kept, ii.Add(lbs, model.Fingerprint(lbs.Hash()+uint64(i))))
+			}
+			total = heapAlloc() - before
+			runtime.KeepAlive(ii)
+			runtime.KeepAlive(kept)
+		}
+		b.ReportMetric(float64(total)/float64(len(series)), "bytes/series")
+	})
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	for _, sizes := range [][2]int{{10, 10000}, {1000, 10000}, {10000, 10000}} {
+		a, other := make([]model.Fingerprint, sizes[0]), make([]model.Fingerprint, sizes[1])
+		step := sizes[1] / sizes[0]
+		for i := range a {
+			a[i] = model.Fingerprint(i * step)
+		}
+		for i := range other {
+			other[i] = model.Fingerprint(i)
+		}
+		b.Run(fmt.Sprintf("%d/%d", sizes[0], sizes[1]), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				intersect(a, other)
+			}
+		})
+	}
+}
+
+func BenchmarkFindSetMatches(b *testing.B) {
+	for _, pattern := range []string{
+		"^(?:svc-1|svc-2|svc-3)$",
+		"^(?:foo|bar|ba[rz])$",
+		"^(?:svc-.*)$",
+	} {
+		b.Run(pattern, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				FindSetMatches(pattern)
+			}
+		})
+	}
+}
+
+// BenchmarkLookupIter compares consuming a broad lookup through Lookup and
+// LookupIter. Lookup allocates a combined slice at each level of its merge
+// while LookupIter only holds the results of each shard.
+func BenchmarkLookupIter(b *testing.B) {
+	ii := benchmarkIndex(benchmarkSeries())
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchNotEqual, "namespace", "ns-0"),
+	}
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			fps, err := ii.Lookup(matchers, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for range fps {
+			}
+		}
+	})
+	b.Run("iter", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			it, err := ii.LookupIter(matchers, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for it.Next() {
+			}
+		}
+	})
+}
+
+// BenchmarkMergeStringSlices compares the recursive two-way merge with a
+// single pass heap k-way merge on per shard label names, mostly shared by
+// all shards, and label values, mostly distinct across shards. The heap
+// merge allocates only the result, but its comparisons make it about 1.5 to
+// 3 times slower at 32 and 128 shards, so LabelNames and LabelValues keep
+// the two-way merge.
+func BenchmarkMergeStringSlices(b *testing.B) {
+	for _, shards := range []int{32, 128} {
+		names := make([][]string, shards)
+		values := make([][]string, shards)
+		for i := range names {
+			for n := 0; n < 20; n++ {
+				names[i] = append(names[i], fmt.Sprintf("label_%02d", n))
+			}
+			// a few names only carried by some shards
+			names[i] = append(names[i], fmt.Sprintf("rare_%02d", i%8))
+			sort.Strings(names[i])
+		}
+		for v := 0; v < 20000; v++ {
+			// most values land in a single shard, some in several
+			values[v%shards] = append(values[v%shards], fmt.Sprintf("pod-%05d", v))
+			if v%10 == 0 {
+				values[(v+1)%shards] = append(values[(v+1)%shards], fmt.Sprintf("pod-%05d", v))
+			}
+		}
+		for i := range values {
+			sort.Strings(values[i])
+		}
+
+		for _, input := range []struct {
+			name string
+			ss   [][]string
+		}{{"names", names}, {"values", values}} {
+			require.Equal(b, mergeStringSlices(input.ss), mergeStringSlicesHeap(input.ss))
+			for _, merge := range []struct {
+				name string
+				fn   func([][]string) []string
+			}{{"two-way", mergeStringSlices}, {"heap", mergeStringSlicesHeap}} {
+				b.Run(fmt.Sprintf("shards=%d/%s/%s", shards, input.name, merge.name), func(b *testing.B) {
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						merge.fn(input.ss)
+					}
+				})
+			}
+		}
+	}
+}
+
+// mergeStringSlicesHeap is mergeStringSlices as a single pass k-way merge,
+// picking the lowest head of the slices from a min heap.
+func mergeStringSlicesHeap(ss [][]string) []string {
+	var n int
+	h := make([][]string, 0, len(ss))
+	for _, s := range ss {
+		if len(s) > 0 {
+			h = append(h, s)
+			n += len(s)
+		}
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		siftDownStrings(h, i)
+	}
+	result := make([]string, 0, n)
+	for len(h) > 0 {
+		s := h[0][0]
+		if len(result) == 0 || result[len(result)-1] != s {
+			result = append(result, s)
+		}
+		if h[0] = h[0][1:]; len(h[0]) == 0 {
+			h[0] = h[len(h)-1]
+			h = h[:len(h)-1]
+		}
+		siftDownStrings(h, 0)
+	}
+	return result
+}
+
+// siftDownStrings restores the heap order of the slices of h below i,
+// ordered by their first string.
+func siftDownStrings(h [][]string, i int) {
+	for {
+		min, l := i, 2*i+1
+		if l < len(h) && h[l][0] < h[min][0] {
+			min = l
+		}
+		if r := l + 1; r < len(h) && h[r][0] < h[min][0] {
+			min = r
+		}
+		if min == i {
+			return
+		}
+		h[i], h[min] = h[min], h[i]
+		i = min
+	}
+}
@@ -38,10 +38,7 @@ func NewBitPrefixWithShards(totalShards uint32) (*BitPrefixInvertedIndex, error)
 
 	shards := make([]*indexShard, totalShards)
 	for i := uint32(0); i < totalShards; i++ {
-		shards[i] = &indexShard{
-			idx:   map[string]indexEntry{},
-			shard: i,
-		}
+		shards[i] = newBitPrefixShard(i)
 	}
 	return &BitPrefixInvertedIndex{
 		totalShards: totalShards,
@@ -49,6 +46,15 @@ func NewBitPrefixWithShards(totalShards uint32) (*BitPrefixInvertedIndex, error)
 	}, nil
 }
 
+// newBitPrefixShard returns a shard without the fingerprint to labels
+// maps of the InvertedIndex shards, which nothing reads here: the series
+// of the head only pay for their postings.
+func newBitPrefixShard(i uint32) *indexShard {
+	shard := newIndexShard(i, IndexOptions{})
+	shard.series, shard.refs, shard.keepSeries = nil, nil, false
+	return shard
+}
+
 func (ii *BitPrefixInvertedIndex) getShards(shard *shard.Annotation) ([]*indexShard, bool) {
 	if shard == nil {
 		return ii.shards, false
@@ -181,11 +187,9 @@ func (ii *BitPrefixInvertedIndex) LabelNames(shard *shard.Annotation) ([]string,
 		outer:
 			for name, entry := range x {
 				for _, valEntry := range entry.fps {
-					for _, fp := range valEntry.fps {
-						if s.Match(fp) {
-							results = append(results, name)
-							continue outer
-						}
+					if postingsMatchShard(valEntry.fps, s) {
+						results = append(results, name)
+						continue outer
 					}
 				}
 			}
@@ -217,13 +221,9 @@ func (ii *BitPrefixInvertedIndex) LabelValues(name string, shard *shard.Annotati
 		extractor = func(x indexEntry) []string {
 			results := make([]string, 0, len(x.fps))
 
-		outer:
 			for val, valEntry := range x.fps {
-				for _, fp := range valEntry.fps {
-					if s.Match(fp) {
-						results = append(results, val)
-						continue outer
-					}
+				if postingsMatchShard(valEntry.fps, s) {
+					results = append(results, val)
 				}
 			}
 			return results
@@ -239,6 +239,16 @@ func (ii *BitPrefixInvertedIndex) LabelValues(name string, shard *shard.Annotati
 	return mergeStringSlices(results), nil
 }
 
+// postingsMatchShard reports whether any fingerprint of p belongs to the shard.
+func postingsMatchShard(p postings, s index.ShardAnnotation) bool {
+	var match bool
+	p.iterate(func(fp model.Fingerprint) bool {
+		match = s.Match(fp)
+		return !match
+	})
+	return match
+}
+
 // Delete a fingerprint with the given label pairs.
 func (ii *BitPrefixInvertedIndex) Delete(labels []*commonv1.LabelPair, fp model.Fingerprint) {
 	localShard := index.NewShard(0, uint32(len(ii.shards)))
@@ -89,6 +89,45 @@ func Test_BitPrefixDeleteAddLoopkup(t *testing.T) {
 	require.Len(t, ids, 0)
 }
 
+func Test_BitPrefixLeanShards(t *testing.T) {
+	ii, err := NewBitPrefixWithShards(2)
+	require.NoError(t, err)
+	inverted := NewWithShards(1)
+	for i := 0; i < 20; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2))
+		if i%3 == 0 {
+			lbs = phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i))
+		}
+		fp := model.Fingerprint(uint64(i) << 59)
+		ii.Add(lbs, fp)
+		inverted.Add(lbs, fp)
+		if i%5 == 0 {
+			ii.Delete(lbs, fp)
+			inverted.Delete(lbs, fp)
+		}
+	}
+	// the shards only hold postings
+	for _, s := range ii.shards {
+		require.Nil(t, s.series)
+		require.Nil(t, s.refs)
+	}
+
+	for _, matchers := range [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".*")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "missing", ".*")},
+	} {
+		expected, err := inverted.Lookup(matchers, nil)
+		require.NoError(t, err)
+		actual, err := ii.Lookup(matchers, nil)
+		require.NoError(t, err)
+		sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
+		require.Equal(t, expected, actual, "%v", matchers)
+	}
+}
+
 func Test_BitPrefix_hash_mapping(t *testing.T) {
 	lbs := []*commonv1.LabelPair{
 		{Name: "compose_project", Value: "loki-boltdb-storage-s3"},
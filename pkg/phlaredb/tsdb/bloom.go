@@ -0,0 +1,103 @@
+package tsdb
+
+import (
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// pairBloomProbes is the number of bits set per label pair.
+const pairBloomProbes = 4
+
+// pairBloomFilter records the label pairs of a shard, see
+// IndexOptions.PairBloomFilterBits. Lookups consult it without taking the
+// shard lock to skip shards which definitely lack the pair of an equality
+// matcher. Pairs can't be removed: deleted pairs remain as false positives
+// until the filter is rebuilt by Compact. Bits are only set under the shard
+// write lock, and read atomically. A nil filter may contain any pair.
+type pairBloomFilter struct {
+	words []uint64
+}
+
+func newPairBloomFilter(bits int) *pairBloomFilter {
+	if bits <= 0 {
+		return nil
+	}
+	return &pairBloomFilter{words: make([]uint64, (bits+63)/64)}
+}
+
+// pairHash hashes a label pair for the bloom filters, so that a lookup
+// hashes each pair once for all the shards.
+func pairHash(name, value string) uint64 {
+	return xxhash.Sum64String(name) ^ (xxhash.Sum64String(value) * 0x9e3779b97f4a7c15)
+}
+
+// probe returns the word and bit of the i-th probe of a pair hash, using
+// double hashing with an odd step so probes don't collapse.
+func (f *pairBloomFilter) probe(h, i uint64) (word int, bit uint64) {
+	pos := (h + i*((h>>32)|1)) % (uint64(len(f.words)) * 64)
+	return int(pos / 64), 1 << (pos % 64)
+}
+
+// add records the pair. Must be called under the shard write lock.
+func (f *pairBloomFilter) add(name, value string) {
+	if f == nil {
+		return
+	}
+	h := pairHash(name, value)
+	for i := uint64(0); i < pairBloomProbes; i++ {
+		word, bit := f.probe(h, i)
+		if w := atomic.LoadUint64(&f.words[word]); w&bit == 0 {
+			atomic.StoreUint64(&f.words[word], w|bit)
+		}
+	}
+}
+
+// mayContain reports whether the pair of hash h may have been added. It
+// never returns false for a pair added since the last rebuild.
+func (f *pairBloomFilter) mayContain(h uint64) bool {
+	if f == nil {
+		return true
+	}
+	for i := uint64(0); i < pairBloomProbes; i++ {
+		word, bit := f.probe(h, i)
+		if atomic.LoadUint64(&f.words[word])&bit == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuild resets the filter to the pairs of idx, dropping the deleted ones.
+// Must be called under the shard write lock. The new bits of every word are
+// a subset of the current ones, so concurrent readers never miss a pair of
+// idx.
+func (f *pairBloomFilter) rebuild(idx unlockIndex) {
+	if f == nil {
+		return
+	}
+	words := make([]uint64, len(f.words))
+	for name, values := range idx {
+		for value := range values.fps {
+			h := pairHash(name, value)
+			for i := uint64(0); i < pairBloomProbes; i++ {
+				word, bit := f.probe(h, i)
+				words[word] |= bit
+			}
+		}
+	}
+	for i, w := range words {
+		atomic.StoreUint64(&f.words[i], w)
+	}
+}
+
+// mayHoldPairs reports whether the shard may hold all the pairs of the given
+// hashes, see pairHash.
+func (shard *indexShard) mayHoldPairs(hashes []uint64) bool {
+	for _, h := range hashes {
+		if !shard.pairs.mayContain(h) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_PairBloomFilter(t *testing.T) {
+	f := newPairBloomFilter(1 << 12)
+	for i := 0; i < 100; i++ {
+		f.add("pod", fmt.Sprint("pod-", i))
+	}
+	for i := 0; i < 100; i++ {
+		require.True(t, f.mayContain(pairHash("pod", fmt.Sprint("pod-", i))))
+	}
+	var falsePositives int
+	for i := 100; i < 1100; i++ {
+		if f.mayContain(pairHash("pod", fmt.Sprint("pod-", i))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 10)
+	// the name and the value are hashed apart
+	require.False(t, f.mayContain(pairHash("pod-1", "pod")))
+
+	var nilFilter *pairBloomFilter
+	nilFilter.add("pod", "a")
+	require.True(t, nilFilter.mayContain(pairHash("pod", "a")))
+	require.Nil(t, newPairBloomFilter(0))
+}
+
+func Test_PairBloomFilterLookup(t *testing.T) {
+	ii := NewWithOptions(16, IndexOptions{PairBloomFilterBits: 1 << 12})
+	for i := 0; i < 200; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	for i := 0; i < 200; i++ {
+		fps, err := ii.Lookup([]*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "env", "prod"),
+			labels.MustNewMatcher(labels.MatchEqual, "pod", fmt.Sprint("pod-", i)),
+		}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []model.Fingerprint{model.Fingerprint(i)}, fps)
+	}
+	skipped := 0
+	for _, s := range ii.shards {
+		if !s.mayHoldPairs([]uint64{pairHash("pod", "pod-7")}) {
+			skipped++
+		}
+	}
+	require.GreaterOrEqual(t, skipped, 14)
+
+	// deleted pairs are dropped by Compact
+	lbs := phlaremodel.LabelsFromStrings("env", "prod", "pod", "pod-7")
+	s := ii.shards[ii.ShardForLabels(lbs)]
+	ii.Delete(lbs, 7)
+	require.True(t, s.pairs.mayContain(pairHash("pod", "pod-7")))
+	ii.Compact()
+	require.False(t, s.pairs.mayContain(pairHash("pod", "pod-7")))
+	require.True(t, s.pairs.mayContain(pairHash("env", "prod")))
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}, nil)
+	require.NoError(t, err)
+	require.Len(t, fps, 199)
+}
+
+// BenchmarkPairBloomFilter measures selective equality lookups on many
+// shards, most of which lack the pair.
+func BenchmarkPairBloomFilter(b *testing.B) {
+	for _, bits := range []int{0, 1 << 16} {
+		ii := NewWithOptions(128, IndexOptions{PairBloomFilterBits: bits})
+		for i := 0; i < 20000; i++ {
+			ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+		}
+		// a third of the queried pods don't exist
+		queries := make([][]*labels.Matcher, 30000)
+		for i := range queries {
+			queries[i] = []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", fmt.Sprint("pod-", i))}
+		}
+		b.Run(fmt.Sprintf("bits=%d", bits), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := ii.Lookup(queries[i%len(queries)], nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
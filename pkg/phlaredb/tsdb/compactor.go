@@ -0,0 +1,85 @@
+package tsdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Compact releases the memory retained by postings which shrank after
+// deletes, and rebuilds the pair bloom filters without the deleted pairs.
+// Shards are compacted one at a time.
+func (ii *InvertedIndex) Compact() {
+	for _, shard := range ii.shards {
+		shard.compact()
+	}
+}
+
+// StartCompactor runs Compact every interval on a goroutine, followed by
+// PurgeOlderThan if IndexOptions.CompactorPurgeAge is set. No shard lock is
+// held for more than one shard at a time, so queries aren't starved. The
+// returned function stops the compactor and waits for it to exit. Only the
+// first call starts a compactor, later ones and calls on a closed index
+// return a no-op stop function. A non-positive interval disables the
+// compactor: nothing is started and a later call can still start one.
+// Close stops the compactor too.
+func (ii *InvertedIndex) StartCompactor(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	ii.stopCompactorMtx.Lock()
+	defer ii.stopCompactorMtx.Unlock()
+	if ii.closed.Load() || !ii.compactorStarted.CAS(false, true) {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				ii.Compact()
+				if ii.opts.CompactorPurgeAge > 0 {
+					ii.PurgeOlderThan(now.Add(-ii.opts.CompactorPurgeAge))
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	ii.stopCompactor = func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+	return ii.stopCompactor
+}
+
+// compact shrinks the postings slices using less than half of their
+// capacity and rebuilds the pair bloom filter. If postings pooling is
+// enabled, the shrunk slices are handed to the free list, within its
+// bounds, for new postings to reuse rather than to the GC.
+func (shard *indexShard) compact() {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	shard.pairs.rebuild(shard.idx)
+	for _, values := range shard.idx {
+		for _, entry := range values.fps {
+			if p, ok := entry.fps.(*slicePostings); ok && cap(p.fps) > 2*len(p.fps) {
+				shrunk := p.fps
+				p.fps = append(make([]model.Fingerprint, 0, len(p.fps)), p.fps...)
+				shard.freeList.put(shrunk)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_Compact(t *testing.T) {
+	ii := NewWithShards(1)
+	for i := 0; i < 1000; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), model.Fingerprint(i))
+	}
+	for i := 10; i < 1000; i++ {
+		ii.Delete(phlaremodel.LabelsFromStrings("env", "prod"), model.Fingerprint(i))
+	}
+	p := ii.shards[0].idx["env"].fps["prod"].fps.(*slicePostings)
+	require.Greater(t, cap(p.fps), 20)
+
+	ii.Compact()
+	require.Equal(t, 10, cap(p.fps))
+	require.NoError(t, ii.Validate())
+	fps, err := ii.Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, fps, 10)
+}
+
+func Test_CompactPoolPostings(t *testing.T) {
+	ii := NewWithOptions(1, IndexOptions{PoolPostings: true})
+	for i := 0; i < 40; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), model.Fingerprint(i))
+	}
+	for i := 10; i < 40; i++ {
+		ii.Delete(phlaremodel.LabelsFromStrings("env", "prod"), model.Fingerprint(i))
+	}
+	require.Empty(t, ii.shards[0].freeList.free)
+
+	// the shrunk slice is recycled by the next postings
+	ii.Compact()
+	require.Len(t, ii.shards[0].freeList.free, 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "dev"), 100)
+	require.Empty(t, ii.shards[0].freeList.free)
+	require.NoError(t, ii.Validate())
+}
+
+func Test_StartCompactor(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{TrackLastWrite: true, CompactorPurgeAge: time.Millisecond})
+	for i := 0; i < 10; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint(i)), model.Fingerprint(i))
+	}
+
+	// a non-positive interval starts nothing
+	ii.StartCompactor(0)()
+	ii.StartCompactor(-time.Second)()
+
+	stop := ii.StartCompactor(time.Millisecond)
+	// only the first call starts a compactor
+	ii.StartCompactor(time.Millisecond)()
+
+	require.Eventually(t, func() bool {
+		names, err := ii.LabelNames(nil)
+		require.NoError(t, err)
+		return len(names) == 0
+	}, time.Second, time.Millisecond)
+	stop()
+	stop()
+	require.NoError(t, ii.Validate())
+}
+
+func Test_Close(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{TrackLastWrite: true})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	ii.StartCompactor(time.Millisecond)
+
+	require.NoError(t, ii.Close())
+	require.NoError(t, ii.Close())
+
+	require.Nil(t, ii.Add(phlaremodel.LabelsFromStrings("env", "dev"), 2))
+	_, err := ii.AddStrict(phlaremodel.LabelsFromStrings("env", "dev"), 2)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = ii.AddToShard(0, phlaremodel.LabelsFromStrings("env", "dev"), 2)
+	require.ErrorIs(t, err, ErrClosed)
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	require.Zero(t, ii.DropLabel("env"))
+	require.Zero(t, ii.PurgeOlderThan(time.Now().Add(time.Hour)))
+
+	// queries serve the final state
+	fps, err := ii.Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+
+	// the compactor can't be started again
+	ii.StartCompactor(time.Millisecond)()
+}
@@ -0,0 +1,69 @@
+package tsdb
+
+import (
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// QueryCost estimates the work of a lookup, see EstimateCost. Callers
+// apply their own policy to the components, e.g. rejecting queries above a
+// threshold of any of them.
+type QueryCost struct {
+	// Shards is the number of shards the lookup would evaluate, once shards
+	// missing the postings of an equality matcher are excluded.
+	Shards int `json:"shards"`
+	// Postings is the number of fingerprints in the postings of the
+	// equality matchers, summed over the shards.
+	Postings int `json:"postings"`
+	// Values is the number of distinct values the other matchers, matching
+	// values one at a time, would scan, summed over the shards.
+	Values int `json:"values"`
+}
+
+// EstimateCost estimates the work of looking up the matchers without
+// evaluating them: it only reads the lengths of postings and the number of
+// values of the matched label names, shard by shard. Values are scanned
+// for every matcher but equality ones, including negated equality ones.
+// A lookup without matchers, returning all series, is estimated by the
+// shards to evaluate only.
+func (ii *InvertedIndex) EstimateCost(matchers []*labels.Matcher, shard *shard.Annotation) (QueryCost, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return QueryCost{}, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return QueryCost{}, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+
+	shards := ii.getShards(shard)
+	if len(matchers) > 0 {
+		shards, _ = planLookup(shards, matchers)
+	}
+	cost := QueryCost{Shards: len(shards)}
+	for _, s := range shards {
+		s.estimateCost(matchers, &cost)
+	}
+	return cost, nil
+}
+
+// estimateCost adds the postings and values of the shard read by the
+// matchers to cost.
+func (shard *indexShard) estimateCost(matchers []*labels.Matcher, cost *QueryCost) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for _, m := range matchers {
+		values, ok := shard.idx[m.Name]
+		if !ok {
+			continue
+		}
+		if m.Type == labels.MatchEqual {
+			if entry, ok := values.fps[m.Value]; ok {
+				cost.Postings += entry.fps.len()
+			}
+			continue
+		}
+		cost.Values += len(values.fps)
+	}
+}
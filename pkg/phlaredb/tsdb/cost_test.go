@@ -0,0 +1,57 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_EstimateCost(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	env := labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")
+	pod := labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")
+	envShards, err := ii.ShardsForMatchers([]*labels.Matcher{env})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		matchers []*labels.Matcher
+		shard    *shard.Annotation
+		expected QueryCost
+	}{
+		{nil, nil, QueryCost{Shards: 4}},
+		{[]*labels.Matcher{env}, nil, QueryCost{Shards: len(envShards), Postings: 50}},
+		{[]*labels.Matcher{pod}, nil, QueryCost{Shards: 4, Values: 100}},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "env", "env-0")}, nil, QueryCost{Shards: 4, Values: 8}},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "missing"), pod}, nil, QueryCost{}},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "missing", "a")}, nil, QueryCost{}},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "missing", "a.*")}, nil, QueryCost{Shards: 4}},
+		{nil, &shard.Annotation{Shard: 1, Of: 2}, QueryCost{Shards: 2}},
+	} {
+		t.Run(fmt.Sprint(tc.matchers, tc.shard), func(t *testing.T) {
+			cost, err := ii.EstimateCost(tc.matchers, tc.shard)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, cost)
+		})
+	}
+
+	// the estimate is computed on the shards only holding env-0
+	cost, err := ii.EstimateCost([]*labels.Matcher{env, pod}, nil)
+	require.NoError(t, err)
+	require.Equal(t, len(envShards), cost.Shards)
+	require.Equal(t, 50, cost.Postings)
+	require.LessOrEqual(t, cost.Values, 100)
+
+	_, err = ii.EstimateCost(nil, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+	_, err = ii.EstimateCost([]*labels.Matcher{{Type: labels.MatchRegexp, Name: "pod", Value: "("}}, nil)
+	require.ErrorIs(t, err, ErrInvalidMatcher)
+}
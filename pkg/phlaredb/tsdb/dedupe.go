@@ -0,0 +1,118 @@
+package tsdb
+
+import (
+	"reflect"
+	"unsafe"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// DedupeStrings collapses the distinct copies of identical label names and
+// values held by the index into a single instance, and returns the number
+// of bytes of the copies no longer referenced by the index. Names and
+// values are interned within a label name of a shard, but identical
+// strings used under several names, as both a name and a value or in
+// several shards are copied each time they're first indexed. Shards are
+// processed one at a time under their write lock. Labels previously
+// returned by Add keep referencing the strings they were returned with.
+func (ii *InvertedIndex) DedupeStrings() (reclaimed int) {
+	d := &stringDeduper{
+		canonical: map[string]string{},
+		replaced:  map[uintptr]struct{}{},
+	}
+	for _, shard := range ii.shards {
+		shard.dedupeStrings(d)
+	}
+	return d.reclaimed
+}
+
+// stringDeduper maps strings to their canonical instance, the first one
+// seen, and accounts for the bytes of the other instances.
+type stringDeduper struct {
+	canonical map[string]string
+	// replaced records the data pointers of the instances accounted for,
+	// as the same instance is referenced from several places.
+	replaced  map[uintptr]struct{}
+	reclaimed int
+}
+
+// stringData returns the address of the bytes of s.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func (d *stringDeduper) intern(s string) string {
+	if s == "" {
+		return s
+	}
+	c, ok := d.canonical[s]
+	if !ok {
+		d.canonical[s] = s
+		return s
+	}
+	if p := stringData(s); p != stringData(c) {
+		if _, ok := d.replaced[p]; !ok {
+			d.replaced[p] = struct{}{}
+			d.reclaimed += len(s)
+		}
+	}
+	return c
+}
+
+func (shard *indexShard) dedupeStrings(d *stringDeduper) {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	// map keys hold their own reference, the maps are rebuilt
+	idx := make(unlockIndex, len(shard.idx))
+	for _, values := range shard.idx {
+		values.name = d.intern(values.name)
+		fps := make(map[string]indexValueEntry, len(values.fps))
+		for _, entry := range values.fps {
+			entry.value = d.intern(entry.value)
+			fps[entry.value] = entry
+		}
+		values.fps = fps
+		if values.sorted != nil {
+			sorted := make([]string, len(values.sorted.values))
+			for i, v := range values.sorted.values {
+				sorted[i] = d.intern(v)
+			}
+			numeric := make([]numericValue, len(values.sorted.numeric))
+			for i, v := range values.sorted.numeric {
+				numeric[i] = numericValue{number: v.number, value: d.intern(v.value)}
+			}
+			values.sorted.values, values.sorted.numeric = sorted, numeric
+		}
+		values.cache.invalidate()
+		idx[values.name] = values
+	}
+	shard.idx = idx
+
+	names := make([]string, len(shard.names))
+	for i, name := range shard.names {
+		names[i] = d.intern(name)
+	}
+	shard.names = names
+
+	// as for dropSeriesLabel, stored labels are replaced rather than
+	// modified since they may have been handed out to callers
+	for fp, lbs := range shard.series {
+		var result phlaremodel.Labels
+		for i, l := range lbs {
+			name, value := d.intern(l.Name), d.intern(l.Value)
+			if result == nil && stringData(name) == stringData(l.Name) && stringData(value) == stringData(l.Value) {
+				continue
+			}
+			if result == nil {
+				result = make(phlaremodel.Labels, len(lbs))
+				copy(result, lbs[:i])
+			}
+			result[i] = &commonv1.LabelPair{Name: name, Value: value}
+		}
+		if result != nil {
+			shard.series[fp] = result
+		}
+	}
+}
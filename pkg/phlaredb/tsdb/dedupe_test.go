@@ -0,0 +1,57 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_DedupeStrings(t *testing.T) {
+	for _, opts := range []IndexOptions{
+		{},
+		{SortedValues: true},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			ii := NewWithOptions(2, opts)
+			// "prod" is a value of env and stage in both shards, "stage" is
+			// both a name and a value
+			lbs := phlaremodel.LabelsFromStrings("env", "prod", "kind", "stage", "stage", "prod")
+			for shard := uint32(0); shard < 2; shard++ {
+				_, err := ii.AddToShard(shard, lbs, model.Fingerprint(shard))
+				require.NoError(t, err)
+			}
+			returned := ii.shards[0].series[0]
+
+			// 4 copies of "prod" and "stage", 2 of "env" and "kind"
+			require.Equal(t, 3*len("prod")+3*len("stage")+len("env")+len("kind"), ii.DedupeStrings())
+			require.Equal(t, 0, ii.DedupeStrings())
+
+			canonical := stringData(ii.shards[0].idx["env"].fps["prod"].value)
+			for _, shard := range ii.shards {
+				require.Equal(t, canonical, stringData(shard.idx["env"].fps["prod"].value))
+				require.Equal(t, canonical, stringData(shard.idx["stage"].fps["prod"].value))
+				for _, l := range shard.series[model.Fingerprint(shard.shard)] {
+					require.Equal(t, stringData(shard.idx[l.Name].name), stringData(l.Name))
+					require.Equal(t, stringData(shard.idx[l.Name].fps[l.Value].value), stringData(l.Value))
+				}
+			}
+			require.Equal(t, stringData(ii.shards[0].idx["stage"].name), stringData(ii.shards[1].idx["kind"].fps["stage"].value))
+			// labels handed out are left untouched
+			require.Equal(t, lbs, returned)
+			require.Equal(t, lbs, ii.shards[1].series[1])
+
+			fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "stage", "prod")}, nil)
+			require.NoError(t, err)
+			require.Equal(t, []model.Fingerprint{0, 1}, fps)
+			values, err := ii.LabelValues("kind", nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"stage"}, values)
+			require.NoError(t, ii.Validate())
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// IndexDiff is the difference between the series of two indexes, computed
+// by InvertedIndex.Diff. All fields are sorted by fingerprint.
+type IndexDiff struct {
+	// OnlyInThis holds the series of the receiver missing from the other
+	// index, OnlyInOther the series of the other index missing from the
+	// receiver.
+	OnlyInThis  []model.Fingerprint
+	OnlyInOther []model.Fingerprint
+	// Changed holds the series present in both indexes with different
+	// labels.
+	Changed []SeriesDiff
+}
+
+// Empty reports whether both indexes hold the same series.
+func (d IndexDiff) Empty() bool {
+	return len(d.OnlyInThis) == 0 && len(d.OnlyInOther) == 0 && len(d.Changed) == 0
+}
+
+// SeriesDiff details the label pairs differing for a fingerprint.
+type SeriesDiff struct {
+	Fingerprint model.Fingerprint
+	// Removed holds the label pairs only found in the receiver, Added the
+	// label pairs only found in the other index. Both are sorted.
+	Removed phlaremodel.Labels
+	Added   phlaremodel.Labels
+}
+
+// Diff compares the series of both indexes using their fingerprint to
+// labels maps, regardless of how the series are spread across shards. It is
+// meant for debugging and tests, as it copies the series of both indexes.
+func (ii *InvertedIndex) Diff(other *InvertedIndex) IndexDiff {
+	this, that := ii.seriesByFingerprint(), other.seriesByFingerprint()
+
+	var diff IndexDiff
+	for fp, lbs := range this {
+		otherLbs, ok := that[fp]
+		if !ok {
+			diff.OnlyInThis = append(diff.OnlyInThis, fp)
+			continue
+		}
+		if removed, added := diffLabels(lbs, otherLbs); len(removed) > 0 || len(added) > 0 {
+			diff.Changed = append(diff.Changed, SeriesDiff{Fingerprint: fp, Removed: removed, Added: added})
+		}
+	}
+	for fp := range that {
+		if _, ok := this[fp]; !ok {
+			diff.OnlyInOther = append(diff.OnlyInOther, fp)
+		}
+	}
+
+	sort.Sort(model.Fingerprints(diff.OnlyInThis))
+	sort.Sort(model.Fingerprints(diff.OnlyInOther))
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Fingerprint < diff.Changed[j].Fingerprint
+	})
+	return diff
+}
+
+func (ii *InvertedIndex) seriesByFingerprint() map[model.Fingerprint]phlaremodel.Labels {
+	result := map[model.Fingerprint]phlaremodel.Labels{}
+	for _, shard := range ii.shards {
+		shard.mtx.RLock()
+		for fp, lbs := range shard.series {
+			result[fp] = lbs
+		}
+		shard.mtx.RUnlock()
+	}
+	return result
+}
+
+// diffLabels returns the label pairs only in a and the ones only in b. Both
+// label sets must be sorted by name.
+func diffLabels(a, b phlaremodel.Labels) (onlyA, onlyB phlaremodel.Labels) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Name < b[j].Name:
+			onlyA = append(onlyA, a[i])
+			i++
+		case a[i].Name > b[j].Name:
+			onlyB = append(onlyB, b[j])
+			j++
+		default:
+			if a[i].Value != b[j].Value {
+				onlyA = append(onlyA, a[i])
+				onlyB = append(onlyB, b[j])
+			}
+			i++
+			j++
+		}
+	}
+	onlyA = append(onlyA, a[i:]...)
+	onlyB = append(onlyB, b[j:]...)
+	return onlyA, onlyB
+}
@@ -0,0 +1,49 @@
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_Diff(t *testing.T) {
+	a, b := NewWithShards(4), NewWithShards(8)
+	require.True(t, a.Diff(b).Empty())
+
+	for _, ii := range []*InvertedIndex{a, b} {
+		ii.Add([]*commonv1.LabelPair{{Name: "foo", Value: "1"}}, 1)
+		ii.Add([]*commonv1.LabelPair{{Name: "foo", Value: "2"}, {Name: "bar", Value: "a"}}, 2)
+	}
+	require.True(t, a.Diff(b).Empty())
+
+	a.Add([]*commonv1.LabelPair{{Name: "foo", Value: "3"}}, 3)
+	b.Add([]*commonv1.LabelPair{{Name: "foo", Value: "4"}}, 4)
+	b.Add([]*commonv1.LabelPair{{Name: "foo", Value: "5"}}, 5)
+	a.Add([]*commonv1.LabelPair{{Name: "foo", Value: "6"}, {Name: "bar", Value: "a"}}, 6)
+	b.Add([]*commonv1.LabelPair{{Name: "foo", Value: "6"}, {Name: "baz", Value: "b"}}, 6)
+	a.Add([]*commonv1.LabelPair{{Name: "foo", Value: "7"}}, 7)
+	b.Add([]*commonv1.LabelPair{{Name: "foo", Value: "8"}}, 7)
+
+	diff := a.Diff(b)
+	require.False(t, diff.Empty())
+	require.Equal(t, IndexDiff{
+		OnlyInThis:  []model.Fingerprint{3},
+		OnlyInOther: []model.Fingerprint{4, 5},
+		Changed: []SeriesDiff{
+			{
+				Fingerprint: 6,
+				Removed:     phlaremodel.LabelsFromStrings("bar", "a"),
+				Added:       phlaremodel.LabelsFromStrings("baz", "b"),
+			},
+			{
+				Fingerprint: 7,
+				Removed:     phlaremodel.LabelsFromStrings("foo", "7"),
+				Added:       phlaremodel.LabelsFromStrings("foo", "8"),
+			},
+		},
+	}, diff)
+}
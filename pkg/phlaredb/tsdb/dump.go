@@ -0,0 +1,239 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/encoding"
+)
+
+// The postings dump layout is designed to be memory-mapped. All fixed size
+// integers are big endian, all other integers are unsigned varints.
+//
+//	┌────────────────────────────────────────────────────────────────────┐
+//	│ magic(4) │ version(1) │ reserved(3) │ total shards(4)              │
+//	│ symbols length(8) │ postings length(8)                             │
+//	├────────────────────────────────────────────────────────────────────┤
+//	│ symbols: count, then each string as <length><bytes>, sorted        │
+//	├────────────────────────────────────────────────────────────────────┤
+//	│ postings, for each shard in order: pairs count, then for each      │
+//	│ pair sorted by name and value: <name ref><value ref><fps count>    │
+//	│ followed by the first fingerprint and the deltas to the next ones  │
+//	└────────────────────────────────────────────────────────────────────┘
+//
+// Symbol references are the offsets of the strings within the symbols
+// section, so a string can be read without decoding the symbol table.
+const (
+	postingsDumpMagic      = 0x50485058 // "PHPX"
+	postingsDumpVersion    = 1
+	postingsDumpHeaderSize = 28
+)
+
+// ErrInvalidPostingsDump is returned by LoadPostings for malformed input.
+var ErrInvalidPostingsDump = errors.New("invalid postings dump")
+
+// dumpedPair is a label pair and a copy of its postings.
+type dumpedPair struct {
+	name, value string
+	fps         []model.Fingerprint
+}
+
+// DumpPostings writes the postings of the index to w in a format which can
+// be loaded with LoadPostings. Shards are dumped one at a time, so the dump
+// is only consistent per shard under concurrent writes.
+func (ii *InvertedIndex) DumpPostings(w io.Writer) error {
+	shards := make([][]dumpedPair, len(ii.shards))
+	for i, shard := range ii.shards {
+		shards[i] = shard.dumpPairs()
+	}
+	symbolsBuf, postingsBuf := encodePostingsSections(shards)
+
+	header := encoding.EncWith(make([]byte, 0, postingsDumpHeaderSize))
+	header.PutBE32(postingsDumpMagic)
+	header.PutByte(postingsDumpVersion)
+	header.PutBytes([]byte{0, 0, 0})
+	header.PutBE32(ii.totalShards)
+	header.PutBE64(uint64(len(symbolsBuf)))
+	header.PutBE64(uint64(len(postingsBuf)))
+
+	for _, b := range [][]byte{header.Get(), symbolsBuf, postingsBuf} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPostings builds an index from a dump written by DumpPostings. Series
+// are restored into the shard they were dumped from. Loading is eager: the
+// sections are copied out of r and every posting is decoded into the new
+// index, which doesn't reference r once loaded. The layout allows to serve
+// lookups from mapped memory, but LoadPostings doesn't.
+func LoadPostings(r io.ReaderAt) (*InvertedIndex, error) {
+	b := make([]byte, postingsDumpHeaderSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %v", ErrInvalidPostingsDump, err)
+	}
+	header := encoding.DecWith(b)
+	if magic := header.Be32(); magic != postingsDumpMagic {
+		return nil, fmt.Errorf("%w: invalid magic number %x", ErrInvalidPostingsDump, magic)
+	}
+	if version := header.Byte(); version != postingsDumpVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidPostingsDump, version)
+	}
+	header.Skip(3)
+	totalShards := header.Be32()
+	if err := validateShardCount(totalShards); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPostingsDump, err)
+	}
+	symbolsLen, postingsLen := header.Be64(), header.Be64()
+	if symbolsLen > math.MaxInt64-postingsDumpHeaderSize || postingsLen > math.MaxInt64-postingsDumpHeaderSize-symbolsLen {
+		return nil, fmt.Errorf("%w: sections of %d and %d bytes", ErrInvalidPostingsDump, symbolsLen, postingsLen)
+	}
+
+	// the lengths are untrusted, the sections are read incrementally so
+	// that no more memory is allocated than the input holds
+	size := int64(symbolsLen + postingsLen)
+	b, err := io.ReadAll(io.NewSectionReader(r, postingsDumpHeaderSize, size))
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading sections: %v", ErrInvalidPostingsDump, err)
+	}
+	if int64(len(b)) != size {
+		return nil, fmt.Errorf("%w: sections of %d bytes, expected %d", ErrInvalidPostingsDump, len(b), size)
+	}
+
+	symbol, err := decodeSymbols(b[:symbolsLen])
+	if err != nil {
+		return nil, err
+	}
+	ii := NewWithShards(totalShards)
+	d := encoding.DecWith(b[symbolsLen:])
+	for _, shard := range ii.shards {
+		if err := shard.loadPostings(&d, symbol); err != nil {
+			return nil, err
+		}
+	}
+	if d.Len() > 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidPostingsDump, d.Len())
+	}
+	return ii, nil
+}
+
+// encodePostingsSections encodes the symbols section and the postings
+// section of the pairs of each shard.
+func encodePostingsSections(shards [][]dumpedPair) (symbols, postings []byte) {
+	set := map[string]struct{}{}
+	for _, pairs := range shards {
+		for _, p := range pairs {
+			set[p.name] = struct{}{}
+			set[p.value] = struct{}{}
+		}
+	}
+	sortedSymbols := make([]string, 0, len(set))
+	for s := range set {
+		sortedSymbols = append(sortedSymbols, s)
+	}
+	sort.Strings(sortedSymbols)
+
+	refs := make(map[string]int, len(sortedSymbols))
+	symbolsBuf := encoding.EncWith(nil)
+	symbolsBuf.PutUvarint(len(sortedSymbols))
+	for _, s := range sortedSymbols {
+		refs[s] = symbolsBuf.Len()
+		symbolsBuf.PutUvarintStr(s)
+	}
+
+	postingsBuf := encoding.EncWith(nil)
+	for _, pairs := range shards {
+		postingsBuf.PutUvarint(len(pairs))
+		for _, p := range pairs {
+			postingsBuf.PutUvarint(refs[p.name])
+			postingsBuf.PutUvarint(refs[p.value])
+			postingsBuf.PutUvarint(len(p.fps))
+			var prev model.Fingerprint
+			for _, fp := range p.fps {
+				postingsBuf.PutUvarint64(uint64(fp - prev))
+				prev = fp
+			}
+		}
+	}
+	return symbolsBuf.Get(), postingsBuf.Get()
+}
+
+// decodeSymbols decodes a symbols section, and returns a function resolving
+// symbol references.
+func decodeSymbols(b []byte) (func(ref int) (string, error), error) {
+	symbols := map[int]string{}
+	d := encoding.DecWith(b)
+	for n := d.Uvarint(); n > 0 && d.Err() == nil; n-- {
+		ref := len(b) - d.Len()
+		symbols[ref] = d.UvarintStr()
+	}
+	if d.Err() != nil || d.Len() > 0 {
+		return nil, fmt.Errorf("%w: malformed symbols", ErrInvalidPostingsDump)
+	}
+	return func(ref int) (string, error) {
+		s, ok := symbols[ref]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown symbol reference %d", ErrInvalidPostingsDump, ref)
+		}
+		return s, nil
+	}, nil
+}
+
+// loadPostings adds the series of the shard's postings read from d.
+func (shard *indexShard) loadPostings(d *encoding.Decbuf, symbol func(int) (string, error)) error {
+	series := map[model.Fingerprint]phlaremodel.Labels{}
+	for pairs := d.Uvarint(); pairs > 0 && d.Err() == nil; pairs-- {
+		name, err := symbol(d.Uvarint())
+		if err != nil {
+			return err
+		}
+		value, err := symbol(d.Uvarint())
+		if err != nil {
+			return err
+		}
+		var fp model.Fingerprint
+		for i, n := 0, d.Uvarint(); i < n && d.Err() == nil; i++ {
+			delta := model.Fingerprint(d.Uvarint64())
+			if i > 0 && delta == 0 {
+				return fmt.Errorf("%w: duplicate fingerprint %v for %s=%q", ErrInvalidPostingsDump, fp, name, value)
+			}
+			fp += delta
+			series[fp] = append(series[fp], &commonv1.LabelPair{Name: name, Value: value})
+		}
+	}
+	if d.Err() != nil {
+		return fmt.Errorf("%w: malformed postings of shard %d: %v", ErrInvalidPostingsDump, shard.shard, d.Err())
+	}
+	for fp, lbs := range series {
+		shard.add(lbs, fp)
+	}
+	return nil
+}
+
+// dumpPairs returns the label pairs of the shard sorted by name and value,
+// with a copy of their postings.
+func (shard *indexShard) dumpPairs() []dumpedPair {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	var pairs []dumpedPair
+	for _, name := range shard.names {
+		values := shard.idx[name]
+		start := len(pairs)
+		for value, entry := range values.fps {
+			pairs = append(pairs, dumpedPair{name: name, value: value, fps: entry.fps.appendTo(nil)})
+		}
+		group := pairs[start:]
+		sort.Slice(group, func(i, j int) bool { return group[i].value < group[j].value })
+	}
+	return pairs
+}
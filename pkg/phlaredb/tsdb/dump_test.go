@@ -0,0 +1,83 @@
+package tsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_DumpLoadPostings(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"__name__", "cpu",
+			"env", fmt.Sprint("env-", i%3),
+			"pod", fmt.Sprint("pod-", i),
+		), model.Fingerprint(i*1e15))
+	}
+	// a series routed to another shard than its labels hash
+	_, err := ii.AddToShard((ii.ShardForLabels(phlaremodel.LabelsFromStrings("pod", "x"))+1)%8, phlaremodel.LabelsFromStrings("pod", "x"), 1)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, ii.DumpPostings(&buf))
+	loaded, err := LoadPostings(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.NoError(t, loaded.Validate())
+	require.True(t, ii.Diff(loaded).Empty())
+
+	for i := range ii.shards {
+		require.Equal(t, ii.shards[i].allFPs(), loaded.shards[i].allFPs())
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")}
+	expected, err := ii.Lookup(matchers, nil)
+	require.NoError(t, err)
+	actual, err := loaded.Lookup(matchers, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// an empty index round trips too
+	buf.Reset()
+	require.NoError(t, NewWithShards(4).DumpPostings(&buf))
+	loaded, err = LoadPostings(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, loaded.shards, 4)
+}
+
+func Test_LoadPostingsInvalid(t *testing.T) {
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), 1)
+	var buf bytes.Buffer
+	require.NoError(t, ii.DumpPostings(&buf))
+	dump := buf.Bytes()
+	// the postings length claims one more byte than there is
+	longer := append([]byte{}, dump...)
+	longer[postingsDumpHeaderSize-1]++
+	// lengths of sections too large to be allocated, and wrapping around
+	huge := append([]byte{}, dump...)
+	binary.BigEndian.PutUint64(huge[12:], 1<<60)
+	overflow := append([]byte{}, dump...)
+	binary.BigEndian.PutUint64(overflow[12:], math.MaxUint64)
+
+	for name, b := range map[string][]byte{
+		"empty":     {},
+		"truncated": dump[:len(dump)-1],
+		"length":    longer,
+		"huge":      huge,
+		"overflow":  overflow,
+		"magic":     append([]byte{0}, dump[1:]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPostings(bytes.NewReader(b))
+			require.ErrorIs(t, err, ErrInvalidPostingsDump)
+		})
+	}
+}
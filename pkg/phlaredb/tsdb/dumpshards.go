@@ -0,0 +1,254 @@
+package tsdb
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/encoding"
+)
+
+// A shard dump holds the postings of a single shard in the layout of the
+// postings dump, with a header identifying the shard and a CRC32
+// (Castagnoli) checksum of the symbols and postings sections:
+//
+//	┌────────────────────────────────────────────────────────────────────┐
+//	│ magic(4) │ version(1) │ reserved(3) │ shard(4) │ total shards(4)   │
+//	│ checksum(4) │ symbols length(8) │ postings length(8)               │
+//	├────────────────────────────────────────────────────────────────────┤
+//	│ symbols of the shard, as in the postings dump                      │
+//	├────────────────────────────────────────────────────────────────────┤
+//	│ postings of the shard, as in the postings dump                     │
+//	└────────────────────────────────────────────────────────────────────┘
+const (
+	shardDumpMagic      = 0x50485358 // "PHSX"
+	shardDumpVersion    = 1
+	shardDumpHeaderSize = 36
+	shardDumpPrefix     = "shard-"
+	shardDumpSuffix     = ".idx"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// shardDumpFile returns the name of the dump file of the shard.
+func shardDumpFile(shard uint32) string {
+	return fmt.Sprintf("%s%04d%s", shardDumpPrefix, shard, shardDumpSuffix)
+}
+
+// DumpShards writes the postings of each shard to its own file in dir,
+// created if needed, named after the shard: shard-0000.idx, shard-0001.idx
+// and so on. The files can be loaded with LoadShards. Each file is written
+// under a temporary name then renamed, so a crash never leaves a partial
+// shard file. As for DumpPostings, the dump is only consistent per shard
+// under concurrent writes.
+func (ii *InvertedIndex) DumpShards(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, shard := range ii.shards {
+		symbols, postings := encodePostingsSections([][]dumpedPair{shard.dumpPairs()})
+		checksum := crc32.Update(crc32.Checksum(symbols, castagnoliTable), castagnoliTable, postings)
+
+		b := encoding.EncWith(make([]byte, 0, shardDumpHeaderSize+len(symbols)+len(postings)))
+		b.PutBE32(shardDumpMagic)
+		b.PutByte(shardDumpVersion)
+		b.PutBytes([]byte{0, 0, 0})
+		b.PutBE32(shard.shard)
+		b.PutBE32(ii.totalShards)
+		b.PutBE32(checksum)
+		b.PutBE64(uint64(len(symbols)))
+		b.PutBE64(uint64(len(postings)))
+		b.PutBytes(symbols)
+		b.PutBytes(postings)
+		if err := writeFileAtomic(filepath.Join(dir, shardDumpFile(shard.shard)), b.Get()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes b to a temporary file renamed to name once synced,
+// so that a crash never leaves a partial file under name. The temporary
+// file doesn't match the shard files LoadShards looks for.
+func writeFileAtomic(name string, b []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// LoadShards builds an index of totalShards shards from the shard files
+// written by DumpShards found in dir, loading them in parallel. Shards
+// without a file in dir are left empty, so that a subset of the shards can
+// be loaded by only providing their files. It fails with
+// ErrInvalidPostingsDump if dir holds no shard file, or if a file is
+// malformed, does not match its checksum or was dumped from an index of
+// another shard count. See LoadShardsWithOptions to load the other shards
+// when some are corrupt.
+func LoadShards(dir string, totalShards uint32) (*InvertedIndex, error) {
+	ii, _, err := LoadShardsWithOptions(dir, totalShards, LoadOptions{})
+	return ii, err
+}
+
+// LoadOptions configures LoadShardsWithOptions. The zero value is the
+// strict behaviour of LoadShards.
+type LoadOptions struct {
+	// LenientLoad leaves the shards whose file can't be read or is invalid
+	// empty rather than failing the load, reporting them in
+	// LoadResult.CorruptShards, so that the index stays partially available
+	// after disk corruption. Loading still fails if dir holds no shard file
+	// or a file of a shard out of range.
+	LenientLoad bool
+	// OnCorruptShard is called with each shard left empty by LenientLoad
+	// and the error its file failed with, e.g. to log it. It may be called
+	// concurrently.
+	OnCorruptShard func(shard uint32, err error)
+}
+
+// LoadResult reports what LoadShardsWithOptions couldn't load.
+type LoadResult struct {
+	// CorruptShards are the shards left empty by LenientLoad, sorted.
+	CorruptShards []uint32
+}
+
+// LoadShardsWithOptions is LoadShards with the given options.
+func LoadShardsWithOptions(dir string, totalShards uint32, opts LoadOptions) (*InvertedIndex, LoadResult, error) {
+	if err := validateShardCount(totalShards); err != nil {
+		return nil, LoadResult{}, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, LoadResult{}, err
+	}
+	var shards []uint32
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, shardDumpPrefix) || !strings.HasSuffix(name, shardDumpSuffix) {
+			continue
+		}
+		i, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, shardDumpPrefix), shardDumpSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(i) >= totalShards {
+			return nil, LoadResult{}, fmt.Errorf("%w: %s: shard %d of %d", ErrInvalidPostingsDump, name, i, totalShards)
+		}
+		shards = append(shards, uint32(i))
+	}
+	if len(shards) == 0 {
+		return nil, LoadResult{}, fmt.Errorf("%w: no shard file in %s", ErrInvalidPostingsDump, dir)
+	}
+
+	ii := NewWithShards(totalShards)
+	// corrupt[i] is set by the goroutine loading shards[i] only
+	corrupt := make([]bool, len(shards))
+	var g errgroup.Group
+	g.SetLimit(runtime.GOMAXPROCS(0))
+	for j, i := range shards {
+		j, i := j, i
+		g.Go(func() error {
+			name := filepath.Join(dir, shardDumpFile(i))
+			err := loadShardFile(ii.shards[i], name, totalShards)
+			if err == nil || !opts.LenientLoad {
+				return err
+			}
+			// the shard may hold the series decoded before the error
+			fresh := newIndexShard(i, ii.opts)
+			fresh.setMatches, fresh.generations = ii.shards[i].setMatches, ii.shards[i].generations
+			ii.shards[i] = fresh
+			corrupt[j] = true
+			if opts.OnCorruptShard != nil {
+				opts.OnCorruptShard(i, err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, LoadResult{}, err
+	}
+
+	var result LoadResult
+	for j, i := range shards {
+		if corrupt[j] {
+			result.CorruptShards = append(result.CorruptShards, i)
+		}
+	}
+	sort.Slice(result.CorruptShards, func(a, b int) bool { return result.CorruptShards[a] < result.CorruptShards[b] })
+	return ii, result, nil
+}
+
+// loadShardFile adds the series of the shard dump file name to the shard.
+func loadShardFile(shard *indexShard, name string, totalShards uint32) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := shard.loadShardDump(b, totalShards); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// loadShardDump adds the series of the shard dump b to the shard.
+func (shard *indexShard) loadShardDump(b []byte, totalShards uint32) error {
+	if len(b) < shardDumpHeaderSize {
+		return fmt.Errorf("%w: short header", ErrInvalidPostingsDump)
+	}
+	header := encoding.DecWith(b[:shardDumpHeaderSize])
+	if magic := header.Be32(); magic != shardDumpMagic {
+		return fmt.Errorf("%w: invalid magic number %x", ErrInvalidPostingsDump, magic)
+	}
+	if version := header.Byte(); version != shardDumpVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidPostingsDump, version)
+	}
+	header.Skip(3)
+	if i, n := header.Be32(), header.Be32(); i != shard.shard || n != totalShards {
+		return fmt.Errorf("%w: shard %d of %d dumped as shard %d of %d", ErrInvalidPostingsDump, shard.shard, totalShards, i, n)
+	}
+	checksum := header.Be32()
+	symbolsLen, postingsLen := header.Be64(), header.Be64()
+	b = b[shardDumpHeaderSize:]
+	// checked one at a time as their sum may wrap around
+	if symbolsLen > uint64(len(b)) || postingsLen != uint64(len(b))-symbolsLen {
+		return fmt.Errorf("%w: sections of %d and %d bytes, %d available", ErrInvalidPostingsDump, symbolsLen, postingsLen, len(b))
+	}
+	if crc := crc32.Checksum(b, castagnoliTable); crc != checksum {
+		return fmt.Errorf("%w: checksum %x, expected %x", ErrInvalidPostingsDump, crc, checksum)
+	}
+
+	symbol, err := decodeSymbols(b[:symbolsLen])
+	if err != nil {
+		return err
+	}
+	d := encoding.DecWith(b[symbolsLen:])
+	if err := shard.loadPostings(&d, symbol); err != nil {
+		return err
+	}
+	if d.Len() > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidPostingsDump, d.Len())
+	}
+	return nil
+}
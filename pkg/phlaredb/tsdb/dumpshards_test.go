@@ -0,0 +1,140 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_DumpLoadShards(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"__name__", "cpu",
+			"env", fmt.Sprint("env-", i%3),
+			"pod", fmt.Sprint("pod-", i),
+		), model.Fingerprint(i*1e15))
+	}
+	dir := filepath.Join(t.TempDir(), "dump")
+	require.NoError(t, ii.DumpShards(dir))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 8)
+	require.Equal(t, "shard-0000.idx", entries[0].Name())
+
+	loaded, err := LoadShards(dir, 8)
+	require.NoError(t, err)
+	require.NoError(t, loaded.Validate())
+	require.True(t, ii.Diff(loaded).Empty())
+
+	// a subset of the shards
+	require.NoError(t, os.Remove(filepath.Join(dir, shardDumpFile(3))))
+	loaded, err = LoadShards(dir, 8)
+	require.NoError(t, err)
+	require.NoError(t, loaded.Validate())
+	for i := range ii.shards {
+		if i == 3 {
+			require.Empty(t, loaded.shards[i].allFPs())
+			continue
+		}
+		require.Equal(t, ii.shards[i].allFPs(), loaded.shards[i].allFPs())
+	}
+
+	_, err = LoadShards(dir, 4)
+	require.ErrorIs(t, err, ErrInvalidPostingsDump)
+	_, err = LoadShards(dir, 0)
+	require.ErrorIs(t, err, ErrInvalidShardCount)
+	_, err = LoadShards(t.TempDir(), 8)
+	require.ErrorIs(t, err, ErrInvalidPostingsDump)
+}
+
+func Test_LoadShardsInvalid(t *testing.T) {
+	ii := NewWithShards(2)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), 1)
+	dir := t.TempDir()
+	require.NoError(t, ii.DumpShards(dir))
+	file := shardDumpFile(ii.ShardForLabels(phlaremodel.LabelsFromStrings("foo", "bar")))
+	dump, err := os.ReadFile(filepath.Join(dir, file))
+	require.NoError(t, err)
+
+	corrupted := append([]byte{}, dump...)
+	corrupted[len(corrupted)-1]++
+	otherShard := append([]byte{}, dump...)
+	otherShard[11] ^= 1
+	// section lengths summing to the available bytes once wrapped around
+	overflow := append([]byte{}, dump...)
+	binary.BigEndian.PutUint64(overflow[20:], math.MaxUint64)
+	binary.BigEndian.PutUint64(overflow[28:], uint64(len(dump)-shardDumpHeaderSize+1))
+
+	for name, b := range map[string][]byte{
+		"empty":     {},
+		"truncated": dump[:len(dump)-1],
+		"checksum":  corrupted,
+		"shard":     otherShard,
+		"overflow":  overflow,
+		"magic":     append([]byte{0}, dump[1:]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, file), b, 0o644))
+			_, err := LoadShards(dir, 2)
+			require.ErrorIs(t, err, ErrInvalidPostingsDump)
+			require.NotContains(t, err.Error(), "no shard file")
+		})
+	}
+}
+
+func Test_LoadShardsLenient(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	dir := t.TempDir()
+	require.NoError(t, ii.DumpShards(dir))
+	// shard 1 fails its checksum, shard 2 is truncated
+	name := filepath.Join(dir, shardDumpFile(1))
+	dump, err := os.ReadFile(name)
+	require.NoError(t, err)
+	dump[len(dump)-1]++
+	require.NoError(t, os.WriteFile(name, dump, 0o644))
+	name = filepath.Join(dir, shardDumpFile(2))
+	dump, err = os.ReadFile(name)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(name, dump[:len(dump)/2], 0o644))
+
+	_, err = LoadShards(dir, 4)
+	require.ErrorIs(t, err, ErrInvalidPostingsDump)
+
+	var mtx sync.Mutex
+	reported := map[uint32]error{}
+	loaded, result, err := LoadShardsWithOptions(dir, 4, LoadOptions{
+		LenientLoad: true,
+		OnCorruptShard: func(shard uint32, err error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			reported[shard] = err
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1, 2}, result.CorruptShards)
+	require.Len(t, reported, 2)
+	require.ErrorIs(t, reported[1], ErrInvalidPostingsDump)
+	require.ErrorIs(t, reported[2], ErrInvalidPostingsDump)
+	require.NoError(t, loaded.Validate())
+	for i := range ii.shards {
+		if i == 1 || i == 2 {
+			require.Empty(t, loaded.shards[i].allFPs())
+			continue
+		}
+		require.Equal(t, ii.shards[i].allFPs(), loaded.shards[i].allFPs())
+	}
+}
@@ -0,0 +1,99 @@
+package tsdb
+
+import (
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// Reader is the query side of an index.
+type Reader interface {
+	Lookup(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error)
+	LabelNames(shard *shard.Annotation) ([]string, error)
+	LabelValues(name string, shard *shard.Annotation) ([]string, error)
+}
+
+var (
+	_ Reader = (*InvertedIndex)(nil)
+	_ Reader = (*Federated)(nil)
+)
+
+// Federated queries several indexes as one, e.g. the indexes of consecutive
+// time blocks. Every query is sent to each index and their results merged:
+// fingerprints are deduplicated and ordered like the results of the first
+// index, label names and values are deduplicated and sorted. The shard
+// annotation is validated against each index.
+type Federated struct {
+	indexes     []*InvertedIndex
+	concurrency int
+}
+
+// NewFederated returns a reader over the given indexes, querying at most
+// concurrency of them at a time. A non-positive concurrency queries them all
+// at once.
+func NewFederated(concurrency int, indexes ...*InvertedIndex) *Federated {
+	return &Federated{indexes: indexes, concurrency: concurrency}
+}
+
+func (f *Federated) Lookup(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	results := make([][]model.Fingerprint, len(f.indexes))
+	err := f.forEach(func(i int, ii *InvertedIndex) error {
+		fps, err := ii.Lookup(matchers, shard)
+		if ii.opts.DescendingPostings {
+			// results are fresh slices, merged in ascending order
+			reverseFingerprints(fps)
+		}
+		results[i] = fps
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := mergeFingerprintSlices(results)
+	if len(f.indexes) > 0 {
+		f.indexes[0].orderFingerprints(result)
+	}
+	return result, nil
+}
+
+func (f *Federated) LabelNames(shard *shard.Annotation) ([]string, error) {
+	results := make([][]string, len(f.indexes))
+	err := f.forEach(func(i int, ii *InvertedIndex) (err error) {
+		results[i], err = ii.LabelNames(shard)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeStringSlices(results), nil
+}
+
+func (f *Federated) LabelValues(name string, shard *shard.Annotation) ([]string, error) {
+	results := make([][]string, len(f.indexes))
+	err := f.forEach(func(i int, ii *InvertedIndex) (err error) {
+		results[i], err = ii.LabelValues(name, shard)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mergeStringSlices(results), nil
+}
+
+// forEach calls fn for each index with the configured concurrency, and
+// returns the first error.
+func (f *Federated) forEach(fn func(i int, ii *InvertedIndex) error) error {
+	var g errgroup.Group
+	if f.concurrency > 0 {
+		g.SetLimit(f.concurrency)
+	}
+	for i, ii := range f.indexes {
+		i, ii := i, ii
+		g.Go(func() error {
+			return fn(i, ii)
+		})
+	}
+	return g.Wait()
+}
@@ -0,0 +1,80 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_Federated(t *testing.T) {
+	blocks := make([]*InvertedIndex, 3)
+	for b := range blocks {
+		blocks[b] = NewWithShards(4)
+		// consecutive blocks share half of their series
+		for i := b * 5; i < b*5+10; i++ {
+			blocks[b].Add(phlaremodel.LabelsFromStrings(
+				"env", "prod",
+				"pod", fmt.Sprint("pod-", i),
+				fmt.Sprint("block_", b), "true",
+			), model.Fingerprint(i))
+		}
+	}
+	prod := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}
+
+	for _, concurrency := range []int{0, 1, 2} {
+		f := NewFederated(concurrency, blocks...)
+
+		fps, err := f.Lookup(prod, nil)
+		require.NoError(t, err)
+		require.Len(t, fps, 20)
+		for i, fp := range fps {
+			require.Equal(t, model.Fingerprint(i), fp)
+		}
+		fps, err = f.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-(4|5|14)")}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []model.Fingerprint{4, 5, 14}, fps)
+
+		names, err := f.LabelNames(nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{"block_0", "block_1", "block_2", "env", "pod"}, names)
+
+		values, err := f.LabelValues("env", nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{"prod"}, values)
+		values, err = f.LabelValues("pod", &shard.Annotation{Shard: 0, Of: 2})
+		require.NoError(t, err)
+		require.NotEmpty(t, values)
+	}
+
+	// errors of any index fail the query
+	_, err := NewFederated(0, blocks[0], NewWithShards(3)).Lookup(prod, &shard.Annotation{Shard: 0, Of: 2})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+
+	fps, err := NewFederated(0).Lookup(prod, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+}
+
+func Test_FederatedDescending(t *testing.T) {
+	desc := NewWithOptions(2, IndexOptions{DescendingPostings: true})
+	asc := NewWithShards(2)
+	for i := 0; i < 6; i++ {
+		if i%2 == 0 {
+			desc.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+		} else {
+			asc.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+		}
+	}
+	fps, err := NewFederated(0, desc, asc).Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{5, 4, 3, 2, 1, 0}, fps)
+	fps, err = NewFederated(0, asc, desc).Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{0, 1, 2, 3, 4, 5}, fps)
+}
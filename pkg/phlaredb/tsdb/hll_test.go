@@ -0,0 +1,22 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HyperLogLog(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			h := &hyperLogLog{}
+			for i := 0; i < n; i++ {
+				h.insert(fmt.Sprint("value-", i))
+				// repeated values are only counted once.
+				h.insert(fmt.Sprint("value-", i%(n/2+1)))
+			}
+			require.InDelta(t, float64(n), float64(h.estimate()), float64(n)*0.05+0.5)
+		})
+	}
+}
@@ -9,15 +9,20 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"regexp"
+	"regexp/syntax"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
 	"unsafe"
 
+	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"go.uber.org/atomic"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
@@ -28,8 +33,41 @@ var (
 	// Bitmap used by func isRegexMetaCharacter to check whether a character needs to be escaped.
 	regexMetaCharacterBytes [16]byte
 	ErrInvalidShardQuery    = errors.New("incompatible index shard query")
+	ErrShardOutOfRange      = errors.New("index shard out of range")
+	ErrInvalidMatcher       = errors.New("invalid matcher")
+	ErrDuplicateLabelName   = errors.New("duplicate label name")
+	ErrClosed               = errors.New("index closed")
+	ErrInvalidShardCount    = errors.New("invalid index shard count")
+	ErrInvalidBucketBits    = errors.New("invalid fingerprint bucket bits")
+	ErrSeriesNotFound       = errors.New("series not found")
+	ErrTooManyLabelValues   = errors.New("too many label values")
+
+	// ErrShardNotDivisor, ErrShardTooLarge, ErrShardFactorNotPositive and
+	// ErrShardNotInFactor detail why a shard query is incompatible with the
+	// index and all wrap ErrInvalidShardQuery.
+	ErrShardNotDivisor        = fmt.Errorf("%w: shard factor does not divide the index shard count", ErrInvalidShardQuery)
+	ErrShardTooLarge          = fmt.Errorf("%w: shard factor exceeds the index shard count", ErrInvalidShardQuery)
+	ErrShardFactorNotPositive = fmt.Errorf("%w: shard factor is not positive", ErrInvalidShardQuery)
+	ErrShardNotInFactor       = fmt.Errorf("%w: shard is not within the shard factor", ErrInvalidShardQuery)
+
+	// ErrRegexpTooComplex is returned for regexp matchers exceeding
+	// IndexOptions.MaxRegexpProgramSize, it wraps ErrInvalidMatcher.
+	ErrRegexpTooComplex = fmt.Errorf("%w: regexp too complex", ErrInvalidMatcher)
 )
 
+// LimitExceededError is returned by Lookup when the number of matching
+// fingerprints exceeds IndexOptions.MaxLookupResults.
+type LimitExceededError struct {
+	Limit int
+	// Count is the number of fingerprints accumulated when the lookup was
+	// aborted, a lower bound of the actual number of matches.
+	Count int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("lookup results limit exceeded: got at least %d results, limit is %d", e.Count, e.Limit)
+}
+
 // isRegexMetaCharacter reports whether byte b needs to be escaped.
 func isRegexMetaCharacter(b byte) bool {
 	return b < utf8.RuneSelf && regexMetaCharacterBytes[b%16]&(1<<(b/16)) != 0
@@ -41,7 +79,11 @@ func init() {
 	}
 }
 
-const DefaultIndexShards = 32
+const (
+	DefaultIndexShards = 32
+	// MaxIndexShards is the largest shard count accepted by NewChecked.
+	MaxIndexShards = 1 << 12
+)
 
 type Interface interface {
 	Add(labels []*commonv1.LabelPair, fp model.Fingerprint) labels.Labels
@@ -56,19 +98,214 @@ type Interface interface {
 type InvertedIndex struct {
 	totalShards uint32
 	shards      []*indexShard
+	opts        IndexOptions
+	hasher      *labelsHasher
+	lookupCache *lookupCache
+	// lookupLimiter is nil unless IndexOptions.MaxLookupGoroutines is set.
+	lookupLimiter *lookupLimiter
+
+	compactorStarted atomic.Bool
+	// stopCompactor is set by StartCompactor and called by Close.
+	stopCompactorMtx sync.Mutex
+	stopCompactor    func()
+	closed           atomic.Bool
 }
 
+// IndexOptions configures optional behaviour of an InvertedIndex.
+// The zero value is the default used by NewWithShards.
+type IndexOptions struct {
+	// PoolPostings recycles the fingerprint slices of postings removed by
+	// Delete, reusing them for postings created by subsequent adds.
+	PoolPostings bool
+	// TrackLastWrite records when each label value last received a
+	// fingerprint, which is required by PurgeOlderThan.
+	TrackLastWrite bool
+	// MaxLookupResults makes Lookup fail with a *LimitExceededError when
+	// more fingerprints would be returned. Zero means unlimited.
+	MaxLookupResults int
+	// BitmapPostings stores postings in roaring bitmaps instead of sorted
+	// slices, combined with the native roaring And and Or at lookup. See
+	// BenchmarkPostings and BenchmarkLookup for the trade-offs.
+	BitmapPostings bool
+	// SetMatchesCacheSize bounds the number of regex matcher values whose
+	// extracted set members (see FindSetMatches) are cached across
+	// lookups. Zero disables the cache.
+	SetMatchesCacheSize int
+	// SortedValues maintains the values of each label name in sorted order,
+	// making LabelValuesWithPrefix and LookupNumericRange sublinear in the
+	// number of values at the expense of memory and insertion cost. See
+	// BenchmarkValueScans.
+	SortedValues bool
+	// ImmutablePostings makes postings copy-on-write, so that Lookup only
+	// holds the shard read lock while collecting the postings of the
+	// matched values, and intersects them after releasing it. Each add and
+	// delete copies the postings it modifies. Ignored if BitmapPostings is
+	// set.
+	ImmutablePostings bool
+	// DeltaPostings stores postings as blocks of delta-varint encoded
+	// fingerprints, trading CPU at query time for memory. See
+	// BenchmarkPostingsMemory. Ignored if BitmapPostings or
+	// ImmutablePostings is set.
+	DeltaPostings bool
+	// HashBufferSize is the initial size of the buffers used to serialize
+	// label sets when hashing them to a shard, 1000 bytes by default.
+	HashBufferSize int
+	// MaxPooledHashBufferSize is the size above which hashing buffers grown
+	// by long label sets are dropped rather than recycled, 64KiB by default.
+	MaxPooledHashBufferSize int
+	// MetricNameAsLabel hashes the __name__ label like any other label of
+	// the sorted label set, rather than leading the hashed string with its
+	// value as model.Metric.String() does. The shard of a series then
+	// depends on its full label set only, which suits profiling series not
+	// using the metric name convention. It changes the shard of every
+	// series carrying a metric name, so it can't be toggled on an existing
+	// index.
+	MetricNameAsLabel bool
+	// OnEvict is called by Delete with the fingerprint and labels of a
+	// series once the fingerprint no longer appears in any postings. It is
+	// called after releasing the shard lock, so it may use the index.
+	OnEvict func(fp model.Fingerprint, labels phlaremodel.Labels)
+	// MaxValuesPerLabel is a safety valve against cardinality explosions:
+	// once a label name has that many distinct values in a shard, pairs
+	// with new values for it are dropped when series are added, while the
+	// series are still indexed under their other labels, and the labels
+	// returned by Add omit them. Values are spread over shards, so a label
+	// can hold up to that many values per shard. SetPostings fails with
+	// ErrTooManyLabelValues instead of installing a new value over the cap.
+	// Zero disables the cap.
+	MaxValuesPerLabel int
+	// OnDroppedPair is called with each pair dropped by MaxValuesPerLabel,
+	// e.g. to alert on misbehaving clients. It is called after releasing
+	// the shard lock, so it may use the index.
+	OnDroppedPair func(fp model.Fingerprint, name, value string)
+	// QueryLogger is called with an audit of every Lookup, LabelNames and
+	// LabelValues call once it completes, including the ones made by other
+	// methods of the index, e.g. to log them. It's called synchronously, so
+	// it should be cheap.
+	QueryLogger func(QueryAudit)
+	// DeleteFallbackSearch makes Delete search the other shards for the
+	// fingerprint when the shard its labels route to doesn't hold it, e.g.
+	// because the labels differ from the ones it was added with, and delete
+	// it there with its stored labels rather than leaking it. It costs a
+	// lookup per shard for fingerprints deleted more than once.
+	DeleteFallbackSearch bool
+	// OnDeleteMismatch is called by Delete, with DeleteFallbackSearch, when
+	// the fingerprint is found and deleted in a shard other than the one
+	// its labels route to, e.g. to log the mismatch. It is called after
+	// releasing the shard lock.
+	OnDeleteMismatch func(fp model.Fingerprint, labels phlaremodel.Labels, routed, found uint32)
+	// EmptyMatchMeansAbsent gives equality matchers on an empty value the
+	// Prometheus semantics: `l=""` matches the series without the label l,
+	// as well as the ones storing an empty value for it. By default only
+	// the series storing an empty value match. Regardless of this option,
+	// the match-all regexps the index resolves without evaluating them,
+	// such as `l=~".*"`, match the series without the label as in
+	// Prometheus. Other regexps accepting the empty value, such as
+	// `l=~"a?"`, only match the series storing a value.
+	EmptyMatchMeansAbsent bool
+	// CacheLabelValues caches the sorted values of each label name returned
+	// by LabelValues until a value is added or removed, rather than sorting
+	// them on every call. Ignored if SortedValues is set.
+	CacheLabelValues bool
+	// MaxRegexpProgramSize bounds the number of instructions regexp matchers
+	// compile to, failing lookups with larger ones with ErrRegexpTooComplex
+	// rather than evaluating them against every value of their label.
+	// 65536 by default, which legitimate queries stay well below. Negative
+	// disables the check.
+	MaxRegexpProgramSize int
+	// LookupCacheSize bounds the number of lookup results cached per matcher
+	// set and shard annotation, see WarmCache. Cached results are ignored
+	// once a series carrying one of the label names they depend on is
+	// written. Zero disables the cache.
+	LookupCacheSize int
+	// LookupCacheTTL is how long lookup results stay cached, zero meaning
+	// until they're invalidated or evicted.
+	LookupCacheTTL time.Duration
+	// MaxLookupGoroutines makes lookups evaluate their shards concurrently,
+	// bounding the goroutines evaluating shards across all the lookups of
+	// the index. Once the bound is reached, lookups evaluate their
+	// remaining shards in their own goroutine rather than waiting, see
+	// InFlightLookupGoroutines. Lookups with a budget remain sequential.
+	// Zero evaluates shards sequentially.
+	MaxLookupGoroutines int
+	// PairBloomFilterBits is the size of a per shard bloom filter of the
+	// indexed label pairs, letting lookups skip the shards which lack the
+	// pair of an equality matcher without taking their lock. Deleted pairs
+	// are only dropped from the filter by Compact. Zero disables the filter.
+	PairBloomFilterBits int
+	// LabelEnricher transforms the labels of the series returned by
+	// MatchSeries, SeriesAsPromLabels and StreamSeries, e.g. to add labels
+	// derived from the stored ones. It is given a copy of the stored labels,
+	// which it may modify and return, and never affects lookups.
+	LabelEnricher func(phlaremodel.Labels) phlaremodel.Labels
+	// ValueNormalizer canonicalizes label values before they are indexed,
+	// e.g. to fold casing variants into a single value, and must be
+	// deterministic. It's also applied to the labels given to deletes and
+	// to the values of equality matchers, while regexp matchers are
+	// evaluated as is against the normalized values. Changing it requires
+	// rebuilding the index.
+	ValueNormalizer func(name, value string) string
+	// DescendingPostings makes lookups and series queries return their
+	// results in descending rather than ascending fingerprint order.
+	// Postings are still stored in ascending order, which intersections and
+	// merges rely on, and results are reversed on their way out:
+	// ShardReader.VisitPostings visits the postings as stored.
+	DescendingPostings bool
+	// CompactorPurgeAge makes the compactor started by StartCompactor also
+	// purge the label values which haven't been written to for that long.
+	// It requires TrackLastWrite. Zero disables purging.
+	CompactorPurgeAge time.Duration
+}
+
+// NewWithShards returns an index with the default options. A zero shard
+// count falls back to DefaultIndexShards.
 func NewWithShards(totalShards uint32) *InvertedIndex {
+	return NewWithOptions(totalShards, IndexOptions{})
+}
+
+// NewChecked is NewWithOptions rejecting shard counts outside of
+// [1, MaxIndexShards] with ErrInvalidShardCount.
+func NewChecked(totalShards uint32, opts IndexOptions) (*InvertedIndex, error) {
+	if err := validateShardCount(totalShards); err != nil {
+		return nil, err
+	}
+	return NewWithOptions(totalShards, opts), nil
+}
+
+func validateShardCount(totalShards uint32) error {
+	if totalShards == 0 || totalShards > MaxIndexShards {
+		return fmt.Errorf("%w: %d, must be between 1 and %d", ErrInvalidShardCount, totalShards, MaxIndexShards)
+	}
+	return nil
+}
+
+// NewWithOptions returns an index with the given options. A zero shard count
+// falls back to DefaultIndexShards, see NewChecked to reject it instead.
+func NewWithOptions(totalShards uint32, opts IndexOptions) *InvertedIndex {
+	if totalShards == 0 {
+		totalShards = DefaultIndexShards
+	}
+	setMatches := newSetMatchesCache(opts.SetMatchesCacheSize)
+	lookupCache := newLookupCache(opts.LookupCacheSize, opts.LookupCacheTTL)
+	var generations *labelGenerations
+	if lookupCache != nil {
+		generations = lookupCache.gens
+	}
 	shards := make([]*indexShard, totalShards)
 	for i := uint32(0); i < totalShards; i++ {
-		shards[i] = &indexShard{
-			idx:   map[string]indexEntry{},
-			shard: i,
-		}
+		shards[i] = newIndexShard(i, opts)
+		shards[i].setMatches = setMatches
+		shards[i].generations = generations
 	}
+	hasher := newLabelsHasher(opts.HashBufferSize, opts.MaxPooledHashBufferSize)
+	hasher.metricNameAsLabel = opts.MetricNameAsLabel
 	return &InvertedIndex{
-		totalShards: totalShards,
-		shards:      shards,
+		totalShards:   totalShards,
+		shards:        shards,
+		opts:          opts,
+		hasher:        hasher,
+		lookupCache:   lookupCache,
+		lookupLimiter: newLookupLimiter(opts.MaxLookupGoroutines),
 	}
 }
 
@@ -89,54 +326,255 @@ func (ii *InvertedIndex) getShards(shard *shard.Annotation) []*indexShard {
 }
 
 func (ii *InvertedIndex) validateShard(shard *shard.Annotation) error {
+	return ValidateShardAnnotation(ii.totalShards, shard)
+}
+
+// ValidateShardAnnotation checks that shard can query an index of totalShards
+// shards, returning ErrShardTooLarge or ErrShardNotDivisor otherwise. A nil
+// annotation is always valid.
+func ValidateShardAnnotation(totalShards uint32, shard *shard.Annotation) error {
 	if shard == nil {
 		return nil
 	}
-	if int(ii.totalShards)%shard.Of != 0 || uint32(shard.Of) > ii.totalShards {
-		return fmt.Errorf("%w index_shard:%d query_shard:%v", ErrInvalidShardQuery, ii.totalShards, shard)
+	if shard.Of <= 0 {
+		return fmt.Errorf("%w query_shard:%v", ErrShardFactorNotPositive, shard)
+	}
+	if shard.Shard < 0 || shard.Shard >= shard.Of {
+		return fmt.Errorf("%w query_shard:%v", ErrShardNotInFactor, shard)
+	}
+	if uint32(shard.Of) > totalShards {
+		return fmt.Errorf("%w index_shard:%d query_shard:%v", ErrShardTooLarge, totalShards, shard)
+	}
+	if int(totalShards)%shard.Of != 0 {
+		return fmt.Errorf("%w index_shard:%d query_shard:%v", ErrShardNotDivisor, totalShards, shard)
+	}
+	return nil
+}
+
+// Close stops the compactor started by StartCompactor, if any, and waits for
+// it to exit. Afterwards writes are ignored, or fail with ErrClosed for the
+// ones returning an error, while queries keep serving the final state of
+// the index. Closing an index more than once is a no-op.
+func (ii *InvertedIndex) Close() error {
+	if !ii.closed.CAS(false, true) {
+		return nil
+	}
+	ii.stopCompactorMtx.Lock()
+	stop := ii.stopCompactor
+	ii.stopCompactorMtx.Unlock()
+	if stop != nil {
+		stop()
 	}
 	return nil
 }
 
 // Add a fingerprint under the specified labels.
+// Labels carrying the same name more than once keep their last value, use
+// AddStrict to reject them instead.
+// It is a no-op returning nil once the index is closed.
+// The returned labels are retained by the index, keeping them rather than
+// a copy avoids holding the labels of the series twice.
 // NOTE: memory for `labels` is unsafe; anything retained beyond the
 // life of this function must be copied
 func (ii *InvertedIndex) Add(labels phlaremodel.Labels, fp model.Fingerprint) phlaremodel.Labels {
-	shardIndex := labelsSeriesIDHash(labels)
-	shard := ii.shards[shardIndex%ii.totalShards]
+	if ii.closed.Load() {
+		return nil
+	}
+	labels, _ = dedupeLabelNames(labels)
+	labels = ii.normalize(labels)
+	shard := ii.shards[ii.ShardForLabels(labels)]
 	return shard.add(labels, fp) // add() returns 'interned' values so the original labels are not retained
 }
 
-var (
-	bufferPool = sync.Pool{
-		New: func() interface{} {
-			return bytes.NewBuffer(make([]byte, 0, 1000))
-		},
+// AddStrict is like Add but fails with ErrDuplicateLabelName, without adding
+// anything, if labels carry the same name more than once.
+func (ii *InvertedIndex) AddStrict(labels phlaremodel.Labels, fp model.Fingerprint) (phlaremodel.Labels, error) {
+	if ii.closed.Load() {
+		return nil, ErrClosed
+	}
+	labels, dup := dedupeLabelNames(labels)
+	if dup != "" {
+		return nil, fmt.Errorf("%w: %q", ErrDuplicateLabelName, dup)
+	}
+	labels = ii.normalize(labels)
+	shard := ii.shards[ii.ShardForLabels(labels)]
+	return shard.add(labels, fp), nil
+}
+
+// AddInterned is like Add but stores the strings of labels in the index as
+// they are instead of copying them, for labels already owned by the caller,
+// e.g. returned by a previous Add. The caller must never modify the memory
+// backing those strings: unlike Add, the index retains it.
+func (ii *InvertedIndex) AddInterned(labels phlaremodel.Labels, fp model.Fingerprint) phlaremodel.Labels {
+	if ii.closed.Load() {
+		return nil
+	}
+	labels, _ = dedupeLabelNames(labels)
+	labels = ii.normalize(labels)
+	shard := ii.shards[ii.ShardForLabels(labels)]
+	return shard.insert(labels, fp, func(s string) string { return s })
+}
+
+// ShardForLabels returns the index of the shard Add routes the given labels
+// to, without adding anything.
+func (ii *InvertedIndex) ShardForLabels(labels phlaremodel.Labels) uint32 {
+	return ii.hasher.hash(labels) % ii.totalShards
+}
+
+// AddToShard adds a fingerprint under the specified labels to the given shard,
+// bypassing the labels hash based routing of Add.
+// Delete and sharded lookups route series by their labels hash: callers must
+// keep the routing of their series consistent with Add, or series added here
+// may be missed by sharded queries and never removed by Delete.
+// As for Add, labels carrying the same name more than once keep their last
+// value.
+// NOTE: memory for `labels` is unsafe, as for Add.
+func (ii *InvertedIndex) AddToShard(shardIndex uint32, labels phlaremodel.Labels, fp model.Fingerprint) (phlaremodel.Labels, error) {
+	if ii.closed.Load() {
+		return nil, ErrClosed
+	}
+	if shardIndex >= ii.totalShards {
+		return nil, fmt.Errorf("%w: shard %d of %d", ErrShardOutOfRange, shardIndex, ii.totalShards)
 	}
+	labels, _ = dedupeLabelNames(labels)
+	return ii.shards[shardIndex].add(ii.normalize(labels), fp), nil
+}
+
+const (
+	defaultHashBufferSize          = 1000
+	defaultMaxPooledHashBufferSize = 64 << 10
+)
+
+var (
+	// base64Pool buffers have a fixed size and never grow.
 	base64Pool = sync.Pool{
 		New: func() interface{} {
 			return bytes.NewBuffer(make([]byte, 0, base64.RawStdEncoding.EncodedLen(sha256.Size)))
 		},
 	}
+	defaultLabelsHasher = newLabelsHasher(0, 0)
 )
 
+// labelsHasher hashes label sets to shards, pooling the buffers used to
+// serialize them.
+type labelsHasher struct {
+	buffers       sync.Pool
+	maxPooledSize int
+	// metricNameAsLabel formats __name__ as any other label, see
+	// IndexOptions.MetricNameAsLabel.
+	metricNameAsLabel bool
+}
+
+func newLabelsHasher(size, maxPooledSize int) *labelsHasher {
+	if size <= 0 {
+		size = defaultHashBufferSize
+	}
+	if maxPooledSize <= 0 {
+		maxPooledSize = defaultMaxPooledHashBufferSize
+	}
+	h := &labelsHasher{maxPooledSize: maxPooledSize}
+	h.buffers.New = func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	return h
+}
+
+// labelsSeriesIDHash returns the hash routing a series to a shard: the
+// first 4 bytes, read as a big endian uint32, of the base64 encoded SHA-256
+// of the canonical labels formatted by labelsString. As the labels are
+// canonicalized first, the hash depends neither on the input order of the
+// labels nor on the presence of pairs with an empty value, including an
+// empty metric name.
 func labelsSeriesIDHash(ls []*commonv1.LabelPair) uint32 {
+	return defaultLabelsHasher.hash(ls)
+}
+
+// CanonicalizeLabels returns the labels sorted by name without the pairs
+// having an empty value, which are equivalent to absent labels. Names
+// appearing more than once keep their last value. The input is returned as
+// is if it is already canonical, and is never modified.
+func CanonicalizeLabels(ls phlaremodel.Labels) phlaremodel.Labels {
+	canonical := true
+	for i, l := range ls {
+		if l.Value == "" || (i > 0 && ls[i-1].Name >= l.Name) {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return ls
+	}
+	deduped, _ := dedupeLabelNames(ls)
+	result := make(phlaremodel.Labels, 0, len(deduped))
+	for _, l := range deduped {
+		if l.Value != "" {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+// dedupeLabelNames returns the labels sorted by name, keeping the last value
+// of names appearing more than once, along with the first such name. The
+// input is returned as is if it is sorted without duplicates, and is never
+// modified.
+func dedupeLabelNames(ls phlaremodel.Labels) (phlaremodel.Labels, string) {
+	sorted := true
+	for i := 1; i < len(ls); i++ {
+		if ls[i-1].Name >= ls[i].Name {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return ls, ""
+	}
+	result := make(phlaremodel.Labels, len(ls))
+	copy(result, ls)
+	// stable, so that duplicate names remain in input order
+	sort.Stable(result)
+	var dup string
+	j := 0
+	for i := range result {
+		if j > 0 && result[j-1].Name == result[i].Name {
+			if dup == "" {
+				dup = result[i].Name
+			}
+			result[j-1] = result[i]
+			continue
+		}
+		result[j] = result[i]
+		j++
+	}
+	return result[:j], dup
+}
+
+func (hasher *labelsHasher) hash(ls []*commonv1.LabelPair) uint32 {
+	ls = CanonicalizeLabels(ls)
 	b64 := base64Pool.Get().(*bytes.Buffer)
 	defer func() {
 		base64Pool.Put(b64)
 	}()
 	buf := b64.Bytes()[:b64.Cap()]
-	labelsSeriesID(ls, buf)
+	hasher.seriesID(ls, buf)
 	return binary.BigEndian.Uint32(buf)
 }
 
-func labelsSeriesID(ls []*commonv1.LabelPair, dest []byte) {
-	buf := bufferPool.Get().(*bytes.Buffer)
+func (hasher *labelsHasher) seriesID(ls []*commonv1.LabelPair, dest []byte) {
+	buf := hasher.buffers.Get().(*bytes.Buffer)
 	defer func() {
+		// drop buffers grown by long label sets, so they aren't retained
+		if buf.Cap() > hasher.maxPooledSize {
+			return
+		}
 		buf.Reset()
-		bufferPool.Put(buf)
+		hasher.buffers.Put(buf)
 	}()
-	labelsString(buf, ls)
+	if hasher.metricNameAsLabel {
+		labelSetString(buf, ls)
+	} else {
+		labelsString(buf, ls)
+	}
 	h := sha256.Sum256(buf.Bytes())
 	dest = dest[:base64.RawStdEncoding.EncodedLen(len(h))]
 	base64.RawStdEncoding.Encode(dest, h[:])
@@ -171,250 +609,2359 @@ func labelsString(b *bytes.Buffer, ls []*commonv1.LabelPair) {
 	b.WriteByte('}')
 }
 
+// labelSetString is labelsString without the metric name special case:
+// __name__ is formatted in place like any other label.
+func labelSetString(b *bytes.Buffer, ls []*commonv1.LabelPair) {
+	b.WriteByte('{')
+	for i, l := range ls {
+		if i > 0 {
+			b.WriteByte(',')
+			b.WriteByte(' ')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		var buf [1000]byte
+		b.Write(strconv.AppendQuote(buf[:0], l.Value))
+	}
+	b.WriteByte('}')
+}
+
 // Lookup all fingerprints for the provided matchers.
+// The result is sorted in ascending order, or descending with
+// IndexOptions.DescendingPostings, and free of duplicates.
 func (ii *InvertedIndex) Lookup(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if ii.opts.QueryLogger == nil {
+		result, err := ii.LookupDetailed(matchers, shard)
+		return result.Fingerprints, err
+	}
+	start := time.Now()
+	result, err := ii.LookupDetailed(matchers, shard)
+	ii.auditQuery(QueryAudit{
+		Method:   "Lookup",
+		Matchers: matchersString(matchers),
+		Shard:    shard,
+		Results:  len(result.Fingerprints),
+		Err:      err,
+	}, start)
+	return result.Fingerprints, err
+}
+
+// LookupNonNil is like Lookup but never returns a nil slice on success: a
+// lookup without matches yields an empty, non-nil slice. A nil result is
+// only ever returned together with an error.
+func (ii *InvertedIndex) LookupNonNil(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	fps, err := ii.Lookup(matchers, shard)
+	if err != nil {
+		return nil, err
+	}
+	if fps == nil {
+		fps = []model.Fingerprint{}
+	}
+	return fps, nil
+}
+
+// LookupResult is the result of LookupDetailed.
+type LookupResult struct {
+	// Fingerprints is ordered like the result of Lookup.
+	Fingerprints []model.Fingerprint
+	// ShardsQueried is the number of index shards the lookup covered.
+	ShardsQueried int
+	// ShardsWithResults is the number of shards holding matching series.
+	ShardsWithResults int
+}
+
+// LookupDetailed is like Lookup but also reports how many shards were
+// queried and how many of them contributed results, to detect incomplete
+// shard coverage.
+func (ii *InvertedIndex) LookupDetailed(matchers []*labels.Matcher, shard *shard.Annotation) (LookupResult, error) {
 	if err := ii.validateShard(shard); err != nil {
+		return LookupResult{}, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return LookupResult{}, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+	if ii.lookupCache == nil {
+		return ii.lookup(ii.getShards(shard), matchers)
+	}
+
+	key, deps := ii.lookupCacheKey(matchers, shard)
+	if result, ok := ii.lookupCache.get(key, deps); ok {
+		return result, nil
+	}
+	gens := ii.lookupCache.generations(deps)
+	result, err := ii.lookup(ii.getShards(shard), matchers)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	ii.lookupCache.put(key, gens, result)
+	return result, nil
+}
+
+// LookupOptions configures LookupWithOptions.
+type LookupOptions struct {
+	// Shard restricts the lookup to the shards of the annotation, all
+	// shards are evaluated if nil.
+	Shard *shard.Annotation
+	// ExcludeShards lists the indices of index shards not to evaluate, for
+	// instance to drain them. It applies on top of Shard.
+	ExcludeShards []uint32
+}
+
+// LookupWithOptions is like Lookup with the shards to evaluate configured by
+// opts. It fails with ErrShardOutOfRange if an excluded shard index is not
+// part of the index.
+func (ii *InvertedIndex) LookupWithOptions(matchers []*labels.Matcher, opts LookupOptions) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(opts.Shard); err != nil {
+		return nil, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
 		return nil, err
 	}
+	matchers = ii.normalizeMatchers(matchers)
+	shards := ii.getShards(opts.Shard)
+	if len(opts.ExcludeShards) > 0 {
+		excluded := make(map[uint32]struct{}, len(opts.ExcludeShards))
+		for _, i := range opts.ExcludeShards {
+			if i >= ii.totalShards {
+				return nil, fmt.Errorf("%w: excluded shard %d of %d", ErrShardOutOfRange, i, ii.totalShards)
+			}
+			excluded[i] = struct{}{}
+		}
+		// getShards may return the shards of the index itself, filter a copy
+		remaining := make([]*indexShard, 0, len(shards))
+		for _, s := range shards {
+			if _, ok := excluded[s.shard]; !ok {
+				remaining = append(remaining, s)
+			}
+		}
+		shards = remaining
+	}
+	result, err := ii.lookup(shards, matchers)
+	return result.Fingerprints, err
+}
 
-	var result []model.Fingerprint
-	shards := ii.getShards(shard)
+// lookup evaluates the matchers against the given shards. Shards skipped by
+// planLookup count as queried, as their postings were checked.
+func (ii *InvertedIndex) lookup(shards []*indexShard, matchers []*labels.Matcher) (LookupResult, error) {
+	results, err := ii.lookupShards(shards, matchers)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	return LookupResult{
+		Fingerprints:      ii.orderFingerprints(mergeFingerprintSlices(results)),
+		ShardsQueried:     len(shards),
+		ShardsWithResults: len(results),
+	}, nil
+}
+
+// lookupShards returns the sorted fingerprints of each shard matching the
+// matchers, omitting shards without matches.
+func (ii *InvertedIndex) lookupShards(shards []*indexShard, matchers []*labels.Matcher) ([][]model.Fingerprint, error) {
+	results, _, err := ii.lookupShardsUntil(shards, matchers, nil)
+	return results, err
+}
 
+// lookupShardsUntil is lookupShards checking stop, unless nil, before
+// evaluating each shard after the first one. It returns the results of the
+// shards evaluated so far as soon as stop returns true, and whether shards
+// were left out.
+func (ii *InvertedIndex) lookupShardsUntil(shards []*indexShard, matchers []*labels.Matcher, stop func() bool) ([][]model.Fingerprint, bool, error) {
 	// if no matcher is specified, all fingerprints would be returned
-	if len(matchers) == 0 {
-		for i := range shards {
-			fps := shards[i].allFPs()
-			result = append(result, fps...)
-		}
-		return result, nil
+	eval := func(s *indexShard) []model.Fingerprint { return s.allFPs() }
+	if len(matchers) > 0 {
+		shards, matchers = planLookup(shards, matchers)
+		eval = func(s *indexShard) []model.Fingerprint { return s.lookup(matchers) }
+	}
+	if stop == nil && ii.lookupLimiter != nil && len(shards) > 1 {
+		results, err := ii.lookupShardsParallel(shards, eval)
+		return results, false, err
 	}
 
+	// Series are sharded by their labels hash, so the fingerprint ranges
+	// of the shards interleave and must be merged rather than appended.
+	results := make([][]model.Fingerprint, 0, len(shards))
+	var count int
 	for i := range shards {
-		fps := shards[i].lookup(matchers)
-		result = append(result, fps...)
+		if i > 0 && stop != nil && stop() {
+			return results, true, nil
+		}
+		if fps := eval(shards[i]); len(fps) > 0 {
+			results = append(results, fps)
+			count += len(fps)
+			if err := ii.checkLookupLimit(count); err != nil {
+				return nil, false, err
+			}
+		}
 	}
-	return result, nil
+	return results, false, nil
 }
 
-// LabelNames returns all label names.
-func (ii *InvertedIndex) LabelNames(shard *shard.Annotation) ([]string, error) {
+// LookupWithBudget is like Lookup but stops evaluating shards once budget
+// has elapsed, returning the fingerprints of the shards evaluated so far
+// and whether the result is truncated. The budget is checked between
+// shards, so each shard is evaluated entirely and at least one is. A
+// non-positive budget is unlimited. Results are not cached.
+func (ii *InvertedIndex) LookupWithBudget(matchers []*labels.Matcher, shard *shard.Annotation, budget time.Duration) ([]model.Fingerprint, bool, error) {
 	if err := ii.validateShard(shard); err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	shards := ii.getShards(shard)
-	results := make([][]string, 0, len(shards))
-	for i := range shards {
-		shardResult := shards[i].labelNames(nil)
-		results = append(results, shardResult)
+	if err := ii.checkMatchers(matchers); err != nil {
+		return nil, false, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+	var stop func() bool
+	if budget > 0 {
+		start := time.Now()
+		stop = func() bool { return time.Since(start) > budget }
 	}
+	results, truncated, err := ii.lookupShardsUntil(ii.getShards(shard), matchers, stop)
+	if err != nil {
+		return nil, false, err
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), truncated, nil
+}
 
-	return mergeStringSlices(results), nil
+// LookupByMetricName returns the sorted fingerprints of the series named
+// name which match all the extra matchers. The metric name equality is
+// evaluated first, as it's usually the most selective matcher.
+func (ii *InvertedIndex) LookupByMetricName(name string, extraMatchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	for i, m := range extraMatchers {
+		if m == nil {
+			return nil, fmt.Errorf("%w at position %d", ErrInvalidMatcher, i)
+		}
+	}
+	matchers := make([]*labels.Matcher, 0, len(extraMatchers)+1)
+	matchers = append(matchers, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name))
+	return ii.Lookup(append(matchers, extraMatchers...), shard)
 }
 
-// LabelValues returns the values for the given label.
-func (ii *InvertedIndex) LabelValues(name string, shard *shard.Annotation) ([]string, error) {
+// LookupGrouped is like Lookup but returns the matching fingerprints keyed by
+// the index of the shard holding them, each group sorted. Shards without
+// matches are omitted.
+func (ii *InvertedIndex) LookupGrouped(matchers []*labels.Matcher, shard *shard.Annotation) (map[uint32][]model.Fingerprint, error) {
 	if err := ii.validateShard(shard); err != nil {
 		return nil, err
 	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return nil, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+
 	shards := ii.getShards(shard)
-	results := make([][]string, 0, len(shards))
+	if len(matchers) > 0 {
+		shards, matchers = planLookup(shards, matchers)
+	}
+	result := make(map[uint32][]model.Fingerprint, len(shards))
+	var count int
+	for _, s := range shards {
+		if fps := s.matchingFPs(matchers); len(fps) > 0 {
+			result[s.shard] = ii.orderFingerprints(fps)
+			count += len(fps)
+			if err := ii.checkLookupLimit(count); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
 
-	for i := range shards {
-		shardResult := shards[i].labelValues(name, nil)
-		results = append(results, shardResult)
+// LookupWithMatchedValues is like Lookup but also returns, for each label
+// name of a regexp matcher, the sorted distinct values of that label among
+// the matching series.
+func (ii *InvertedIndex) LookupWithMatchedValues(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, map[string][]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, nil, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return nil, nil, err
 	}
+	matchers = ii.normalizeMatchers(matchers)
 
-	return mergeStringSlices(results), nil
-}
+	matched := map[string]map[string]struct{}{}
+	for _, m := range matchers {
+		if m.Type == labels.MatchRegexp {
+			matched[m.Name] = map[string]struct{}{}
+		}
+	}
 
-// Delete a fingerprint with the given label pairs.
-func (ii *InvertedIndex) Delete(labels []*commonv1.LabelPair, fp model.Fingerprint) {
-	shard := ii.shards[labelsSeriesIDHash(labels)%ii.totalShards]
-	shard.delete(labels, fp)
+	shards := ii.getShards(shard)
+	if len(matchers) > 0 {
+		shards, matchers = planLookup(shards, matchers)
+	}
+	results := make([][]model.Fingerprint, 0, len(shards))
+	var count int
+	for _, s := range shards {
+		fps := s.matchingFPs(matchers)
+		if len(fps) == 0 {
+			continue
+		}
+		results = append(results, fps)
+		count += len(fps)
+		if err := ii.checkLookupLimit(count); err != nil {
+			return nil, nil, err
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		for _, series := range s.seriesLabels(fps) {
+			for name, values := range matched {
+				values[series.labels.Get(name)] = struct{}{}
+			}
+		}
+	}
+
+	values := make(map[string][]string, len(matched))
+	for name, set := range matched {
+		result := make([]string, 0, len(set))
+		for value := range set {
+			result = append(result, value)
+		}
+		sort.Strings(result)
+		values[name] = result
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), values, nil
 }
 
-// NB slice entries are sorted in fp order.
-type indexEntry struct {
-	name string
-	fps  map[string]indexValueEntry
+// LookupByNamePattern returns the sorted fingerprints of the series having
+// any label whose name matches namePattern, which is not anchored, and whose
+// value satisfies valueMatcher. The name of valueMatcher is ignored, and a nil
+// valueMatcher matches any value.
+func (ii *InvertedIndex) LookupByNamePattern(namePattern *regexp.Regexp, valueMatcher *labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	if valueMatcher != nil {
+		if err := ii.checkMatchers([]*labels.Matcher{valueMatcher}); err != nil {
+			return nil, err
+		}
+		valueMatcher = ii.normalizeMatcher(valueMatcher)
+	}
+
+	shards := ii.getShards(shard)
+	results := make([][]model.Fingerprint, 0, len(shards))
+	for i := range shards {
+		if fps := shards[i].lookupByNamePattern(namePattern, valueMatcher); len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), nil
 }
 
-type indexValueEntry struct {
-	value string
-	fps   []model.Fingerprint
+// AllFingerprints returns the fingerprints of all series, ordered like the
+// result of Lookup.
+func (ii *InvertedIndex) AllFingerprints(shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+
+	shards := ii.getShards(shard)
+	results := make([][]model.Fingerprint, 0, len(shards))
+	for i := range shards {
+		if fps := shards[i].allFPs(); len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), nil
 }
 
-type unlockIndex map[string]indexEntry
+// FingerprintBuckets counts the distinct indexed fingerprints by their top
+// bits bits, to reveal clustering of the fingerprint function. It fails with
+// ErrInvalidBucketBits unless bits is within [1, 64].
+func (ii *InvertedIndex) FingerprintBuckets(bits int, shard *shard.Annotation) (map[uint64]int, error) {
+	if bits < 1 || bits > 64 {
+		return nil, fmt.Errorf("%w: %d, must be between 1 and 64", ErrInvalidBucketBits, bits)
+	}
+	fps, err := ii.AllFingerprints(shard)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[uint64]int)
+	for _, fp := range fps {
+		buckets[uint64(fp)>>(64-bits)]++
+	}
+	return buckets, nil
+}
 
-// This is the prevalent value for Intel and AMD CPUs as-at 2018.
-const cacheLineSize = 64
+// LookupFingerprintRange returns the sorted fingerprints of all series
+// within [min, max].
+func (ii *InvertedIndex) LookupFingerprintRange(min, max model.Fingerprint, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
 
-// Roughly
-// map[labelName] => map[labelValue] => []fingerprint
-type indexShard struct {
-	shard uint32
-	mtx   sync.RWMutex
-	idx   unlockIndex
-	//nolint:structcheck,unused
-	pad [cacheLineSize - unsafe.Sizeof(sync.Mutex{}) - unsafe.Sizeof(unlockIndex{})]byte
+	shards := ii.getShards(shard)
+	results := make([][]model.Fingerprint, 0, len(shards))
+	for i := range shards {
+		if fps := shards[i].fingerprintRange(min, max); len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), nil
 }
 
-func copyString(s string) string {
-	return string([]byte(s))
+const defaultMaxRegexpProgramSize = 1 << 16
+
+// checkMatchers returns ErrRegexpTooComplex if a regexp matcher compiles to
+// more instructions than allowed by IndexOptions.MaxRegexpProgramSize.
+func (ii *InvertedIndex) checkMatchers(matchers []*labels.Matcher) error {
+	max := ii.opts.MaxRegexpProgramSize
+	if max < 0 {
+		return nil
+	}
+	if max == 0 {
+		max = defaultMaxRegexpProgramSize
+	}
+	for i, m := range matchers {
+		if m.Type != labels.MatchRegexp && m.Type != labels.MatchNotRegexp {
+			continue
+		}
+		// anchored as labels.NewMatcher does
+		re, err := syntax.Parse("^(?:"+m.Value+")$", syntax.Perl)
+		if err != nil {
+			return fmt.Errorf("%w at position %d: %v", ErrInvalidMatcher, i, err)
+		}
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			return fmt.Errorf("%w at position %d: %v", ErrInvalidMatcher, i, err)
+		}
+		if len(prog.Inst) > max {
+			return fmt.Errorf("%w at position %d: %d instructions, at most %d allowed", ErrRegexpTooComplex, i, len(prog.Inst), max)
+		}
+	}
+	return nil
+}
+
+// normalize returns a copy of ls with the values canonicalized by
+// IndexOptions.ValueNormalizer, or ls itself if there is none.
+func (ii *InvertedIndex) normalize(ls phlaremodel.Labels) phlaremodel.Labels {
+	if ii.opts.ValueNormalizer == nil {
+		return ls
+	}
+	result := make(phlaremodel.Labels, len(ls))
+	for i, l := range ls {
+		result[i] = &commonv1.LabelPair{Name: l.Name, Value: ii.opts.ValueNormalizer(l.Name, l.Value)}
+	}
+	return result
+}
+
+// normalizeMatchers returns the matchers with the values of the equality
+// matchers canonicalized by IndexOptions.ValueNormalizer, without modifying
+// the given slice.
+func (ii *InvertedIndex) normalizeMatchers(matchers []*labels.Matcher) []*labels.Matcher {
+	if ii.opts.ValueNormalizer == nil {
+		return matchers
+	}
+	result := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		result[i] = ii.normalizeMatcher(m)
+	}
+	return result
+}
+
+func (ii *InvertedIndex) normalizeMatcher(m *labels.Matcher) *labels.Matcher {
+	if ii.opts.ValueNormalizer == nil || (m.Type != labels.MatchEqual && m.Type != labels.MatchNotEqual) {
+		return m
+	}
+	value := ii.opts.ValueNormalizer(m.Name, m.Value)
+	if value == m.Value {
+		return m
+	}
+	// equality matchers never fail to build
+	return labels.MustNewMatcher(m.Type, m.Name, value)
+}
+
+// checkLookupLimit returns a *LimitExceededError if count exceeds the
+// configured maximum number of lookup results. Fingerprints are
+// distinct across shards, so count can be accumulated shard by shard.
+func (ii *InvertedIndex) checkLookupLimit(count int) error {
+	if ii.opts.MaxLookupResults > 0 && count > ii.opts.MaxLookupResults {
+		return &LimitExceededError{Limit: ii.opts.MaxLookupResults, Count: count}
+	}
+	return nil
+}
+
+// planLookup narrows down the shards to evaluate for queries with at least
+// one equality matcher. Since a fingerprint lives in exactly one shard,
+// only shards holding postings for every equality matcher can match.
+// The returned matchers evaluate the most selective equality matcher first.
+// Queries made of regexp and negated matchers only are left untouched.
+func planLookup(shards []*indexShard, matchers []*labels.Matcher) ([]*indexShard, []*labels.Matcher) {
+	var equals []int
+	for i, m := range matchers {
+		// all shards share the options of the index
+		if m.Type == labels.MatchEqual && !(len(shards) > 0 && shards[0].matchesAbsent(m)) {
+			equals = append(equals, i)
+		}
+	}
+	if len(equals) == 0 {
+		return shards, matchers
+	}
+
+	var (
+		candidates = make([]*indexShard, 0, len(shards))
+		totals     = make([]int, len(equals))
+		lengths    = make([]int, len(equals))
+	)
+	// all shards share the options of the index
+	var hashes []uint64
+	if len(shards) > 0 && shards[0].pairs != nil {
+		hashes = make([]uint64, len(equals))
+		for i, j := range equals {
+			hashes[i] = pairHash(matchers[j].Name, matchers[j].Value)
+		}
+	}
+
+outer:
+	for _, s := range shards {
+		if !s.mayHoldPairs(hashes) {
+			continue
+		}
+		s.postingsLengths(matchers, equals, lengths)
+		for _, n := range lengths {
+			if n == 0 {
+				continue outer
+			}
+		}
+		for i, n := range lengths {
+			totals[i] += n
+		}
+		candidates = append(candidates, s)
+	}
+	if len(candidates) == 0 {
+		return nil, matchers
+	}
+
+	best := 0
+	for i := range totals {
+		if totals[i] < totals[best] {
+			best = i
+		}
+	}
+	if equals[best] == 0 {
+		return candidates, matchers
+	}
+	reordered := make([]*labels.Matcher, 0, len(matchers))
+	reordered = append(reordered, matchers[equals[best]])
+	reordered = append(reordered, matchers[:equals[best]]...)
+	reordered = append(reordered, matchers[equals[best]+1:]...)
+	return candidates, reordered
+}
+
+// ShardsForMatchers returns the sorted indices of the shards which may hold
+// series matching all the matchers: shards missing the postings of an
+// equality matcher are excluded, other matchers don't exclude any shard.
+func (ii *InvertedIndex) ShardsForMatchers(matchers []*labels.Matcher) ([]uint32, error) {
+	for i, m := range matchers {
+		if m == nil || m.Name == "" {
+			return nil, fmt.Errorf("%w at position %d", ErrInvalidMatcher, i)
+		}
+	}
+	shards, _ := planLookup(ii.shards, ii.normalizeMatchers(matchers))
+	result := make([]uint32, 0, len(shards))
+	for _, s := range shards {
+		result = append(result, s.shard)
+	}
+	return result, nil
+}
+
+// LabelNames returns all label names.
+func (ii *InvertedIndex) LabelNames(shard *shard.Annotation) ([]string, error) {
+	if ii.opts.QueryLogger == nil {
+		return ii.labelNames(shard)
+	}
+	start := time.Now()
+	names, err := ii.labelNames(shard)
+	ii.auditQuery(QueryAudit{Method: "LabelNames", Shard: shard, Results: len(names), Err: err}, start)
+	return names, err
+}
+
+func (ii *InvertedIndex) labelNames(shard *shard.Annotation) ([]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards))
+	for i := range shards {
+		shardResult := shards[i].labelNames(nil)
+		results = append(results, shardResult)
+	}
+
+	return mergeStringSlices(results), nil
+}
+
+// LabelValues returns the values for the given label.
+func (ii *InvertedIndex) LabelValues(name string, shard *shard.Annotation) ([]string, error) {
+	if ii.opts.QueryLogger == nil {
+		return ii.labelValues(name, shard)
+	}
+	start := time.Now()
+	values, err := ii.labelValues(name, shard)
+	ii.auditQuery(QueryAudit{Method: "LabelValues", LabelName: name, Shard: shard, Results: len(values), Err: err}, start)
+	return values, err
+}
+
+func (ii *InvertedIndex) labelValues(name string, shard *shard.Annotation) ([]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards))
+
+	for i := range shards {
+		shardResult := shards[i].labelValues(name, nil)
+		results = append(results, shardResult)
+	}
+
+	return mergeStringSlices(results), nil
+}
+
+// LabelValuesSorted is like LabelValues with the values ordered by less
+// rather than lexicographically, e.g. to order versions semantically. The
+// values of all the shards are merged before being sorted, and values less
+// considers equivalent remain in lexicographic order.
+func (ii *InvertedIndex) LabelValuesSorted(name string, shard *shard.Annotation, less func(a, b string) bool) ([]string, error) {
+	values, err := ii.LabelValues(name, shard)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(values, func(i, j int) bool { return less(values[i], values[j]) })
+	return values, nil
+}
+
+// ProfileTypes returns the sorted distinct profile types of the indexed
+// series, the values of the phlaremodel.LabelNameProfileType label.
+func (ii *InvertedIndex) ProfileTypes(shard *shard.Annotation) ([]string, error) {
+	return ii.LabelValues(phlaremodel.LabelNameProfileType, shard)
+}
+
+// LabelValueCount is a label value with the number of series carrying it.
+type LabelValueCount struct {
+	Value string
+	Count uint64
+}
+
+// LabelValuesWithCounts returns the values for the given label sorted by
+// value, each with the number of series carrying it. See
+// SortLabelValueCountsByCount to order them by count instead.
+func (ii *InvertedIndex) LabelValuesWithCounts(name string, shard *shard.Annotation) ([]LabelValueCount, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	// a series lives in a single shard, so counts add up across shards
+	counts := map[string]uint64{}
+	for _, s := range ii.getShards(shard) {
+		s.valueCounts(name, counts)
+	}
+	result := make([]LabelValueCount, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, LabelValueCount{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Value < result[j].Value
+	})
+	return result, nil
+}
+
+// SortLabelValueCountsByCount orders counts from the highest to the lowest
+// count, then by value.
+func SortLabelValueCountsByCount(counts []LabelValueCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Value < counts[j].Value
+	})
+}
+
+// LabelValuesMulti returns the values of each of the given labels, taking
+// each shard's lock only once for the whole set of names.
+// The result holds an entry for every requested name, which is an empty
+// slice if the name is absent.
+func (ii *InvertedIndex) LabelValuesMulti(names []string, shard *shard.Annotation) (map[string][]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	shards := ii.getShards(shard)
+	results := make(map[string][][]string, len(names))
+
+	for i := range shards {
+		for name, values := range shards[i].labelValuesMulti(names) {
+			results[name] = append(results[name], values)
+		}
+	}
+
+	merged := make(map[string][]string, len(names))
+	for _, name := range names {
+		values := mergeStringSlices(results[name])
+		if values == nil {
+			values = []string{}
+		}
+		merged[name] = values
+	}
+	return merged, nil
+}
+
+// LabelValuesUnion returns the sorted distinct values of any of the given
+// labels, e.g. to list the values of a label being renamed under both its
+// old and new names. As LabelValuesMulti, it takes each shard's lock only
+// once.
+func (ii *InvertedIndex) LabelValuesUnion(names []string, shard *shard.Annotation) ([]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards)*len(names))
+	for i := range shards {
+		for _, values := range shards[i].labelValuesMulti(names) {
+			results = append(results, values)
+		}
+	}
+	return mergeStringSlices(results), nil
+}
+
+// PostingsForLabel returns, for each value of the given label, the sorted
+// fingerprints of the series carrying it, merged across shards.
+// The returned slices are copies and can be modified by the caller.
+func (ii *InvertedIndex) PostingsForLabel(name string, shard *shard.Annotation) (map[string][]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+
+	result := map[string][]model.Fingerprint{}
+	for _, s := range ii.getShards(shard) {
+		for value, fps := range s.postings(name) {
+			if existing, ok := result[value]; ok {
+				fps = union(existing, fps)
+			}
+			result[value] = fps
+		}
+	}
+	for _, fps := range result {
+		ii.orderFingerprints(fps)
+	}
+	return result, nil
+}
+
+// LabelValueCountFor returns the number of distinct values of the given
+// label among the series matching all the matchers.
+func (ii *InvertedIndex) LabelValueCountFor(name string, matchers []*labels.Matcher, shard *shard.Annotation) (uint64, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return 0, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return 0, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+
+	distinct := map[string]struct{}{}
+	for _, s := range ii.getShards(shard) {
+		fps := s.matchingFPs(matchers)
+		if len(fps) == 0 {
+			continue
+		}
+		s.valuesIntersecting(name, fps, distinct)
+	}
+	return uint64(len(distinct)), nil
+}
+
+// PostingsSimilarity returns the Jaccard index of the postings of both
+// label pairs, the size of their intersection over the size of their
+// union. It returns 0 if either pair is absent.
+func (ii *InvertedIndex) PostingsSimilarity(nameA, valueA, nameB, valueB string, shard *shard.Annotation) (float64, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return 0, err
+	}
+	if ii.opts.ValueNormalizer != nil {
+		valueA, valueB = ii.opts.ValueNormalizer(nameA, valueA), ii.opts.ValueNormalizer(nameB, valueB)
+	}
+
+	// a series belongs to a single shard, so sizes add up across shards
+	var sizeA, sizeB, intersection, unionSize int
+	for _, s := range ii.getShards(shard) {
+		a, b := s.pairPostings(nameA, valueA), s.pairPostings(nameB, valueB)
+		sizeA += len(a)
+		sizeB += len(b)
+		intersection += len(intersect(a, b))
+		unionSize += len(union(a, b))
+	}
+	if sizeA == 0 || sizeB == 0 {
+		return 0, nil
+	}
+	return float64(intersection) / float64(unionSize), nil
+}
+
+// LabelValuesInterned calls visit for each distinct value of the given label,
+// in sorted order across shards, stopping early if visit returns false.
+// Values are the strings interned by the index and are passed without
+// building the merged result slice.
+func (ii *InvertedIndex) LabelValuesInterned(name string, shard *shard.Annotation, visit func(value string) bool) error {
+	if err := ii.validateShard(shard); err != nil {
+		return err
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards))
+
+	for i := range shards {
+		shardResult := shards[i].labelValues(name, nil)
+		if len(shardResult) > 0 {
+			results = append(results, shardResult)
+		}
+	}
+
+	visitMergedStringSlices(results, visit)
+	return nil
+}
+
+// LabelValuesWithPrefix returns the sorted distinct values of the given
+// label starting with prefix.
+func (ii *InvertedIndex) LabelValuesWithPrefix(name, prefix string, shard *shard.Annotation) ([]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards))
+	for i := range shards {
+		if values := shards[i].valuesWithPrefix(name, prefix); len(values) > 0 {
+			results = append(results, values)
+		}
+	}
+	return mergeStringSlices(results), nil
+}
+
+// LabelValuesPage returns up to limit sorted values of the label strictly
+// greater than afterValue, all of them if limit is not positive. nextToken
+// is the last returned value, to pass as afterValue for the next page, or
+// empty once the values are exhausted. Pages are stable as long as the
+// index is not modified while paging.
+func (ii *InvertedIndex) LabelValuesPage(name string, shard *shard.Annotation, afterValue string, limit int) (values []string, nextToken string, err error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, "", err
+	}
+	// one more value than the page tells if there is a next page
+	shardLimit := 0
+	if limit > 0 {
+		shardLimit = limit + 1
+	}
+	shards := ii.getShards(shard)
+	results := make([][]string, 0, len(shards))
+	for i := range shards {
+		if values := shards[i].valuesAfter(name, afterValue, shardLimit); len(values) > 0 {
+			results = append(results, values)
+		}
+	}
+	visitMergedStringSlices(results, func(value string) bool {
+		if limit > 0 && len(values) == limit {
+			nextToken = values[len(values)-1]
+			return false
+		}
+		values = append(values, value)
+		return true
+	})
+	return values, nextToken, nil
+}
+
+// PostingsLengthBucket counts the label pairs whose number of series is
+// within [Min, Max].
+type PostingsLengthBucket struct {
+	Min, Max int
+	Pairs    int
+}
+
+// PostingsLengthHistogram returns the distribution of the number of series
+// per label pair, in buckets of increasing powers of ten: 1, 2-10, 11-100
+// and so on up to the bucket of the largest pair. The postings of a pair
+// present in several shards are summed before bucketing.
+func (ii *InvertedIndex) PostingsLengthHistogram(shard *shard.Annotation) ([]PostingsLengthBucket, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	lengths := map[LabelPair]int{}
+	for _, s := range ii.getShards(shard) {
+		s.pairLengths(lengths)
+	}
+
+	var buckets []PostingsLengthBucket
+	for _, n := range lengths {
+		i := 0
+		for max := 1; n > max; max *= 10 {
+			i++
+		}
+		for len(buckets) <= i {
+			if len(buckets) == 0 {
+				buckets = append(buckets, PostingsLengthBucket{Min: 1, Max: 1})
+				continue
+			}
+			max := buckets[len(buckets)-1].Max
+			buckets = append(buckets, PostingsLengthBucket{Min: max + 1, Max: max * 10})
+		}
+		buckets[i].Pairs++
+	}
+	return buckets, nil
+}
+
+// LabelPair is a distinct label name and value pair of the index.
+type LabelPair struct {
+	Name, Value string
+}
+
+// LabelPairs returns all distinct label pairs, sorted by name then value.
+func (ii *InvertedIndex) LabelPairs(shard *shard.Annotation) ([]LabelPair, error) {
+	var pairs []LabelPair
+	err := ii.VisitLabelPairs(shard, func(pair LabelPair) bool {
+		pairs = append(pairs, pair)
+		return true
+	})
+	return pairs, err
+}
+
+// VisitLabelPairs calls visit for each distinct label pair sorted by name
+// then value, until visit returns false. Only the values of a single label
+// name are held in memory at a time.
+func (ii *InvertedIndex) VisitLabelPairs(shard *shard.Annotation, visit func(LabelPair) bool) error {
+	if err := ii.validateShard(shard); err != nil {
+		return err
+	}
+	shards := ii.getShards(shard)
+	names := make([][]string, 0, len(shards))
+	for i := range shards {
+		if shardNames := shards[i].labelNames(nil); len(shardNames) > 0 {
+			names = append(names, shardNames)
+		}
+	}
+
+	stopped := false
+	visitMergedStringSlices(names, func(name string) bool {
+		values := make([][]string, 0, len(shards))
+		for i := range shards {
+			if shardValues := shards[i].labelValues(name, nil); len(shardValues) > 0 {
+				values = append(values, shardValues)
+			}
+		}
+		visitMergedStringSlices(values, func(value string) bool {
+			stopped = !visit(LabelPair{Name: name, Value: value})
+			return !stopped
+		})
+		return !stopped
+	})
+	return nil
+}
+
+// Symbols returns the distinct label name and value strings of the index,
+// sorted lexicographically.
+func (ii *InvertedIndex) Symbols(shard *shard.Annotation) ([]string, error) {
+	var symbols []string
+	err := ii.VisitSymbols(shard, func(symbol string) bool {
+		symbols = append(symbols, symbol)
+		return true
+	})
+	return symbols, err
+}
+
+// VisitSymbols calls visit for each distinct label name and value string in
+// ascending order, until visit returns false.
+func (ii *InvertedIndex) VisitSymbols(shard *shard.Annotation, visit func(string) bool) error {
+	if err := ii.validateShard(shard); err != nil {
+		return err
+	}
+	shards := ii.getShards(shard)
+	symbols := make([][]string, 0, len(shards))
+	for i := range shards {
+		if shardSymbols := shards[i].symbols(); len(shardSymbols) > 0 {
+			symbols = append(symbols, shardSymbols)
+		}
+	}
+	visitMergedStringSlices(symbols, visit)
+	return nil
+}
+
+// LookupNumericRange returns all fingerprints for series whose value for the
+// given label, parsed as a float, lies within [min, max].
+// Values that don't parse as numbers are skipped.
+func (ii *InvertedIndex) LookupNumericRange(name string, min, max float64, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+
+	shards := ii.getShards(shard)
+	results := make([][]model.Fingerprint, 0, len(shards))
+	for i := range shards {
+		if fps := shards[i].numericRange(name, min, max); len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), nil
+}
+
+// LookupAllValues returns all fingerprints carrying every one of the given
+// values for the label name, the intersection of the postings of each
+// value, unlike a regex matcher over the values which returns their union.
+// As a series carries a single value per label name, the result is empty
+// whenever values holds two distinct values, which can be used to check
+// for postings disagreeing with the stored labels. An empty values returns
+// no fingerprint.
+func (ii *InvertedIndex) LookupAllValues(name string, values []string, shard *shard.Annotation) ([]model.Fingerprint, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if ii.opts.ValueNormalizer != nil {
+		normalized := make([]string, len(values))
+		for i, v := range values {
+			normalized[i] = ii.opts.ValueNormalizer(name, v)
+		}
+		values = normalized
+	}
+
+	shards := ii.getShards(shard)
+	results := make([][]model.Fingerprint, 0, len(shards))
+	for i := range shards {
+		if fps := shards[i].allValues(name, values); len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return ii.orderFingerprints(mergeFingerprintSlices(results)), nil
+}
+
+// SeriesAsPromLabels returns the labels of all series matching the provided
+// matchers, converted to Prometheus labels. The result is ordered like the
+// fingerprints returned by Lookup. Each label set is sorted by name as
+// Prometheus expects, with the metric name carried as the __name__ label.
+func (ii *InvertedIndex) SeriesAsPromLabels(matchers []*labels.Matcher, shard *shard.Annotation) ([]labels.Labels, error) {
+	series, err := ii.series([][]*labels.Matcher{matchers}, shard)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]labels.Labels, 0, len(series))
+	for _, s := range series {
+		result = append(result, toPromLabels(s.labels))
+	}
+	return result, nil
+}
+
+// MatchSeries returns the labels of all series matching at least one of the
+// matcher sets, where the matchers within a set must all match.
+// Series are deduplicated and ordered by fingerprint. The returned labels
+// are interned by the index and must not be modified, unless they were
+// transformed by IndexOptions.LabelEnricher.
+func (ii *InvertedIndex) MatchSeries(matcherSets [][]*labels.Matcher, shard *shard.Annotation) ([]phlaremodel.Labels, error) {
+	series, err := ii.series(matcherSets, shard)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]phlaremodel.Labels, 0, len(series))
+	for _, s := range series {
+		result = append(result, s.labels)
+	}
+	return result, nil
+}
+
+type fingerprintLabels struct {
+	fp     model.Fingerprint
+	labels phlaremodel.Labels
+}
+
+// series returns the interned labels of all series matching any of the
+// provided matcher sets, sorted by fingerprint, as transformed by the label
+// enricher if any.
+func (ii *InvertedIndex) series(matcherSets [][]*labels.Matcher, shard *shard.Annotation) ([]fingerprintLabels, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	normalized := make([][]*labels.Matcher, 0, len(matcherSets))
+	for _, matchers := range matcherSets {
+		if err := ii.checkMatchers(matchers); err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, ii.normalizeMatchers(matchers))
+	}
+	matcherSets = normalized
+
+	var result []fingerprintLabels
+	shards := ii.getShards(shard)
+	for i := range shards {
+		var fps []model.Fingerprint
+		for _, matchers := range matcherSets {
+			fps = union(fps, shards[i].matchingFPs(matchers))
+		}
+		result = append(result, shards[i].seriesLabels(fps)...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return ii.fingerprintsOrdered(result[i].fp, result[j].fp)
+	})
+	for i := range result {
+		result[i].labels = ii.enrich(result[i].labels)
+	}
+	return result, nil
+}
+
+// orderFingerprints reverses the ascending fps in place with
+// IndexOptions.DescendingPostings, and returns them.
+func (ii *InvertedIndex) orderFingerprints(fps []model.Fingerprint) []model.Fingerprint {
+	if ii.opts.DescendingPostings {
+		reverseFingerprints(fps)
+	}
+	return fps
+}
+
+// fingerprintsOrdered reports whether a comes before b in the results of the
+// index.
+func (ii *InvertedIndex) fingerprintsOrdered(a, b model.Fingerprint) bool {
+	if ii.opts.DescendingPostings {
+		return a > b
+	}
+	return a < b
+}
+
+func reverseFingerprints(fps []model.Fingerprint) {
+	for i, j := 0, len(fps)-1; i < j; i, j = i+1, j-1 {
+		fps[i], fps[j] = fps[j], fps[i]
+	}
+}
+
+// enrich applies the label enricher, if any, to a copy of the stored labels.
+func (ii *InvertedIndex) enrich(lbs phlaremodel.Labels) phlaremodel.Labels {
+	if ii.opts.LabelEnricher == nil {
+		return lbs
+	}
+	return ii.opts.LabelEnricher(lbs.Clone())
+}
+
+// toPromLabels converts interned labels to Prometheus labels.
+// Pairs with an empty value are dropped since Prometheus treats them
+// as absent.
+func toPromLabels(ls phlaremodel.Labels) labels.Labels {
+	res := make(labels.Labels, 0, len(ls))
+	for _, l := range ls {
+		if l.Value == "" {
+			continue
+		}
+		res = append(res, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	sort.Sort(res)
+	return res
+}
+
+// ApproxLabelNameCardinality returns an estimate of the number of distinct
+// values of each label name. Estimates are computed on demand using one
+// HyperLogLog sketch per name, merged across shards, so memory is bounded
+// by the number of names rather than the number of values. The relative
+// standard error is about 1.6%; small cardinalities are close to exact.
+func (ii *InvertedIndex) ApproxLabelNameCardinality(shard *shard.Annotation) (map[string]uint64, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+
+	sketches := map[string]*hyperLogLog{}
+	for _, s := range ii.getShards(shard) {
+		s.valueSketches(sketches)
+	}
+
+	result := make(map[string]uint64, len(sketches))
+	for name, sketch := range sketches {
+		result[name] = sketch.estimate()
+	}
+	return result, nil
+}
+
+// LabelNamesSortedByCardinality returns the label names ordered from the
+// highest to the lowest exact number of distinct values, then by name.
+// Unlike ApproxLabelNameCardinality, the values of each name are collected
+// across shards, so memory is bounded by the number of distinct values.
+func (ii *InvertedIndex) LabelNamesSortedByCardinality(shard *shard.Annotation) ([]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+
+	distinct := map[string]map[string]struct{}{}
+	for _, s := range ii.getShards(shard) {
+		s.distinctValues(distinct)
+	}
+	names := make([]string, 0, len(distinct))
+	for name := range distinct {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ci, cj := len(distinct[names[i]]), len(distinct[names[j]])
+		if ci != cj {
+			return ci > cj
+		}
+		return names[i] < names[j]
+	})
+	return names, nil
+}
+
+// ConstantLabels returns the label names having a single distinct value
+// across the selected series, mapped to that value. Such labels don't
+// narrow down any query. A name is constant only if all the shards holding
+// it agree on its value. encoding/json serializes the map sorted by name.
+func (ii *InvertedIndex) ConstantLabels(shard *shard.Annotation) (map[string]string, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	varying := make(map[string]struct{})
+	for _, s := range ii.getShards(shard) {
+		s.visitValueCounts(func(name, value string, values int) {
+			if _, ok := varying[name]; ok {
+				return
+			}
+			if prev, ok := result[name]; values > 1 || (ok && prev != value) {
+				delete(result, name)
+				varying[name] = struct{}{}
+				return
+			}
+			result[name] = value
+		})
+	}
+	return result, nil
+}
+
+// Exists reports whether the fingerprint is indexed. Series are sharded by
+// labels rather than fingerprint, and the index doesn't know which shard a
+// fingerprint was routed to, so the fingerprint maps of the shards are
+// checked one at a time, each under its read lock, until one holds it. The
+// cost is O(shards) with a lock round per shard, independent of the number
+// of series: with the default 32 shards, about 0.65µs for an indexed
+// fingerprint and 1µs for a missing one, see BenchmarkExists.
+func (ii *InvertedIndex) Exists(fp model.Fingerprint) bool {
+	for _, shard := range ii.shards {
+		if shard.exists(fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty reports whether no shard holds any label name. It stops at the
+// first non-empty shard.
+func (ii *InvertedIndex) IsEmpty() bool {
+	for _, shard := range ii.shards {
+		if !shard.isEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// PurgeOlderThan removes all label values which haven't received a
+// fingerprint since cutoff, as well as label names left without values.
+// It returns the number of removed label values, and is a no-op unless
+// the index was created with IndexOptions.TrackLastWrite.
+func (ii *InvertedIndex) PurgeOlderThan(cutoff time.Time) (removed int) {
+	if !ii.opts.TrackLastWrite || ii.closed.Load() {
+		return 0
+	}
+	for _, shard := range ii.shards {
+		removed += shard.purgeOlderThan(cutoff.UnixNano())
+	}
+	return removed
+}
+
+// DropLabel removes the given label name from the whole index, including
+// from the labels of the series carrying it, and returns the number of
+// such series. Series left without any label are removed. Series remain in
+// the shard of their original labels, which Delete must still be given.
+func (ii *InvertedIndex) DropLabel(name string) (affected int) {
+	if ii.closed.Load() {
+		return 0
+	}
+	for _, shard := range ii.shards {
+		affected += shard.dropLabel(name)
+	}
+	return affected
+}
+
+// DeleteLabelValue deletes all the series carrying the given label pair and
+// returns their number. IndexOptions.OnEvict is called for each of them.
+func (ii *InvertedIndex) DeleteLabelValue(name, value string) (removed int) {
+	if ii.closed.Load() {
+		return 0
+	}
+	if ii.opts.ValueNormalizer != nil {
+		value = ii.opts.ValueNormalizer(name, value)
+	}
+	for _, shard := range ii.shards {
+		evicted := shard.deleteLabelValue(name, value)
+		removed += len(evicted)
+		if ii.opts.OnEvict != nil {
+			for _, s := range evicted {
+				ii.opts.OnEvict(s.fp, s.labels)
+			}
+		}
+	}
+	return removed
+}
+
+// Delete a fingerprint with the given label pairs.
+func (ii *InvertedIndex) Delete(labels []*commonv1.LabelPair, fp model.Fingerprint) {
+	if ii.closed.Load() {
+		return
+	}
+	labels = ii.normalize(labels)
+	shard := ii.shards[ii.ShardForLabels(labels)]
+	if !ii.opts.DeleteFallbackSearch {
+		evicted := shard.delete(labels, fp)
+		if evicted != nil && ii.opts.OnEvict != nil {
+			ii.opts.OnEvict(fp, evicted)
+		}
+		return
+	}
+	evicted, found := shard.deleteIfExists(labels, fp)
+	if !found {
+		ii.deleteMisrouted(labels, fp, shard.shard)
+		return
+	}
+	if evicted != nil && ii.opts.OnEvict != nil {
+		ii.opts.OnEvict(fp, evicted)
+	}
+}
+
+// deleteMisrouted deletes fp with its stored labels from the shards other
+// than routed holding it, reporting each of them to OnDeleteMismatch.
+func (ii *InvertedIndex) deleteMisrouted(labels phlaremodel.Labels, fp model.Fingerprint, routed uint32) {
+	for _, shard := range ii.shards {
+		if shard.shard == routed {
+			continue
+		}
+		evicted, found := shard.deleteStored(fp)
+		if !found {
+			continue
+		}
+		if ii.opts.OnDeleteMismatch != nil {
+			ii.opts.OnDeleteMismatch(fp, labels, routed, shard.shard)
+		}
+		if evicted != nil && ii.opts.OnEvict != nil {
+			ii.opts.OnEvict(fp, evicted)
+		}
+	}
+}
+
+// NB slice entries are sorted in fp order.
+type indexEntry struct {
+	name string
+	fps  map[string]indexValueEntry
+	// sorted is nil unless IndexOptions.SortedValues is set.
+	sorted *sortedValues
+	// cache is nil unless IndexOptions.CacheLabelValues is set.
+	cache *labelValuesCache
+}
+
+type indexValueEntry struct {
+	value string
+	fps   postings
+	// lastWrite is the unix nano timestamp of the last add,
+	// only maintained when IndexOptions.TrackLastWrite is set.
+	lastWrite int64
+}
+
+type unlockIndex map[string]indexEntry
+
+// This is the prevalent value for Intel and AMD CPUs as-at 2018.
+const cacheLineSize = 64
+
+// Roughly
+// map[labelName] => map[labelValue] => []fingerprint
+type indexShard struct {
+	shard uint32
+	mtx   sync.RWMutex
+	idx   unlockIndex
+	//nolint:structcheck,unused
+	pad [cacheLineSize - unsafe.Sizeof(sync.Mutex{}) - unsafe.Sizeof(unlockIndex{})]byte
+
+	// series maps each fingerprint to the interned labels it was added with.
+	// Along with refs it backs the label recovering, existence, validation
+	// and repair paths of InvertedIndex. It holds the very labels returned
+	// by add: callers keeping those pay about 105 bytes per series for both
+	// maps, 19% of the footprint of the series of BenchmarkSeriesMemory.
+	// Callers dropping them pay for the labels too, about 455 bytes per
+	// series, three times the footprint without the maps. Both are nil
+	// unless keepSeries is set.
+	series map[model.Fingerprint]phlaremodel.Labels
+	// refs counts the postings each fingerprint appears in. A fingerprint
+	// is gone, and removed from series, once its count drops to zero.
+	refs map[model.Fingerprint]int
+	// keepSeries is unset for the shards of BitPrefixInvertedIndex, which
+	// never reads series and refs.
+	keepSeries bool
+	// names holds the sorted label names of idx. It is replaced rather than
+	// modified when names are added or removed, under the write lock.
+	names []string
+	// freeList is nil unless postings pooling is enabled.
+	freeList       *fingerprintsFreeList
+	trackLastWrite bool
+	bitmapPostings bool
+	sortedValues   bool
+	deltaPostings  bool
+	// cacheValues is set unless sortedValues is.
+	cacheValues bool
+	// immutablePostings is set unless bitmapPostings is.
+	immutablePostings     bool
+	emptyMatchMeansAbsent bool
+	// setMatches is shared by all the shards of an index.
+	setMatches *setMatchesCache
+	// generations is shared by all the shards of an index, it is nil unless
+	// the lookup cache is enabled.
+	generations *labelGenerations
+	// pairs is nil unless IndexOptions.PairBloomFilterBits is set.
+	pairs *pairBloomFilter
+	// maxValuesPerLabel and onDroppedPair are IndexOptions.MaxValuesPerLabel
+	// and IndexOptions.OnDroppedPair.
+	maxValuesPerLabel int
+	onDroppedPair     func(fp model.Fingerprint, name, value string)
+}
+
+func newIndexShard(i uint32, opts IndexOptions) *indexShard {
+	shard := &indexShard{
+		idx:        map[string]indexEntry{},
+		series:     map[model.Fingerprint]phlaremodel.Labels{},
+		refs:       map[model.Fingerprint]int{},
+		keepSeries: true,
+		shard:      i,
+	}
+	if opts.PoolPostings {
+		shard.freeList = &fingerprintsFreeList{}
+	}
+	shard.trackLastWrite = opts.TrackLastWrite
+	shard.bitmapPostings = opts.BitmapPostings
+	shard.sortedValues = opts.SortedValues
+	shard.immutablePostings = opts.ImmutablePostings && !opts.BitmapPostings
+	shard.emptyMatchMeansAbsent = opts.EmptyMatchMeansAbsent
+	shard.deltaPostings = opts.DeltaPostings
+	shard.cacheValues = opts.CacheLabelValues && !opts.SortedValues
+	shard.pairs = newPairBloomFilter(opts.PairBloomFilterBits)
+	shard.maxValuesPerLabel = opts.MaxValuesPerLabel
+	shard.onDroppedPair = opts.OnDroppedPair
+	return shard
+}
+
+func (shard *indexShard) newPostings() postings {
+	if shard.bitmapPostings {
+		return newBitmapPostings()
+	}
+	if shard.immutablePostings {
+		return newImmutablePostings()
+	}
+	if shard.deltaPostings {
+		return &deltaPostings{}
+	}
+	return &slicePostings{fps: shard.freeList.get()}
+}
+
+// regexSetMatches returns the values matched by a regex matcher of the
+// form `=~"a|b|c|d"`, or nil for any other matcher.
+func (shard *indexShard) regexSetMatches(matcher *labels.Matcher) []string {
+	if matcher.Type != labels.MatchRegexp {
+		return nil
+	}
+	return shard.setMatches.get(matcher.Value)
+}
+
+// releasePostings recycles emptied postings if pooling is enabled.
+func (shard *indexShard) releasePostings(p postings) {
+	if sp, ok := p.(*slicePostings); ok {
+		shard.freeList.put(sp.fps)
+	}
+}
+
+const (
+	// maxFreeFingerprints bounds the number of slices retained per shard.
+	maxFreeFingerprints = 1024
+	// maxFreeFingerprintsCap is the largest capacity worth recycling;
+	// bigger slices are left to the garbage collector.
+	maxFreeFingerprintsCap = 64
+)
+
+// fingerprintsFreeList holds the backing arrays of removed postings for reuse.
+// It must only be accessed under the owning shard's write lock.
+type fingerprintsFreeList struct {
+	free [][]model.Fingerprint
+}
+
+func (l *fingerprintsFreeList) get() []model.Fingerprint {
+	if l == nil || len(l.free) == 0 {
+		return nil
+	}
+	last := len(l.free) - 1
+	fps := l.free[last]
+	l.free[last] = nil
+	l.free = l.free[:last]
+	return fps
+}
+
+func (l *fingerprintsFreeList) put(fps []model.Fingerprint) {
+	if l == nil || cap(fps) == 0 || cap(fps) > maxFreeFingerprintsCap || len(l.free) >= maxFreeFingerprints {
+		return
+	}
+	l.free = append(l.free, fps[:0])
+}
+
+func copyString(s string) string {
+	return string([]byte(s))
 }
 
 // add metric to the index; return all the name/value pairs as a fresh
 // sorted slice, referencing 'interned' strings from the index so that
 // no references are retained to the memory of `metric`.
 func (shard *indexShard) add(metric []*commonv1.LabelPair, fp model.Fingerprint) phlaremodel.Labels {
+	return shard.insert(metric, fp, copyString)
+}
+
+// insert adds metric to the index like add, using clone to own the names
+// and values not indexed yet.
+func (shard *indexShard) insert(metric []*commonv1.LabelPair, fp model.Fingerprint, clone func(string) string) phlaremodel.Labels {
 	shard.mtx.Lock()
-	defer shard.mtx.Unlock()
+	lbs, dropped := shard.insertSeries(metric, fp, clone)
+	shard.mtx.Unlock()
+	shard.reportDropped(fp, dropped)
+	return lbs
+}
+
+// insertSeries is insert without locking, also returning the pairs dropped
+// by IndexOptions.MaxValuesPerLabel, which must be reported once the lock
+// is released. Must be called under the write lock.
+func (shard *indexShard) insertSeries(metric []*commonv1.LabelPair, fp model.Fingerprint, clone func(string) string) (phlaremodel.Labels, []*commonv1.LabelPair) {
+	shard.generations.bump(metric)
+
+	internedLabels := make(phlaremodel.Labels, 0, len(metric))
+	var dropped []*commonv1.LabelPair
+
+	var now int64
+	if shard.trackLastWrite {
+		now = time.Now().UnixNano()
+	}
+
+	for _, pair := range metric {
+		values, ok := shard.idx[pair.Name]
+		if ok && shard.maxValuesPerLabel > 0 && len(values.fps) >= shard.maxValuesPerLabel {
+			if _, ok := values.fps[pair.Value]; !ok {
+				dropped = append(dropped, pair)
+				continue
+			}
+		}
+		if !ok {
+			values = indexEntry{
+				name: clone(pair.Name),
+				fps:  map[string]indexValueEntry{},
+			}
+			if shard.sortedValues {
+				values.sorted = &sortedValues{}
+			}
+			if shard.cacheValues {
+				values.cache = &labelValuesCache{}
+			}
+			shard.idx[values.name] = values
+			shard.insertName(values.name)
+		}
+		fingerprints, ok := values.fps[pair.Value]
+		if !ok {
+			fingerprints = indexValueEntry{
+				value: clone(pair.Value),
+				fps:   shard.newPostings(),
+			}
+			if values.sorted != nil {
+				values.sorted.insert(fingerprints.value)
+			}
+			values.cache.invalidate()
+		}
+		shard.pairs.add(values.name, fingerprints.value)
+		n := fingerprints.fps.len()
+		fingerprints.fps.add(fp)
+		if fingerprints.fps.len() > n && shard.keepSeries {
+			shard.refs[fp]++
+		}
+		fingerprints.lastWrite = now
+		values.fps[fingerprints.value] = fingerprints
+		internedLabels = append(internedLabels, &commonv1.LabelPair{Name: values.name, Value: fingerprints.value})
+	}
+	sort.Sort(internedLabels)
+	if !shard.keepSeries {
+		return internedLabels, dropped
+	}
+	if len(dropped) > 0 && shard.refs[fp] == 0 {
+		// all pairs dropped, the series isn't indexed
+		return internedLabels, dropped
+	}
+	shard.series[fp] = internedLabels
+	return internedLabels, dropped
+}
+
+// reportDropped calls IndexOptions.OnDroppedPair for the dropped pairs of
+// fp. It must be called without holding the lock.
+func (shard *indexShard) reportDropped(fp model.Fingerprint, dropped []*commonv1.LabelPair) {
+	if shard.onDroppedPair == nil {
+		return
+	}
+	for _, pair := range dropped {
+		shard.onDroppedPair(fp, pair.Name, pair.Value)
+	}
+}
+
+func (shard *indexShard) lookup(matchers []*labels.Matcher) []model.Fingerprint {
+	if shard.immutablePostings {
+		return shard.lookupSnapshots(matchers)
+	}
+
+	// index slice values must only be accessed under lock, so all
+	// code paths must take a copy before returning
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	if shard.bitmapPostings {
+		return shard.lookupBitmaps(matchers)
+	}
+
+	// per-shard intersection is initially nil, which is a special case
+	// meaning "everything" when passed to intersect()
+	// loop invariant: result is sorted
+	var result []model.Fingerprint
+	for _, matcher := range matchers {
+		if p, ok := parseAnyValuePattern(matcher); ok {
+			result = intersect(result, shard.anyValueFPs(matcher, p))
+			if len(result) == 0 {
+				return nil
+			}
+			continue
+		}
+		if shard.matchesAbsent(matcher) {
+			result = intersect(result, shard.absentFPs(matcher.Name))
+			if len(result) == 0 {
+				return nil
+			}
+			continue
+		}
+		values, ok := shard.idx[matcher.Name]
+		if !ok {
+			return nil
+		}
+		var toIntersect model.Fingerprints
+		if matcher.Type == labels.MatchEqual {
+			fps, ok := values.fps[matcher.Value]
+			if !ok {
+				return nil
+			}
+			if result != nil {
+				// intersect directly with the postings rather than a copy
+				result = fps.fps.intersect(result)
+				if len(result) == 0 {
+					return nil
+				}
+				continue
+			}
+			toIntersect = fps.fps.appendTo(toIntersect) // deliberate copy
+		} else if set := shard.regexSetMatches(matcher); len(set) > 0 {
+			// The lookup is of the form `=~"a|b|c|d"`
+			for _, value := range set {
+				if fps, ok := values.fps[value]; ok {
+					toIntersect = fps.fps.appendTo(toIntersect)
+				}
+			}
+			sort.Sort(toIntersect)
+		} else {
+			// accumulate the matching fingerprints (which are all distinct)
+			// then sort to maintain the invariant
+			for value, fps := range values.fps {
+				if matcher.Matches(value) {
+					toIntersect = fps.fps.appendTo(toIntersect)
+				}
+			}
+			sort.Sort(toIntersect)
+		}
+		result = intersect(result, toIntersect)
+		if len(result) == 0 {
+			return nil
+		}
+	}
+
+	return result
+}
+
+// lookupBitmaps is lookup for bitmap postings: the bitmaps of the values
+// matched by each matcher are combined with the native roaring Or, and the
+// ones of the matchers with the native And, rather than through sorted
+// slices. The union of a lone matcher is merged into the result directly.
+// Must be called under the read lock.
+func (shard *indexShard) lookupBitmaps(matchers []*labels.Matcher) []model.Fingerprint {
+	// result is nil until the first matcher is evaluated. It may be one of
+	// the postings bitmaps, which are never modified: And and Or allocate
+	// the bitmaps they return.
+	var result *roaring64.Bitmap
+	for _, matcher := range matchers {
+		var matched []*roaring64.Bitmap
+		absent := shard.matchesAbsent(matcher)
+		if absent {
+			matched = append(matched, fingerprintsBitmap(shard.absentFPs(matcher.Name)))
+		}
+		values := shard.idx[matcher.Name]
+		if p, ok := parseAnyValuePattern(matcher); ok {
+			for value, entry := range values.fps {
+				// absentFPs includes the series storing an empty value
+				if !(absent && value == "") && p.matches(value) {
+					matched = append(matched, entry.fps.(*bitmapPostings).bitmap)
+				}
+			}
+		} else if absent {
+			// `l=""` matches the series without l only
+		} else if matcher.Type == labels.MatchEqual {
+			if entry, ok := values.fps[matcher.Value]; ok {
+				matched = append(matched, entry.fps.(*bitmapPostings).bitmap)
+			}
+		} else if set := shard.regexSetMatches(matcher); len(set) > 0 {
+			for _, value := range set {
+				if entry, ok := values.fps[value]; ok {
+					matched = append(matched, entry.fps.(*bitmapPostings).bitmap)
+				}
+			}
+		} else {
+			for value, entry := range values.fps {
+				if matcher.Matches(value) {
+					matched = append(matched, entry.fps.(*bitmapPostings).bitmap)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+
+		switch {
+		case len(matched) == 1 && result == nil:
+			result = matched[0]
+		case len(matched) == 1:
+			result = roaring64.And(result, matched[0])
+		case result == nil && len(matchers) == 1:
+			// no other side to intersect with: fingerprints are hashes
+			// spread over the whole 64-bit range, mostly alone in their
+			// container, and merging them is cheaper than building their
+			// union bitmap
+			var fps []model.Fingerprint
+			for _, b := range matched {
+				fps = (&bitmapPostings{bitmap: b}).appendTo(fps)
+			}
+			sort.Slice(fps, func(i, j int) bool { return fps[i] < fps[j] })
+			return fps
+		case result == nil:
+			result = roaring64.FastOr(matched...)
+		default:
+			// the intersections are at most as large as result, their
+			// union is cheaper than the one of the matched bitmaps
+			for i, b := range matched {
+				matched[i] = roaring64.And(result, b)
+			}
+			result = roaring64.FastOr(matched...)
+		}
+		if result.IsEmpty() {
+			return nil
+		}
+	}
+	if result == nil {
+		return nil
+	}
+
+	fps := make([]model.Fingerprint, 0, result.GetCardinality())
+	it := result.Iterator()
+	for it.HasNext() {
+		fps = append(fps, model.Fingerprint(it.Next()))
+	}
+	return fps
+}
+
+// fingerprintsBitmap returns a bitmap of fps.
+func fingerprintsBitmap(fps []model.Fingerprint) *roaring64.Bitmap {
+	b := roaring64.New()
+	for _, fp := range fps {
+		b.Add(uint64(fp))
+	}
+	return b
+}
+
+// lookupSnapshots is lookup for immutable postings. Snapshots of the
+// postings of the matched values are collected under the read lock, the
+// intersections happen after releasing it.
+func (shard *indexShard) lookupSnapshots(matchers []*labels.Matcher) []model.Fingerprint {
+	snapshots := shard.matcherSnapshots(matchers)
+	if snapshots == nil {
+		return nil
+	}
+
+	// loop invariant: result is sorted, and must not be returned while it
+	// is a snapshot rather than a fresh slice
+	var result []model.Fingerprint
+	var isSnapshot bool
+	for _, matched := range snapshots {
+		var toIntersect model.Fingerprints
+		if len(matched) == 1 {
+			toIntersect = matched[0]
+		} else {
+			for _, fps := range matched {
+				toIntersect = append(toIntersect, fps...)
+			}
+			sort.Sort(toIntersect)
+		}
+		isSnapshot = result == nil && len(matched) == 1
+		result = intersect(result, toIntersect)
+		if len(result) == 0 {
+			return nil
+		}
+	}
+	if isSnapshot {
+		result = append([]model.Fingerprint(nil), result...)
+	}
+	return result
+}
+
+// matcherSnapshots returns for each matcher the snapshots of the postings
+// of the values it matches, or nil if any matcher matches nothing.
+func (shard *indexShard) matcherSnapshots(matchers []*labels.Matcher) [][][]model.Fingerprint {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	snapshots := make([][][]model.Fingerprint, 0, len(matchers))
+	for _, matcher := range matchers {
+		if p, ok := parseAnyValuePattern(matcher); ok {
+			var matched [][]model.Fingerprint
+			absent := shard.matchesAbsent(matcher)
+			if absent {
+				if fps := shard.absentFPs(matcher.Name); len(fps) > 0 {
+					matched = append(matched, fps)
+				}
+			}
+			for value, fps := range shard.idx[matcher.Name].fps {
+				// absentFPs includes the series storing an empty value
+				if !(absent && value == "") && p.matches(value) {
+					matched = append(matched, fps.fps.(*immutablePostings).snapshot())
+				}
+			}
+			if len(matched) == 0 {
+				return nil
+			}
+			snapshots = append(snapshots, matched)
+			continue
+		}
+		if shard.matchesAbsent(matcher) {
+			fps := shard.absentFPs(matcher.Name)
+			if len(fps) == 0 {
+				return nil
+			}
+			snapshots = append(snapshots, [][]model.Fingerprint{fps})
+			continue
+		}
+		values, ok := shard.idx[matcher.Name]
+		if !ok {
+			return nil
+		}
+		var matched [][]model.Fingerprint
+		if matcher.Type == labels.MatchEqual {
+			if fps, ok := values.fps[matcher.Value]; ok {
+				matched = append(matched, fps.fps.(*immutablePostings).snapshot())
+			}
+		} else if set := shard.regexSetMatches(matcher); len(set) > 0 {
+			for _, value := range set {
+				if fps, ok := values.fps[value]; ok {
+					matched = append(matched, fps.fps.(*immutablePostings).snapshot())
+				}
+			}
+		} else {
+			for value, fps := range values.fps {
+				if matcher.Matches(value) {
+					matched = append(matched, fps.fps.(*immutablePostings).snapshot())
+				}
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		snapshots = append(snapshots, matched)
+	}
+	return snapshots
+}
+
+// matchesAbsent reports whether matcher must match the series without the
+// label l: the any value patterns accepting the empty value such as
+// `l=~".*"` always do, as in Prometheus, and `l=""` does with
+// IndexOptions.EmptyMatchMeansAbsent.
+func (shard *indexShard) matchesAbsent(matcher *labels.Matcher) bool {
+	if matcher.Type == labels.MatchEqual {
+		return shard.emptyMatchMeansAbsent && matcher.Value == ""
+	}
+	p, ok := parseAnyValuePattern(matcher)
+	return ok && p.matchesEmpty
+}
+
+// anyValueFPs returns the sorted fingerprints of the series matching the
+// any value pattern p of matcher, without evaluating its regexp. It is never
+// nil. Must be called under the read lock.
+func (shard *indexShard) anyValueFPs(matcher *labels.Matcher, p anyValuePattern) []model.Fingerprint {
+	result := model.Fingerprints{}
+	absent := shard.matchesAbsent(matcher)
+	if absent {
+		result = shard.absentFPs(matcher.Name)
+	}
+	for value, fps := range shard.idx[matcher.Name].fps {
+		// absentFPs includes the series storing an empty value
+		if !(absent && value == "") && p.matches(value) {
+			result = fps.fps.appendTo(result)
+		}
+	}
+	sort.Sort(result)
+	return result
+}
+
+// absentFPs returns the sorted fingerprints of the series without a
+// non-empty value for the given label. Must be called under the read lock.
+func (shard *indexShard) absentFPs(name string) []model.Fingerprint {
+	all := shard.fingerprints()
+	values, ok := shard.idx[name]
+	if !ok {
+		return all
+	}
+	if !shard.keepSeries {
+		var present model.Fingerprints
+		for value, entry := range values.fps {
+			if value != "" {
+				present = entry.fps.appendTo(present)
+			}
+		}
+		sort.Sort(present)
+		return complement(all, present)
+	}
+	// the stored labels are sorted by name
+	result := all[:0]
+	for _, fp := range all {
+		lbs := shard.series[fp]
+		i := sort.Search(len(lbs), func(i int) bool { return lbs[i].Name >= name })
+		if i == len(lbs) || lbs[i].Name != name || lbs[i].Value == "" {
+			result = append(result, fp)
+		}
+	}
+	return result
+}
+
+// matchingFPs returns the sorted fingerprints matching all matchers,
+// or all fingerprints of the shard if there are none.
+func (shard *indexShard) matchingFPs(matchers []*labels.Matcher) []model.Fingerprint {
+	if len(matchers) == 0 {
+		return shard.allFPs()
+	}
+	return shard.lookup(matchers)
+}
+
+// seriesLabels returns the labels of the given fingerprints, skipping
+// those which have been deleted in the meantime.
+func (shard *indexShard) seriesLabels(fps []model.Fingerprint) []fingerprintLabels {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	result := make([]fingerprintLabels, 0, len(fps))
+	for _, fp := range fps {
+		if lbs, ok := shard.series[fp]; ok {
+			result = append(result, fingerprintLabels{fp: fp, labels: lbs})
+		}
+	}
+	return result
+}
+
+func (shard *indexShard) lookupByNamePattern(namePattern *regexp.Regexp, valueMatcher *labels.Matcher) []model.Fingerprint {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	var results [][]model.Fingerprint
+	for _, name := range shard.names {
+		if !namePattern.MatchString(name) {
+			continue
+		}
+		for value, entry := range shard.idx[name].fps {
+			if valueMatcher == nil || valueMatcher.Matches(value) {
+				results = append(results, entry.fps.appendTo(nil))
+			}
+		}
+	}
+	// a series may match through several names
+	return mergeFingerprintSlices(results)
+}
+
+// fingerprintRange returns the sorted fingerprints of the shard within
+// [min, max].
+func (shard *indexShard) fingerprintRange(min, max model.Fingerprint) model.Fingerprints {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	var result model.Fingerprints
+	for fp := range shard.series {
+		if fp >= min && fp <= max {
+			result = append(result, fp)
+		}
+	}
+	sort.Sort(result)
+	return result
+}
+
+func (shard *indexShard) allFPs() model.Fingerprints {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	return shard.fingerprints()
+}
+
+// fingerprints is allFPs without locking: the sorted fingerprints of the
+// shard, from its fingerprint map. Must be called under the read lock.
+func (shard *indexShard) fingerprints() model.Fingerprints {
+	if !shard.keepSeries {
+		return shard.postingsFingerprints()
+	}
+	if len(shard.series) == 0 {
+		return nil
+	}
+	result := make(model.Fingerprints, 0, len(shard.series))
+	for fp := range shard.series {
+		result = append(result, fp)
+	}
+	sort.Sort(result)
+	return result
+}
+
+func (shard *indexShard) labelNames(extractor func(unlockIndex) []string) []string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	if extractor == nil {
+		return append(make([]string, 0, len(shard.names)), shard.names...)
+	}
+
+	results := make([]string, 0, len(shard.idx))
+	results = append(results, extractor(shard.idx)...)
+	sort.Strings(results)
+	return results
+}
+
+// insertName adds a new label name to the sorted names.
+// Must be called under the write lock.
+func (shard *indexShard) insertName(name string) {
+	j := sort.SearchStrings(shard.names, name)
+	names := make([]string, 0, len(shard.names)+1)
+	names = append(names, shard.names[:j]...)
+	names = append(names, name)
+	shard.names = append(names, shard.names[j:]...)
+}
+
+// deleteName removes a label name from the index and the sorted names.
+// Must be called under the write lock.
+func (shard *indexShard) deleteName(name string) {
+	delete(shard.idx, name)
+	j := sort.SearchStrings(shard.names, name)
+	if j >= len(shard.names) || shard.names[j] != name {
+		return
+	}
+	names := make([]string, 0, len(shard.names)-1)
+	names = append(names, shard.names[:j]...)
+	shard.names = append(names, shard.names[j+1:]...)
+}
+
+func (shard *indexShard) labelValues(
+	name string,
+	extractor func(indexEntry) []string,
+) []string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	values, ok := shard.idx[name]
+	if !ok {
+		return nil
+	}
+
+	if extractor == nil && values.sorted != nil {
+		return append([]string(nil), values.sorted.values...)
+	}
+	if extractor == nil && values.cache != nil {
+		return append([]string(nil), values.cache.get(values)...)
+	}
+	if extractor == nil {
+		results := make([]string, 0, len(values.fps))
+		for val := range values.fps {
+			results = append(results, val)
+		}
+		sort.Strings(results)
+		return results
+	}
+
+	return extractor(values)
+}
+
+// symbols returns the sorted distinct label names and values of the shard.
+func (shard *indexShard) symbols() []string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	seen := make(map[string]struct{}, len(shard.names))
+	for name, entry := range shard.idx {
+		seen[name] = struct{}{}
+		for value := range entry.fps {
+			seen[value] = struct{}{}
+		}
+	}
+	results := make([]string, 0, len(seen))
+	for symbol := range seen {
+		results = append(results, symbol)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// pairPostings returns a copy of the postings of the given label pair. It is
+// never nil, as intersect treats nil as all fingerprints.
+func (shard *indexShard) pairPostings(name, value string) []model.Fingerprint {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	entry, ok := shard.idx[name].fps[value]
+	if !ok {
+		return []model.Fingerprint{}
+	}
+	return entry.fps.appendTo([]model.Fingerprint{}) // deliberate copy
+}
+
+// valueCounts adds the postings length of each value of the given name to
+// counts.
+func (shard *indexShard) valueCounts(name string, counts map[string]uint64) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for value, entry := range shard.idx[name].fps {
+		counts[value] += uint64(entry.fps.len())
+	}
+}
+
+// pairLengths adds the postings length of each label pair of the shard to
+// lengths.
+func (shard *indexShard) pairLengths(lengths map[LabelPair]int) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for name, values := range shard.idx {
+		for value, entry := range values.fps {
+			lengths[LabelPair{Name: name, Value: value}] += entry.fps.len()
+		}
+	}
+}
+
+// valuesWithPrefix returns the sorted values of the given name starting
+// with prefix.
+func (shard *indexShard) valuesWithPrefix(name, prefix string) []string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	values, ok := shard.idx[name]
+	if !ok {
+		return nil
+	}
+	if values.sorted != nil {
+		return append([]string(nil), values.sorted.withPrefix(prefix)...)
+	}
+	var results []string
+	for val := range values.fps {
+		if strings.HasPrefix(val, prefix) {
+			results = append(results, val)
+		}
+	}
+	sort.Strings(results)
+	return results
+}
+
+// visitValueCounts calls visit with each label name of the shard, its
+// number of distinct values and one of them.
+func (shard *indexShard) visitValueCounts(visit func(name, value string, values int)) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for name, values := range shard.idx {
+		for value := range values.fps {
+			visit(name, value, len(values.fps))
+			break
+		}
+	}
+}
+
+// valuesAfter returns up to limit sorted values of the given name greater
+// than after, all of them if limit is not positive.
+func (shard *indexShard) valuesAfter(name, after string, limit int) []string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	values, ok := shard.idx[name]
+	if !ok {
+		return nil
+	}
+	var sorted []string
+	switch {
+	case values.sorted != nil:
+		sorted = values.sorted.values
+	case values.cache != nil:
+		sorted = values.cache.get(values)
+	default:
+		for val := range values.fps {
+			if val > after {
+				sorted = append(sorted, val)
+			}
+		}
+		sort.Strings(sorted)
+	}
+	sorted = sorted[sort.SearchStrings(sorted, after):]
+	if len(sorted) > 0 && sorted[0] == after {
+		sorted = sorted[1:]
+	}
+	if limit > 0 && len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return append([]string(nil), sorted...)
+}
+
+// postings returns a copy of the postings of each value of the given name.
+func (shard *indexShard) postings(name string) map[string][]model.Fingerprint {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	values, ok := shard.idx[name]
+	if !ok {
+		return nil
+	}
+	result := make(map[string][]model.Fingerprint, len(values.fps))
+	for value, entry := range values.fps {
+		result[value] = entry.fps.appendTo(nil) // deliberate copy
+	}
+	return result
+}
+
+// valuesIntersecting adds to values the values of the given name whose
+// postings intersect the sorted fingerprints.
+func (shard *indexShard) valuesIntersecting(name string, fps []model.Fingerprint, values map[string]struct{}) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for value, entry := range shard.idx[name].fps {
+		if _, ok := values[value]; ok {
+			continue
+		}
+		if len(entry.fps.intersect(fps)) > 0 {
+			values[value] = struct{}{}
+		}
+	}
+}
 
-	internedLabels := make(phlaremodel.Labels, len(metric))
+// labelValuesMulti returns the sorted values of each of the given names
+// present in the shard.
+func (shard *indexShard) labelValuesMulti(names []string) map[string][]string {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
 
-	for i, pair := range metric {
-		values, ok := shard.idx[pair.Name]
+	results := make(map[string][]string, len(names))
+	for _, name := range names {
+		values, ok := shard.idx[name]
 		if !ok {
-			values = indexEntry{
-				name: copyString(pair.Name),
-				fps:  map[string]indexValueEntry{},
-			}
-			shard.idx[values.name] = values
+			continue
 		}
-		fingerprints, ok := values.fps[pair.Value]
-		if !ok {
-			fingerprints = indexValueEntry{
-				value: copyString(pair.Value),
-			}
+		result := make([]string, 0, len(values.fps))
+		for val := range values.fps {
+			result = append(result, val)
 		}
-		// Insert into the right position to keep fingerprints sorted
-		j := sort.Search(len(fingerprints.fps), func(i int) bool {
-			return fingerprints.fps[i] >= fp
-		})
-		fingerprints.fps = append(fingerprints.fps, 0)
-		copy(fingerprints.fps[j+1:], fingerprints.fps[j:])
-		fingerprints.fps[j] = fp
-		values.fps[fingerprints.value] = fingerprints
-		internedLabels[i] = &commonv1.LabelPair{Name: values.name, Value: fingerprints.value}
+		sort.Strings(result)
+		results[name] = result
 	}
-	sort.Sort(internedLabels)
-	return internedLabels
+	return results
 }
 
-func (shard *indexShard) lookup(matchers []*labels.Matcher) []model.Fingerprint {
-	// index slice values must only be accessed under lock, so all
-	// code paths must take a copy before returning
+// allValues returns the intersection of the postings of the values of the
+// label name, values being non-empty.
+func (shard *indexShard) allValues(name string, values []string) []model.Fingerprint {
 	shard.mtx.RLock()
 	defer shard.mtx.RUnlock()
 
-	// per-shard intersection is initially nil, which is a special case
-	// meaning "everything" when passed to intersect()
-	// loop invariant: result is sorted
+	entries, ok := shard.idx[name]
+	if !ok {
+		return nil
+	}
 	var result []model.Fingerprint
-	for _, matcher := range matchers {
-		values, ok := shard.idx[matcher.Name]
+	for _, value := range values {
+		entry, ok := entries.fps[value]
 		if !ok {
 			return nil
 		}
-		var toIntersect model.Fingerprints
-		if matcher.Type == labels.MatchEqual {
-			fps := values.fps[matcher.Value]
-			toIntersect = append(toIntersect, fps.fps...) // deliberate copy
-		} else if matcher.Type == labels.MatchRegexp && len(FindSetMatches(matcher.Value)) > 0 {
-			// The lookup is of the form `=~"a|b|c|d"`
-			set := FindSetMatches(matcher.Value)
-			for _, value := range set {
-				toIntersect = append(toIntersect, values.fps[value].fps...)
-			}
-			sort.Sort(toIntersect)
-		} else {
-			// accumulate the matching fingerprints (which are all distinct)
-			// then sort to maintain the invariant
-			for value, fps := range values.fps {
-				if matcher.Matches(value) {
-					toIntersect = append(toIntersect, fps.fps...)
-				}
-			}
-			sort.Sort(toIntersect)
-		}
-		result = intersect(result, toIntersect)
+		// intersect takes a nil list for all fingerprints
+		result = intersect(result, entry.fps.appendTo([]model.Fingerprint{}))
 		if len(result) == 0 {
 			return nil
 		}
 	}
-
 	return result
 }
 
-func (shard *indexShard) allFPs() model.Fingerprints {
+func (shard *indexShard) numericRange(name string, min, max float64) []model.Fingerprint {
 	shard.mtx.RLock()
 	defer shard.mtx.RUnlock()
 
-	var fps model.Fingerprints
-	for _, ie := range shard.idx {
-		for _, ive := range ie.fps {
-			fps = append(fps, ive.fps...)
-		}
-	}
-	if len(fps) == 0 {
+	values, ok := shard.idx[name]
+	if !ok {
 		return nil
 	}
 
+	// accumulate the matching fingerprints (which are all distinct)
+	// then sort to maintain the invariant
 	var result model.Fingerprints
-	m := map[model.Fingerprint]struct{}{}
-	for _, fp := range fps {
-		if _, ok := m[fp]; !ok {
-			m[fp] = struct{}{}
-			result = append(result, fp)
+	if values.sorted != nil {
+		for _, v := range values.sorted.inRange(min, max) {
+			result = values.fps[v.value].fps.appendTo(result)
+		}
+		sort.Sort(result)
+		return result
+	}
+	for value, fps := range values.fps {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		if v >= min && v <= max {
+			result = fps.fps.appendTo(result)
 		}
 	}
+	sort.Sort(result)
 	return result
 }
 
-func (shard *indexShard) labelNames(extractor func(unlockIndex) []string) []string {
-	shard.mtx.RLock()
-	defer shard.mtx.RUnlock()
+// delete removes fp from the postings of the given labels. If fp no longer
+// appears in any postings, its labels before the delete are returned.
+// Otherwise the removed labels are dropped from the stored labels of fp.
+func (shard *indexShard) delete(labels []*commonv1.LabelPair, fp model.Fingerprint) phlaremodel.Labels {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	return shard.deleteSeries(labels, fp)
+}
 
-	results := make([]string, 0, len(shard.idx))
-	if extractor != nil {
-		results = append(results, extractor(shard.idx)...)
-	} else {
-		for name := range shard.idx {
-			results = append(results, name)
-		}
+// deleteIfExists is delete reporting whether the shard held fp.
+func (shard *indexShard) deleteIfExists(labels []*commonv1.LabelPair, fp model.Fingerprint) (phlaremodel.Labels, bool) {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	if _, ok := shard.series[fp]; !ok {
+		return nil, false
 	}
-
-	sort.Strings(results)
-	return results
+	return shard.deleteSeries(labels, fp), true
 }
 
-func (shard *indexShard) labelValues(
-	name string,
-	extractor func(indexEntry) []string,
-) []string {
-	shard.mtx.RLock()
-	defer shard.mtx.RUnlock()
-
-	values, ok := shard.idx[name]
+// deleteStored deletes fp with the labels stored for it, and reports
+// whether the shard held fp.
+func (shard *indexShard) deleteStored(fp model.Fingerprint) (phlaremodel.Labels, bool) {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	stored, ok := shard.series[fp]
 	if !ok {
-		return nil
-	}
-
-	if extractor == nil {
-		results := make([]string, 0, len(values.fps))
-		for val := range values.fps {
-			results = append(results, val)
-		}
-		sort.Strings(results)
-		return results
+		return nil, false
 	}
-
-	return extractor(values)
+	return shard.deleteSeries(stored, fp), true
 }
 
-func (shard *indexShard) delete(labels []*commonv1.LabelPair, fp model.Fingerprint) {
-	shard.mtx.Lock()
-	defer shard.mtx.Unlock()
+// deleteSeries is delete without locking. Must be called under the write
+// lock.
+func (shard *indexShard) deleteSeries(labels []*commonv1.LabelPair, fp model.Fingerprint) phlaremodel.Labels {
+	shard.generations.bump(labels)
+
+	stored := shard.series[fp]
 
 	for _, pair := range labels {
 		name, value := pair.Name, pair.Value
@@ -427,28 +2974,227 @@ func (shard *indexShard) delete(labels []*commonv1.LabelPair, fp model.Fingerpri
 			continue
 		}
 
-		j := sort.Search(len(fingerprints.fps), func(i int) bool {
-			return fingerprints.fps[i] >= fp
-		})
-
-		// see if search didn't find fp which matches the condition which means we don't have to do anything.
-		if j >= len(fingerprints.fps) || fingerprints.fps[j] != fp {
+		// see if fp wasn't found which means we don't have to do anything.
+		if !fingerprints.fps.remove(fp) {
 			continue
 		}
-		fingerprints.fps = fingerprints.fps[:j+copy(fingerprints.fps[j:], fingerprints.fps[j+1:])]
+		shard.dropSeriesLabel(fp, name)
 
-		if len(fingerprints.fps) == 0 {
+		if fingerprints.fps.len() == 0 {
+			shard.releasePostings(fingerprints.fps)
 			delete(values.fps, value)
+			values.sorted.remove(value)
+			values.cache.invalidate()
 		} else {
 			values.fps[value] = fingerprints
 		}
 
 		if len(values.fps) == 0 {
-			delete(shard.idx, name)
+			shard.deleteName(name)
 		} else {
 			shard.idx[name] = values
 		}
 	}
+
+	if _, ok := shard.refs[fp]; ok {
+		return nil
+	}
+	// stored is nil if fp is unknown.
+	return stored
+}
+
+// postingsFingerprints is fingerprints for the shards without a fingerprint
+// map, deduplicating the fingerprints of their postings.
+func (shard *indexShard) postingsFingerprints() model.Fingerprints {
+	var fps model.Fingerprints
+	for _, ie := range shard.idx {
+		for _, ive := range ie.fps {
+			fps = ive.fps.appendTo(fps)
+		}
+	}
+	if len(fps) == 0 {
+		return nil
+	}
+	sort.Sort(fps)
+	j := 1
+	for i := 1; i < len(fps); i++ {
+		if fps[i] != fps[j-1] {
+			fps[j] = fps[i]
+			j++
+		}
+	}
+	return fps[:j]
+}
+
+// valueSketches inserts the values of each label name of the shard
+// into the sketch for that name, creating missing sketches.
+func (shard *indexShard) valueSketches(sketches map[string]*hyperLogLog) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for name, values := range shard.idx {
+		sketch, ok := sketches[name]
+		if !ok {
+			sketch = &hyperLogLog{}
+			sketches[values.name] = sketch
+		}
+		for value := range values.fps {
+			sketch.insert(value)
+		}
+	}
+}
+
+// distinctValues adds the values of each label name of the shard to the
+// set of that name, creating missing sets.
+func (shard *indexShard) distinctValues(distinct map[string]map[string]struct{}) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for name, values := range shard.idx {
+		set, ok := distinct[name]
+		if !ok {
+			set = make(map[string]struct{}, len(values.fps))
+			distinct[values.name] = set
+		}
+		for value := range values.fps {
+			set[value] = struct{}{}
+		}
+	}
+}
+
+// postingsLengths sets lengths[i] to the number of postings in the shard
+// for the equality matcher matchers[equals[i]].
+func (shard *indexShard) postingsLengths(matchers []*labels.Matcher, equals []int, lengths []int) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for i, j := range equals {
+		lengths[i] = 0
+		if entry, ok := shard.idx[matchers[j].Name].fps[matchers[j].Value]; ok {
+			lengths[i] = entry.fps.len()
+		}
+	}
+}
+
+func (shard *indexShard) exists(fp model.Fingerprint) bool {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	_, ok := shard.series[fp]
+	return ok
+}
+
+func (shard *indexShard) isEmpty() bool {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	return len(shard.idx) == 0
+}
+
+// hasPosting reports whether fp is in the postings of name=value.
+// Must be called under the lock.
+func (shard *indexShard) hasPosting(name, value string, fp model.Fingerprint) bool {
+	entry, ok := shard.idx[name].fps[value]
+	return ok && entry.fps.contains(fp)
+}
+
+// purgeOlderThan removes all value entries last written before cutoff
+// and returns how many were removed. Removed pairs are also dropped from
+// the labels of the affected series.
+func (shard *indexShard) purgeOlderThan(cutoff int64) int {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	var removed int
+	for name, values := range shard.idx {
+		for value, fingerprints := range values.fps {
+			if fingerprints.lastWrite >= cutoff {
+				continue
+			}
+			fingerprints.fps.iterate(func(fp model.Fingerprint) bool {
+				shard.dropSeriesLabel(fp, name)
+				return true
+			})
+			shard.releasePostings(fingerprints.fps)
+			delete(values.fps, value)
+			values.sorted.remove(value)
+			values.cache.invalidate()
+			shard.generations.bumpName(name)
+			removed++
+		}
+		if len(values.fps) == 0 {
+			shard.deleteName(name)
+		}
+	}
+	return removed
+}
+
+// deleteLabelValue deletes the series carrying the given label pair, using
+// their stored labels, and returns them.
+func (shard *indexShard) deleteLabelValue(name, value string) []fingerprintLabels {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	entry, ok := shard.idx[name].fps[value]
+	if !ok {
+		return nil
+	}
+	// deleting the series releases the postings
+	fps := entry.fps.appendTo(nil)
+	deleted := make([]fingerprintLabels, 0, len(fps))
+	for _, fp := range fps {
+		if lbs := shard.deleteSeries(shard.series[fp], fp); lbs != nil {
+			deleted = append(deleted, fingerprintLabels{fp: fp, labels: lbs})
+		}
+	}
+	return deleted
+}
+
+func (shard *indexShard) dropLabel(name string) (affected int) {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	values, ok := shard.idx[name]
+	if !ok {
+		return 0
+	}
+	shard.generations.bumpName(name)
+	for _, fingerprints := range values.fps {
+		// a series has a single value per name
+		affected += fingerprints.fps.len()
+		fingerprints.fps.iterate(func(fp model.Fingerprint) bool {
+			shard.dropSeriesLabel(fp, name)
+			return true
+		})
+		shard.releasePostings(fingerprints.fps)
+	}
+	shard.deleteName(name)
+	return affected
+}
+
+// dropSeriesLabel removes the named label from the stored labels of fp,
+// once fp was removed from the postings of that label. fp is removed from
+// the shard after its last postings. The stored slice is replaced rather
+// than modified since it may have been handed out to callers. Must be
+// called under the write lock.
+func (shard *indexShard) dropSeriesLabel(fp model.Fingerprint, name string) {
+	if !shard.keepSeries {
+		return
+	}
+	if shard.refs[fp]--; shard.refs[fp] <= 0 {
+		delete(shard.refs, fp)
+		delete(shard.series, fp)
+		return
+	}
+	lbs, ok := shard.series[fp]
+	if !ok {
+		return
+	}
+	result := make(phlaremodel.Labels, 0, len(lbs))
+	for _, l := range lbs {
+		if l.Name != name {
+			result = append(result, l)
+		}
+	}
+	shard.series[fp] = result
 }
 
 // intersect two sorted lists of fingerprints.  Assumes there are no duplicate
@@ -471,6 +3217,64 @@ func intersect(a, b []model.Fingerprint) []model.Fingerprint {
 	return result
 }
 
+// union two sorted lists of fingerprints, removing duplicates.
+func union(a, b []model.Fingerprint) []model.Fingerprint {
+	result := make([]model.Fingerprint, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			result = append(result, a[i])
+			i++
+		} else if a[i] > b[j] {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
+// complement returns the fingerprints of all which aren't in subset. Both
+// must be sorted and free of duplicates, subset needn't be a subset of all.
+func complement(all, subset []model.Fingerprint) []model.Fingerprint {
+	result := make([]model.Fingerprint, 0, len(all))
+	j := 0
+	for _, fp := range all {
+		for j < len(subset) && subset[j] < fp {
+			j++
+		}
+		if j < len(subset) && subset[j] == fp {
+			continue
+		}
+		result = append(result, fp)
+	}
+	return result
+}
+
+// mergeFingerprintSlices merges sorted lists of fingerprints into a single
+// sorted list without duplicates.
+func mergeFingerprintSlices(ss [][]model.Fingerprint) []model.Fingerprint {
+	switch len(ss) {
+	case 0:
+		return nil
+	case 1:
+		return ss[0]
+	case 2:
+		return union(ss[0], ss[1])
+	default:
+		halfway := len(ss) / 2
+		return union(
+			mergeFingerprintSlices(ss[:halfway]),
+			mergeFingerprintSlices(ss[halfway:]),
+		)
+	}
+}
+
 func mergeStringSlices(ss [][]string) []string {
 	switch len(ss) {
 	case 0:
@@ -509,6 +3313,32 @@ func mergeTwoStringSlices(a, b []string) []string {
 	return result
 }
 
+// visitMergedStringSlices calls visit for each distinct string of the sorted
+// input slices in ascending order, until visit returns false.
+func visitMergedStringSlices(ss [][]string, visit func(string) bool) {
+	pos := make([]int, len(ss))
+	for {
+		min := -1
+		for i := range ss {
+			if pos[i] < len(ss[i]) && (min < 0 || ss[i][pos[i]] < ss[min][pos[min]]) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return
+		}
+		value := ss[min][pos[min]]
+		for i := range ss {
+			if pos[i] < len(ss[i]) && ss[i][pos[i]] == value {
+				pos[i]++
+			}
+		}
+		if !visit(value) {
+			return
+		}
+	}
+}
+
 func FindSetMatches(pattern string) []string {
 	// Return empty matches if the wrapper from Prometheus is missing.
 	if len(pattern) < 6 || pattern[:4] != "^(?:" || pattern[len(pattern)-2:] != ")$" {
@@ -529,6 +3359,21 @@ func FindSetMatches(pattern string) []string {
 			escaped = false
 		} else {
 			switch {
+			case pattern[i] == '[':
+				// A character class is only supported as a whole alternative.
+				end, ok := findSetCharacterClass(pattern, i)
+				if !ok || sets[len(sets)-1].Len() > 0 {
+					return nil
+				}
+				if end+1 < len(pattern)-2 && pattern[end+1] != '|' {
+					return nil
+				}
+				sets[len(sets)-1].WriteByte(pattern[i+1])
+				for j := i + 2; j < end; j++ {
+					sets = append(sets, &strings.Builder{})
+					sets[len(sets)-1].WriteByte(pattern[j])
+				}
+				i = end
 			case isRegexMetaCharacter(pattern[i]):
 				if pattern[i] == '|' {
 					sets = append(sets, &strings.Builder{})
@@ -542,11 +3387,33 @@ func FindSetMatches(pattern string) []string {
 			}
 		}
 	}
+	// repeated alternatives, e.g. `a|a` or `[aa]`, are only returned once
 	matches := make([]string, 0, len(sets))
+	seen := make(map[string]struct{}, len(sets))
 	for _, s := range sets {
-		if s.Len() > 0 {
+		if s.Len() == 0 {
+			continue
+		}
+		if _, ok := seen[s.String()]; !ok {
+			seen[s.String()] = struct{}{}
 			matches = append(matches, s.String())
 		}
 	}
 	return matches
 }
+
+// findSetCharacterClass returns the index of the closing bracket of the
+// character class starting at pattern[start], if the class is a non-empty
+// list of literal ASCII characters: ranges, negations, escapes and nested
+// brackets are not supported.
+func findSetCharacterClass(pattern string, start int) (int, bool) {
+	for i := start + 1; i < len(pattern)-2; i++ {
+		switch b := pattern[i]; {
+		case b == ']':
+			return i, i > start+1
+		case b == '^' || b == '-' || b == '[' || b == '\\' || b >= utf8.RuneSelf:
+			return 0, false
+		}
+	}
+	return 0, false
+}
@@ -1,9 +1,16 @@
 package tsdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"regexp"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
@@ -47,6 +54,64 @@ func Test_GetShards(t *testing.T) {
 func Test_ValidateShards(t *testing.T) {
 	ii := NewWithShards(32)
 	require.NoError(t, ii.validateShard(&shard.Annotation{Shard: 1, Of: 16}))
+
+	err := ii.validateShard(&shard.Annotation{Shard: 1, Of: 12})
+	require.ErrorIs(t, err, ErrShardNotDivisor)
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+	require.NotErrorIs(t, err, ErrShardTooLarge)
+
+	err = ii.validateShard(&shard.Annotation{Shard: 1, Of: 64})
+	require.ErrorIs(t, err, ErrShardTooLarge)
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+	require.NotErrorIs(t, err, ErrShardNotDivisor)
+}
+
+func Test_NewChecked(t *testing.T) {
+	for _, tt := range []struct {
+		totalShards uint32
+		valid       bool
+	}{
+		{0, false},
+		{1, true},
+		{DefaultIndexShards, true},
+		{MaxIndexShards, true},
+		{MaxIndexShards + 1, false},
+		{math.MaxUint32, false},
+	} {
+		ii, err := NewChecked(tt.totalShards, IndexOptions{})
+		if !tt.valid {
+			require.ErrorIs(t, err, ErrInvalidShardCount, tt.totalShards)
+			require.Nil(t, ii)
+			continue
+		}
+		require.NoError(t, err, tt.totalShards)
+		require.Len(t, ii.shards, int(tt.totalShards))
+	}
+
+	// the lenient constructors fall back to the default shard count
+	ii := NewWithShards(0)
+	require.Len(t, ii.shards, DefaultIndexShards)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	require.True(t, ii.Exists(1))
+}
+
+func Test_ValidateShardAnnotation(t *testing.T) {
+	require.NoError(t, ValidateShardAnnotation(32, nil))
+	require.NoError(t, ValidateShardAnnotation(32, &shard.Annotation{Shard: 3, Of: 32}))
+	require.ErrorIs(t, ValidateShardAnnotation(32, &shard.Annotation{Shard: 1, Of: 12}), ErrShardNotDivisor)
+	require.ErrorIs(t, ValidateShardAnnotation(8, &shard.Annotation{Shard: 1, Of: 16}), ErrShardTooLarge)
+	require.ErrorIs(t, ValidateShardAnnotation(8, &shard.Annotation{Shard: 0, Of: 0}), ErrShardFactorNotPositive)
+	require.ErrorIs(t, ValidateShardAnnotation(8, &shard.Annotation{Shard: 0, Of: -4}), ErrShardFactorNotPositive)
+	require.ErrorIs(t, ValidateShardAnnotation(8, &shard.Annotation{Shard: 4, Of: 4}), ErrShardNotInFactor)
+	require.ErrorIs(t, ValidateShardAnnotation(8, &shard.Annotation{Shard: -1, Of: 4}), ErrShardNotInFactor)
+
+	// used to index shards out of range and panic
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	_, err := ii.Lookup(nil, &shard.Annotation{Shard: 5, Of: 4})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+	_, err = ii.LabelNames(&shard.Annotation{Shard: 0, Of: 0})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
 }
 
 func TestDeleteAddLoopkup(t *testing.T) {
@@ -155,3 +220,2141 @@ func Test_ConsistentMapping(t *testing.T) {
 		require.Equal(t, aIDs, bIDs, "incorrect shard mapping for shard %v", shard)
 	}
 }
+
+func Test_LookupNumericRange(t *testing.T) {
+	ii := NewWithShards(16)
+	for i, v := range []string{"1", "2", "3.5", "5", "6", "NaN", "abc", "-1"} {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "foo", Value: "bar"},
+			{Name: "replica", Value: v},
+		}, model.Fingerprint(i))
+	}
+
+	ids, err := ii.LookupNumericRange("replica", 2, 5, nil)
+	require.NoError(t, err)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	require.Equal(t, []model.Fingerprint{1, 2, 3}, ids)
+
+	ids, err = ii.LookupNumericRange("missing", 2, 5, nil)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	_, err = ii.LookupNumericRange("replica", 2, 5, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LookupAllValues(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 10; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+
+	ids, err := ii.LookupAllValues("env", []string{"env-1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1, 3, 5, 7, 9}, ids)
+	ids, err = ii.LookupAllValues("env", []string{"env-1", "env-1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1, 3, 5, 7, 9}, ids)
+
+	// a series carries a single value per name
+	for _, values := range [][]string{{"env-0", "env-1"}, {"env-1", "missing"}, nil} {
+		ids, err = ii.LookupAllValues("env", values, nil)
+		require.NoError(t, err)
+		require.Empty(t, ids)
+	}
+	ids, err = ii.LookupAllValues("missing", []string{"env-1"}, nil)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	// unless the postings disagree with the stored labels
+	s := ii.shards[ii.ShardForLabels(phlaremodel.LabelsFromStrings("env", "env-0", "pod", "pod-0"))]
+	s.idx["env"].fps["env-1"].fps.add(0)
+	ids, err = ii.LookupAllValues("env", []string{"env-0", "env-1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{0}, ids)
+
+	_, err = ii.LookupAllValues("env", []string{"env-1"}, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_AddInterned(t *testing.T) {
+	src, dst := NewWithShards(4), NewWithShards(4)
+	interned := src.Add(phlaremodel.LabelsFromStrings("foo", "bar", "hi", "there"), 1)
+
+	stored := dst.AddInterned(interned, 1)
+	require.Equal(t, interned, stored)
+	for i := range interned {
+		// the strings are retained rather than copied
+		require.Equal(t, stringData(interned[i].Value), stringData(stored[i].Value))
+	}
+	copied := dst.Add(phlaremodel.LabelsFromStrings("foo", "baz"), 2)
+	require.NotEqual(t, stringData("baz"), stringData(copied.Get("foo")))
+
+	fps, err := dst.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "hi", "there")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+	dst.Delete(interned, 1)
+	dst.Delete(copied, 2)
+	require.False(t, dst.Exists(1))
+	require.NoError(t, dst.Validate())
+}
+
+func Test_LabelValuesInterned(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 50; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "foo", Value: "bar"},
+			{Name: "hi", Value: fmt.Sprintf("%02d", i%20)},
+		}, model.Fingerprint(i))
+	}
+
+	expected, err := ii.LabelValues("hi", nil)
+	require.NoError(t, err)
+
+	var visited []string
+	require.NoError(t, ii.LabelValuesInterned("hi", nil, func(value string) bool {
+		visited = append(visited, value)
+		return true
+	}))
+	require.Equal(t, expected, visited)
+
+	visited = visited[:0]
+	require.NoError(t, ii.LabelValuesInterned("hi", nil, func(value string) bool {
+		visited = append(visited, value)
+		return len(visited) < 3
+	}))
+	require.Equal(t, []string{"00", "01", "02"}, visited)
+
+	require.ErrorIs(t, ii.LabelValuesInterned("hi", &shard.Annotation{Shard: 0, Of: 3}, func(string) bool { return true }), ErrInvalidShardQuery)
+}
+
+func Test_PoolPostings(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{PoolPostings: true})
+	lbs := []*commonv1.LabelPair{
+		{Name: "foo", Value: "bar"},
+		{Name: "hi", Value: "hello"},
+	}
+	ii.Add(lbs, 1)
+	ii.Add(lbs, 2)
+	ii.Delete(lbs, 1)
+	ii.Delete(lbs, 2)
+
+	var pooled int
+	for _, s := range ii.shards {
+		pooled += len(s.freeList.free)
+	}
+	require.Equal(t, 2, pooled)
+
+	ii.Add(lbs, 3)
+	ids, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "hi", "hello")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{3}, ids)
+}
+
+func BenchmarkAddDelete(b *testing.B) {
+	series := make([][]*commonv1.LabelPair, 1000)
+	for i := range series {
+		series[i] = []*commonv1.LabelPair{
+			{Name: "pod", Value: fmt.Sprintf("pod-%d", i)},
+			{Name: "service", Value: fmt.Sprintf("svc-%d", i%10)},
+		}
+	}
+
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			ii := NewWithOptions(DefaultIndexShards, IndexOptions{PoolPostings: pool})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for i, lbs := range series {
+					ii.Add(lbs, model.Fingerprint(i))
+				}
+				for i, lbs := range series {
+					ii.Delete(lbs, model.Fingerprint(i))
+				}
+			}
+		})
+	}
+}
+
+func Test_SeriesAsPromLabels(t *testing.T) {
+	ii := NewWithShards(16)
+	ii.Add([]*commonv1.LabelPair{
+		{Name: "Zone", Value: "eu"},
+		{Name: "__name__", Value: "cpu"},
+		{Name: "empty", Value: ""},
+		{Name: "foo", Value: "bar"},
+	}, 1)
+	ii.Add([]*commonv1.LabelPair{
+		{Name: "__name__", Value: "memory"},
+		{Name: "foo", Value: "bar"},
+	}, 2)
+
+	res, err := ii.SeriesAsPromLabels([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu"),
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []labels.Labels{
+		labels.FromStrings("__name__", "cpu", "Zone", "eu", "foo", "bar"),
+	}, res)
+
+	res, err = ii.SeriesAsPromLabels([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "foo", "bar"),
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	ii.Delete([]*commonv1.LabelPair{
+		{Name: "__name__", Value: "memory"},
+		{Name: "foo", Value: "bar"},
+	}, 2)
+	res, err = ii.SeriesAsPromLabels(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, "cpu", res[0].Get(labels.MetricName))
+}
+
+func Test_LookupSortedAcrossShards(t *testing.T) {
+	ii := NewWithShards(4)
+	// Pick series that deliberately alternate between two shards so that
+	// the shards' fingerprint ranges interleave.
+	var expected []model.Fingerprint
+	var fp model.Fingerprint
+	for i := 0; len(expected) < 20; i++ {
+		lbs := []*commonv1.LabelPair{
+			{Name: "foo", Value: "bar"},
+			{Name: "i", Value: fmt.Sprint(i)},
+		}
+		if labelsSeriesIDHash(lbs)%4 != uint32(len(expected)%2) {
+			continue
+		}
+		fp += 2
+		ii.Add(lbs, fp)
+		expected = append(expected, fp)
+	}
+	for i := range ii.shards[:2] {
+		require.NotEmpty(t, ii.shards[i].allFPs())
+	}
+
+	ids, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, ids)
+
+	ids, err = ii.Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, ids)
+
+	ids, err = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "i", ".+")}, &shard.Annotation{Shard: 0, Of: 2})
+	require.NoError(t, err)
+	require.True(t, sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }))
+	require.Len(t, ids, 10)
+}
+
+func Test_MergeFingerprintSlices(t *testing.T) {
+	for _, tt := range []struct {
+		input    [][]model.Fingerprint
+		expected []model.Fingerprint
+	}{
+		{nil, nil},
+		{[][]model.Fingerprint{{1, 2}}, []model.Fingerprint{1, 2}},
+		{[][]model.Fingerprint{{1, 3, 5}, {2, 4, 6}}, []model.Fingerprint{1, 2, 3, 4, 5, 6}},
+		{[][]model.Fingerprint{{1, 4}, {2, 4}, {3, 4, 9}}, []model.Fingerprint{1, 2, 3, 4, 9}},
+		{[][]model.Fingerprint{{}, {7}, {}}, []model.Fingerprint{7}},
+	} {
+		require.Equal(t, tt.expected, mergeFingerprintSlices(tt.input))
+	}
+}
+
+func Test_Complement(t *testing.T) {
+	for _, tt := range []struct {
+		all, subset []model.Fingerprint
+		expected    []model.Fingerprint
+	}{
+		{nil, nil, []model.Fingerprint{}},
+		{[]model.Fingerprint{1, 2, 3}, nil, []model.Fingerprint{1, 2, 3}},
+		{[]model.Fingerprint{1, 2, 3}, []model.Fingerprint{1, 2, 3}, []model.Fingerprint{}},
+		{[]model.Fingerprint{1, 3, 5}, []model.Fingerprint{2, 4, 6}, []model.Fingerprint{1, 3, 5}},
+		{[]model.Fingerprint{1, 2, 3, 4, 5}, []model.Fingerprint{2, 4}, []model.Fingerprint{1, 3, 5}},
+		// extra fingerprints of subset are ignored
+		{[]model.Fingerprint{2, 4}, []model.Fingerprint{1, 2, 3, 5}, []model.Fingerprint{4}},
+		{nil, []model.Fingerprint{1}, []model.Fingerprint{}},
+	} {
+		require.Equal(t, tt.expected, complement(tt.all, tt.subset), "%v - %v", tt.all, tt.subset)
+	}
+}
+
+func Test_AllFingerprints(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 10; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(9-i))
+	}
+	fps, err := ii.AllFingerprints(nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, fps)
+
+	half, err := ii.AllFingerprints(&shard.Annotation{Shard: 0, Of: 2})
+	require.NoError(t, err)
+	other, err := ii.AllFingerprints(&shard.Annotation{Shard: 1, Of: 2})
+	require.NoError(t, err)
+	require.Equal(t, other, complement(fps, half))
+
+	fps, err = NewWithShards(2).AllFingerprints(nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+}
+
+func Test_PurgeOlderThan(t *testing.T) {
+	old := []*commonv1.LabelPair{
+		{Name: "foo", Value: "bar"},
+		{Name: "pod", Value: "old"},
+	}
+	recent := []*commonv1.LabelPair{
+		{Name: "foo", Value: "bar"},
+		{Name: "pod", Value: "recent"},
+	}
+
+	ii := NewWithShards(1)
+	ii.Add(old, 1)
+	require.Equal(t, 0, ii.PurgeOlderThan(time.Now().Add(time.Hour)))
+
+	ii = NewWithOptions(1, IndexOptions{TrackLastWrite: true})
+	ii.Add(old, 1)
+	// the cutoff follows the writes of the old series, the recent one is
+	// added once the clock has reached it
+	cutoff := time.Unix(0, ii.shards[0].idx["pod"].fps["old"].lastWrite+1)
+	require.Eventually(t, func() bool { return !time.Now().Before(cutoff) }, time.Second, time.Microsecond)
+	ii.Add(recent, 2)
+
+	// foo=bar was touched by the recent series, pod=old was not.
+	require.Equal(t, 1, ii.PurgeOlderThan(cutoff))
+	values, err := ii.LabelValues("pod", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"recent"}, values)
+	require.Equal(t, phlaremodel.Labels{{Name: "foo", Value: "bar"}}, ii.shards[0].series[1])
+
+	require.Equal(t, 2, ii.PurgeOlderThan(time.Now().Add(time.Hour)))
+	names, err := ii.LabelNames(nil)
+	require.NoError(t, err)
+	require.Empty(t, names)
+	require.Empty(t, ii.shards[0].series)
+}
+
+func Test_ApproxLabelNameCardinality(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 5000; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint(i % 3)},
+			{Name: "pod", Value: fmt.Sprint(i)},
+		}, model.Fingerprint(i))
+	}
+
+	res, err := ii.ApproxLabelNameCardinality(nil)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, uint64(3), res["env"])
+	require.InDelta(t, 5000, float64(res["pod"]), 5000*0.05)
+
+	_, err = ii.ApproxLabelNameCardinality(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_ConstantLabels(t *testing.T) {
+	ii := NewWithShards(8)
+	constants, err := ii.ConstantLabels(nil)
+	require.NoError(t, err)
+	require.Empty(t, constants)
+
+	for i := 0; i < 50; i++ {
+		lbs := phlaremodel.LabelsFromStrings("cluster", "eu", "env", "prod", "pod", fmt.Sprint("pod-", i))
+		if i == 42 {
+			// a single other value in one shard
+			lbs = phlaremodel.LabelsFromStrings("cluster", "eu", "env", "dev", "pod", fmt.Sprint("pod-", i))
+		}
+		if i%10 == 0 {
+			lbs = append(lbs, &commonv1.LabelPair{Name: "team", Value: "a"})
+		}
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+	ii.Add(phlaremodel.LabelsFromStrings("region", "west", "pod", "other"), 100)
+
+	constants, err = ii.ConstantLabels(nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"cluster": "eu", "team": "a", "region": "west"}, constants)
+	b, err := json.Marshal(constants)
+	require.NoError(t, err)
+	require.Equal(t, `{"cluster":"eu","region":"west","team":"a"}`, string(b))
+
+	// env varies within the shard of the dev series
+	lbs := phlaremodel.LabelsFromStrings("cluster", "eu", "env", "dev", "pod", "pod-42")
+	s := ii.ShardForLabels(lbs)
+	constants, err = ii.ConstantLabels(&shard.Annotation{Shard: int(s), Of: 8})
+	require.NoError(t, err)
+	require.Equal(t, "eu", constants["cluster"])
+	require.NotContains(t, constants, "env")
+	require.NotContains(t, constants, "pod")
+
+	_, err = ii.ConstantLabels(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LabelNamesSortedByCardinality(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 100; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint(i % 3)},
+			{Name: "pod", Value: fmt.Sprint(i)},
+			{Name: "region", Value: fmt.Sprint(i % 2)},
+			{Name: "zone", Value: fmt.Sprint(i % 3)},
+		}, model.Fingerprint(i))
+	}
+
+	names, err := ii.LabelNamesSortedByCardinality(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod", "env", "zone", "region"}, names)
+
+	// counts are exact: a has one value less than b though both get the
+	// same estimate, and values spread over shards are counted once
+	ii = NewWithShards(16)
+	for i := 0; i < 2*1182; i++ {
+		lbs := []*commonv1.LabelPair{{Name: "b", Value: fmt.Sprint("b-", i%1182)}}
+		if i%1182 < 1181 {
+			lbs = append([]*commonv1.LabelPair{{Name: "a", Value: fmt.Sprint("a-", i%1182)}}, lbs...)
+		}
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+	approx, err := ii.ApproxLabelNameCardinality(nil)
+	require.NoError(t, err)
+	require.Equal(t, approx["a"], approx["b"])
+	names, err = ii.LabelNamesSortedByCardinality(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "a"}, names)
+
+	_, err = ii.LabelNamesSortedByCardinality(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_PlanLookup(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 200; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%4)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+			{Name: "svc", Value: fmt.Sprint("svc-", i%10)},
+		}, model.Fingerprint(i))
+	}
+
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "env", "env-.*"),
+		labels.MustNewMatcher(labels.MatchEqual, "svc", "svc-3"),
+		labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-13"),
+	}
+	shards, planned := planLookup(ii.shards, matchers)
+	require.Len(t, shards, 1)
+	require.Equal(t, "pod", planned[0].Name)
+	require.Len(t, planned, 3)
+	require.Equal(t, "env", matchers[0].Name, "input matchers must not be modified")
+
+	shards, _ = planLookup(ii.shards, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-unknown"),
+	})
+	require.Empty(t, shards)
+
+	regexOnly := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")}
+	shards, planned = planLookup(ii.shards, regexOnly)
+	require.Len(t, shards, 16)
+	require.Equal(t, regexOnly, planned)
+
+	for _, ms := range [][]*labels.Matcher{
+		matchers,
+		regexOnly,
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1"), labels.MustNewMatcher(labels.MatchNotEqual, "svc", "svc-1")},
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1"), labels.MustNewMatcher(labels.MatchEqual, "svc", "svc-2")},
+	} {
+		var expected []model.Fingerprint
+		for _, s := range ii.shards {
+			expected = append(expected, s.lookup(ms)...)
+		}
+		sort.Sort(model.Fingerprints(expected))
+		ids, err := ii.Lookup(ms, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, ids, "%v", ms)
+	}
+}
+
+func Test_MatchSeries(t *testing.T) {
+	ii := NewWithShards(8)
+	var all []phlaremodel.Labels
+	for i := 0; i < 20; i++ {
+		lbs := ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%2)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}, model.Fingerprint(i))
+		all = append(all, lbs)
+	}
+
+	res, err := ii.MatchSeries([][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0"), labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")},
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-3")},
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-10")},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []phlaremodel.Labels{all[3], all[10], all[12], all[14], all[16], all[18]}, res)
+
+	res, err = ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "pod", "none")}}, nil)
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	res, err = ii.MatchSeries([][]*labels.Matcher{{}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, all, res)
+}
+
+func Test_FindSetMatches(t *testing.T) {
+	for _, tt := range []struct {
+		pattern  string
+		expected []string
+	}{
+		{"^(?:prod|staging|dev)$", []string{"prod", "staging", "dev"}},
+		{"^(?:[abc])$", []string{"a", "b", "c"}},
+		{"^(?:prod|[ab]|dev)$", []string{"prod", "a", "b", "dev"}},
+		{"^(?:[ab]|[c.])$", []string{"a", "b", "c", "."}},
+		{"^(?:[x]|foo\\.bar)$", []string{"x", "foo.bar"}},
+		// repeated members are returned once, in order of first occurrence
+		{"^(?:[aa])$", []string{"a"}},
+		{"^(?:a|a)$", []string{"a"}},
+		{"^(?:b|[ab]|b)$", []string{"b", "a"}},
+		// unsupported patterns
+		{"^(?:foo[ab])$", nil},
+		{"^(?:[ab]foo)$", nil},
+		{"^(?:[a-c])$", nil},
+		{"^(?:[^ab])$", nil},
+		{"^(?:[])$", nil},
+		{"^(?:[ab)$", nil},
+		{"^(?:[\\d])$", nil},
+		{"^(?:[é])$", nil},
+		{"^(?:a.*)$", nil},
+		{"[abc]", nil},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			require.Equal(t, tt.expected, FindSetMatches(tt.pattern))
+		})
+	}
+}
+
+func Test_Exists(t *testing.T) {
+	ii := NewWithShards(16)
+	lbs := []*commonv1.LabelPair{{Name: "foo", Value: "bar"}}
+	require.False(t, ii.Exists(1))
+	ii.Add(lbs, 1)
+	require.True(t, ii.Exists(1))
+	require.False(t, ii.Exists(2))
+	ii.Delete(lbs, 1)
+	require.False(t, ii.Exists(1))
+}
+
+func Test_LabelValuesWithCounts(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%3), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+
+	counts, err := ii.LabelValuesWithCounts("env", nil)
+	require.NoError(t, err)
+	require.Equal(t, []LabelValueCount{
+		{Value: "env-0", Count: 34},
+		{Value: "env-1", Count: 33},
+		{Value: "env-2", Count: 33},
+	}, counts)
+
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "env-0", "pod", "pod-0"), 0)
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "env-0", "pod", "pod-3"), 3)
+	counts, err = ii.LabelValuesWithCounts("env", nil)
+	require.NoError(t, err)
+	SortLabelValueCountsByCount(counts)
+	require.Equal(t, []LabelValueCount{
+		{Value: "env-1", Count: 33},
+		{Value: "env-2", Count: 33},
+		{Value: "env-0", Count: 32},
+	}, counts)
+
+	var total uint64
+	for i := 0; i < 4; i++ {
+		counts, err := ii.LabelValuesWithCounts("env", &shard.Annotation{Shard: i, Of: 4})
+		require.NoError(t, err)
+		for _, c := range counts {
+			total += c.Count
+		}
+	}
+	require.Equal(t, uint64(98), total)
+
+	counts, err = ii.LabelValuesWithCounts("unknown", nil)
+	require.NoError(t, err)
+	require.Empty(t, counts)
+	_, err = ii.LabelValuesWithCounts("env", &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LabelValuesMulti(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 30; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%3)},
+			{Name: "pod", Value: fmt.Sprintf("pod-%02d", i)},
+		}, model.Fingerprint(i))
+	}
+
+	res, err := ii.LabelValuesMulti([]string{"env", "pod", "missing"}, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	for _, name := range []string{"env", "pod"} {
+		expected, err := ii.LabelValues(name, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, res[name])
+	}
+	require.NotNil(t, res["missing"])
+	require.Empty(t, res["missing"])
+}
+
+func Test_LabelValuesUnion(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 20; i++ {
+		// hosts renamed to hostname from the 10th series, some overlapping
+		name := "host"
+		if i >= 10 {
+			name = "hostname"
+		}
+		ii.Add(phlaremodel.LabelsFromStrings(name, fmt.Sprintf("host-%02d", i%14), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+
+	values, err := ii.LabelValuesUnion([]string{"host", "hostname", "missing"}, nil)
+	require.NoError(t, err)
+	expected := make([]string, 0, 14)
+	for i := 0; i < 14; i++ {
+		expected = append(expected, fmt.Sprintf("host-%02d", i))
+	}
+	require.Equal(t, expected, values)
+
+	values, err = ii.LabelValuesUnion([]string{"host"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected[:10], values)
+
+	values, err = ii.LabelValuesUnion(nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, values)
+
+	_, err = ii.LabelValuesUnion([]string{"host"}, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_MaxLookupResults(t *testing.T) {
+	ii := NewWithOptions(16, IndexOptions{MaxLookupResults: 10})
+	for i := 0; i < 20; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%2)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}, model.Fingerprint(i))
+	}
+
+	ids, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")}, nil)
+	require.NoError(t, err)
+	require.Len(t, ids, 10)
+
+	for _, matchers := range [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")},
+	} {
+		_, err = ii.Lookup(matchers, nil)
+		var limitErr *LimitExceededError
+		require.ErrorAs(t, err, &limitErr)
+		require.Equal(t, 10, limitErr.Limit)
+		require.Greater(t, limitErr.Count, 10)
+		require.LessOrEqual(t, limitErr.Count, 20)
+	}
+}
+
+func Test_AddToShard(t *testing.T) {
+	ii := NewWithShards(4)
+	lbs := []*commonv1.LabelPair{{Name: "foo", Value: "bar"}}
+	target := (labelsSeriesIDHash(lbs) + 1) % 4
+
+	interned, err := ii.AddToShard(target, lbs, 1)
+	require.NoError(t, err)
+	require.Equal(t, phlaremodel.Labels(lbs), interned)
+	require.Equal(t, []model.Fingerprint{1}, []model.Fingerprint(ii.shards[target].allFPs()))
+
+	ids, err := ii.Lookup(nil, &shard.Annotation{Shard: int(target), Of: 4})
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, ids)
+
+	_, err = ii.AddToShard(4, lbs, 2)
+	require.ErrorIs(t, err, ErrShardOutOfRange)
+}
+
+func Test_PostingsForLabel(t *testing.T) {
+	ii := NewWithShards(16)
+	expected := map[string][]model.Fingerprint{}
+	for i := 0; i < 40; i++ {
+		env := fmt.Sprint("env-", i%3)
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: env},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}, model.Fingerprint(i))
+		expected[env] = append(expected[env], model.Fingerprint(i))
+	}
+
+	res, err := ii.PostingsForLabel("env", nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, res)
+
+	// mutating the result must not affect the index.
+	res["env-0"][0] = 1000
+	ids, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected["env-0"], ids)
+
+	res, err = ii.PostingsForLabel("missing", nil)
+	require.NoError(t, err)
+	require.Empty(t, res)
+}
+
+func Test_ShardsForMatchers(t *testing.T) {
+	ii := NewWithShards(8)
+	expected := map[string]uint32{}
+	for i := 0; i < 20; i++ {
+		lbs := []*commonv1.LabelPair{
+			{Name: "env", Value: "prod"},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}
+		ii.Add(lbs, model.Fingerprint(i))
+		expected[lbs[1].Value] = labelsSeriesIDHash(lbs) % 8
+	}
+
+	res, err := ii.ShardsForMatchers([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7"),
+		labels.MustNewMatcher(labels.MatchRegexp, "env", "p.*"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{expected["pod-7"]}, res)
+
+	res, err = ii.ShardsForMatchers([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "none")})
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	res, err = ii.ShardsForMatchers([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-7")})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7}, res)
+
+	_, err = ii.ShardsForMatchers([]*labels.Matcher{nil})
+	require.ErrorIs(t, err, ErrInvalidMatcher)
+}
+
+func Test_LabelNamesCache(t *testing.T) {
+	ii := NewWithShards(2)
+	a := []*commonv1.LabelPair{{Name: "foo", Value: "1"}, {Name: "zone", Value: "a"}}
+	b := []*commonv1.LabelPair{{Name: "bar", Value: "1"}, {Name: "foo", Value: "2"}}
+	c := []*commonv1.LabelPair{{Name: "bar", Value: "2"}, {Name: "foo", Value: "1"}, {Name: "zone", Value: "b"}}
+
+	requireNames := func(expected ...string) {
+		t.Helper()
+		names, err := ii.LabelNames(nil)
+		require.NoError(t, err)
+		if len(expected) == 0 {
+			require.Empty(t, names)
+		} else {
+			require.Equal(t, expected, names)
+		}
+		require.NoError(t, ii.Validate())
+	}
+
+	ii.Add(a, 1)
+	requireNames("foo", "zone")
+	ii.Add(b, 2)
+	ii.Add(c, 3)
+	requireNames("bar", "foo", "zone")
+
+	// the returned names must not alias the cache.
+	names, err := ii.LabelNames(&shard.Annotation{Shard: 0, Of: 2})
+	require.NoError(t, err)
+	if len(names) > 0 {
+		names[0] = "mutated"
+	}
+	requireNames("bar", "foo", "zone")
+
+	ii.Delete(c, 3)
+	requireNames("bar", "foo", "zone")
+	ii.Delete(a, 1)
+	requireNames("bar", "foo")
+	ii.Delete(b, 2)
+	requireNames()
+}
+
+func Test_LabelValueCountFor(t *testing.T) {
+	ii := NewWithShards(16)
+	for i := 0; i < 60; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "pod", Value: fmt.Sprint("pod-", i%12)},
+			{Name: "service", Value: fmt.Sprint("svc-", i%3)},
+			{Name: "i", Value: fmt.Sprint(i)},
+		}, model.Fingerprint(i))
+	}
+
+	for _, tt := range []struct {
+		matchers []*labels.Matcher
+		expected uint64
+	}{
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "service", "svc-1")}, 4},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "service", "svc-(1|2)")}, 8},
+		{nil, 12},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "service", "none")}, 0},
+	} {
+		count, err := ii.LabelValueCountFor("pod", tt.matchers, nil)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, count, "%v", tt.matchers)
+	}
+
+	count, err := ii.LabelValueCountFor("missing", nil, nil)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func Test_SetMatchesCache(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{SetMatchesCacheSize: 2})
+	for i := 0; i < 10; i++ {
+		ii.Add([]*commonv1.LabelPair{{Name: "foo", Value: fmt.Sprint(i)}}, model.Fingerprint(i))
+	}
+	cache := ii.shards[0].setMatches
+	require.NotNil(t, cache)
+
+	for _, tt := range []struct {
+		value    string
+		expected []model.Fingerprint
+	}{
+		{"^(?:1|2|3)$", []model.Fingerprint{1, 2, 3}},
+		{"^(?:4|5)$", []model.Fingerprint{4, 5}},
+		{"^(?:[7-9])$", []model.Fingerprint{7, 8, 9}},
+		// served from the cache
+		{"^(?:1|2|3)$", []model.Fingerprint{1, 2, 3}},
+	} {
+		matcher, err := labels.NewMatcher(labels.MatchRegexp, "foo", tt.value)
+		require.NoError(t, err)
+		fps, err := ii.Lookup([]*labels.Matcher{matcher}, nil)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, fps, tt.value)
+	}
+
+	require.Equal(t, 2, cache.cache.Len())
+	set, ok := cache.cache.Get("^(?:1|2|3)$")
+	require.True(t, ok)
+	require.Equal(t, []string{"1", "2", "3"}, set)
+	set, ok = cache.cache.Get("^(?:[7-9])$")
+	require.True(t, ok)
+	require.Nil(t, set)
+}
+
+func Test_LabelValuesPage(t *testing.T) {
+	for _, sorted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sorted=%v", sorted), func(t *testing.T) {
+			ii := NewWithOptions(8, IndexOptions{SortedValues: sorted})
+			expected := make([]string, 0, 25)
+			for i := 0; i < 50; i++ {
+				// every value is carried by two series, likely in distinct shards
+				value := fmt.Sprintf("v%02d", i/2)
+				if i%2 == 0 {
+					expected = append(expected, value)
+				}
+				ii.Add(phlaremodel.LabelsFromStrings("foo", value, "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+			}
+
+			var paged []string
+			var token string
+			for pages := 1; ; pages++ {
+				values, next, err := ii.LabelValuesPage("foo", nil, token, 10)
+				require.NoError(t, err)
+				paged = append(paged, values...)
+				if next == "" {
+					require.Equal(t, 3, pages)
+					require.Len(t, values, 5)
+					break
+				}
+				require.Len(t, values, 10)
+				require.Equal(t, values[len(values)-1], next)
+				token = next
+			}
+			require.Equal(t, expected, paged)
+
+			// a last page filled exactly has no next page
+			values, next, err := ii.LabelValuesPage("foo", nil, "v14", 10)
+			require.NoError(t, err)
+			require.Equal(t, expected[15:], values)
+			require.Empty(t, next)
+
+			values, next, err = ii.LabelValuesPage("foo", nil, "", 0)
+			require.NoError(t, err)
+			require.Equal(t, expected, values)
+			require.Empty(t, next)
+
+			values, next, err = ii.LabelValuesPage("foo", nil, "v24", 10)
+			require.NoError(t, err)
+			require.Empty(t, values)
+			require.Empty(t, next)
+
+			values, _, err = ii.LabelValuesPage("unknown", nil, "", 10)
+			require.NoError(t, err)
+			require.Empty(t, values)
+
+			_, _, err = ii.LabelValuesPage("foo", &shard.Annotation{Shard: 0, Of: 3}, "", 10)
+			require.ErrorIs(t, err, ErrInvalidShardQuery)
+		})
+	}
+}
+
+func Test_SortedValues(t *testing.T) {
+	for _, sorted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sorted=%v", sorted), func(t *testing.T) {
+			ii := NewWithOptions(4, IndexOptions{SortedValues: sorted, TrackLastWrite: true})
+			for i, v := range []string{"1", "2.5", "10", "-3", "abc", "abd", "ab", "b", "NaN", "1e1"} {
+				ii.Add([]*commonv1.LabelPair{{Name: "foo", Value: v}}, model.Fingerprint(i))
+			}
+
+			values, err := ii.LabelValuesWithPrefix("foo", "ab", nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"ab", "abc", "abd"}, values)
+			values, err = ii.LabelValuesWithPrefix("foo", "", nil)
+			require.NoError(t, err)
+			require.Len(t, values, 10)
+			values, err = ii.LabelValuesWithPrefix("foo", "c", nil)
+			require.NoError(t, err)
+			require.Empty(t, values)
+
+			fps, err := ii.LookupNumericRange("foo", 1, 10, nil)
+			require.NoError(t, err)
+			// 1, 2.5, 10 and 1e1
+			require.Equal(t, []model.Fingerprint{0, 1, 2, 9}, fps)
+
+			ii.Delete(phlaremodel.LabelsFromStrings("foo", "10"), 2)
+			ii.Delete(phlaremodel.LabelsFromStrings("foo", "abc"), 4)
+			require.NoError(t, ii.Validate())
+
+			values, err = ii.LabelValuesWithPrefix("foo", "ab", nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"ab", "abd"}, values)
+			fps, err = ii.LookupNumericRange("foo", 1, 10, nil)
+			require.NoError(t, err)
+			require.Equal(t, []model.Fingerprint{0, 1, 9}, fps)
+
+			ii.PurgeOlderThan(time.Now().Add(time.Hour))
+			require.NoError(t, ii.Validate())
+			values, err = ii.LabelValuesWithPrefix("foo", "", nil)
+			require.NoError(t, err)
+			require.Empty(t, values)
+		})
+	}
+}
+
+func Test_CacheLabelValues(t *testing.T) {
+	ii := NewWithOptions(1, IndexOptions{CacheLabelValues: true})
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "b"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "a"), 2)
+
+	values, err := ii.LabelValues("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, values)
+	// the result is a copy of the cached values
+	values[0] = "z"
+
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "c"), 3)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "a"), 4)
+	values, err = ii.LabelValues("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, values)
+
+	// deleting one of the series of a value keeps it
+	ii.Delete(phlaremodel.LabelsFromStrings("foo", "a"), 2)
+	values, err = ii.LabelValues("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, values)
+
+	ii.Delete(phlaremodel.LabelsFromStrings("foo", "a"), 4)
+	values, err = ii.LabelValues("foo", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, values)
+}
+
+func BenchmarkValueScans(b *testing.B) {
+	for _, sorted := range []bool{false, true} {
+		ii := NewWithOptions(DefaultIndexShards, IndexOptions{SortedValues: sorted})
+		for i := 0; i < 100000; i++ {
+			ii.Add([]*commonv1.LabelPair{
+				{Name: "pod", Value: fmt.Sprintf("pod-%d", i)},
+				{Name: "port", Value: fmt.Sprint(i)},
+			}, model.Fingerprint(i))
+		}
+
+		b.Run(fmt.Sprintf("prefix/sorted=%v", sorted), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				_, _ = ii.LabelValuesWithPrefix("pod", "pod-4242", nil)
+			}
+		})
+		b.Run(fmt.Sprintf("range/sorted=%v", sorted), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				_, _ = ii.LookupNumericRange("port", 4200, 4300, nil)
+			}
+		})
+		b.Run(fmt.Sprintf("add/sorted=%v", sorted), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				ii.Add([]*commonv1.LabelPair{{Name: "port", Value: fmt.Sprint(100000 + n)}}, model.Fingerprint(100000+n))
+			}
+		})
+	}
+}
+
+func Test_ShardForLabels(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 32; i++ {
+		lbs := phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i))
+		s := ii.ShardForLabels(lbs)
+		require.Equal(t, labelsSeriesIDHash(lbs)%8, s)
+		require.False(t, ii.shards[s].exists(model.Fingerprint(i)))
+
+		ii.Add(lbs, model.Fingerprint(i))
+		require.True(t, ii.shards[s].exists(model.Fingerprint(i)))
+	}
+}
+
+func Test_PostingsSimilarity(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "a", Value: fmt.Sprint(i % 2)},
+			{Name: "b", Value: fmt.Sprint(i % 4)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}, model.Fingerprint(i))
+	}
+
+	for _, tt := range []struct {
+		nameA, valueA, nameB, valueB string
+		expected                     float64
+	}{
+		{"a", "0", "a", "0", 1},
+		{"a", "0", "a", "1", 0},
+		// b=0 is half of a=0
+		{"a", "0", "b", "0", 0.5},
+		// b=3 is half of a=1 too
+		{"a", "1", "b", "3", 0.5},
+		{"a", "0", "b", "1", 0},
+		{"a", "0", "missing", "x", 0},
+		{"missing", "x", "missing", "x", 0},
+	} {
+		similarity, err := ii.PostingsSimilarity(tt.nameA, tt.valueA, tt.nameB, tt.valueB, nil)
+		require.NoError(t, err)
+		require.InDelta(t, tt.expected, similarity, 1e-9, "%+v", tt)
+	}
+
+	_, err := ii.PostingsSimilarity("a", "0", "b", "0", &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LookupExcludeShards(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i))
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")}
+
+	all, err := ii.LookupWithOptions(matchers, LookupOptions{})
+	require.NoError(t, err)
+	expected, err := ii.Lookup(matchers, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, all)
+
+	var kept [][]model.Fingerprint
+	for i := uint32(0); i < 8; i += 2 {
+		fps, err := ii.LookupWithOptions(matchers, LookupOptions{Shard: &shard.Annotation{Shard: int(i), Of: 8}})
+		require.NoError(t, err)
+		kept = append(kept, fps)
+	}
+	fps, err := ii.LookupWithOptions(matchers, LookupOptions{ExcludeShards: []uint32{1, 3, 5, 7, 3}})
+	require.NoError(t, err)
+	require.Equal(t, mergeFingerprintSlices(kept), fps)
+	require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] < fps[j] }))
+
+	// shards 1 and 3 of 2 are excluded, leaving shards 5 and 7
+	fps, err = ii.LookupWithOptions(nil, LookupOptions{Shard: &shard.Annotation{Shard: 1, Of: 2}, ExcludeShards: []uint32{1, 3}})
+	require.NoError(t, err)
+	for _, fp := range fps {
+		require.True(t, ii.shards[5].exists(fp) || ii.shards[7].exists(fp))
+	}
+	// the shards of the index are left untouched
+	for i, s := range ii.shards {
+		require.Equal(t, uint32(i), s.shard)
+	}
+
+	_, err = ii.LookupWithOptions(matchers, LookupOptions{ExcludeShards: []uint32{8}})
+	require.ErrorIs(t, err, ErrShardOutOfRange)
+}
+
+func Test_LookupWithBudget(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	for _, matchers := range [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-.*")},
+	} {
+		expected, err := ii.Lookup(matchers, nil)
+		require.NoError(t, err)
+		require.Len(t, expected, 100)
+
+		for _, budget := range []time.Duration{0, time.Hour} {
+			fps, truncated, err := ii.LookupWithBudget(matchers, nil, budget)
+			require.NoError(t, err)
+			require.False(t, truncated)
+			require.Equal(t, expected, fps)
+		}
+
+		// exhausted after the first shard
+		fps, truncated, err := ii.LookupWithBudget(matchers, nil, time.Nanosecond)
+		require.NoError(t, err)
+		require.True(t, truncated)
+		first, err := ii.Lookup(matchers, &shard.Annotation{Shard: 0, Of: 8})
+		require.NoError(t, err)
+		require.Equal(t, first, fps)
+	}
+
+	// a single shard is never truncated
+	fps, truncated, err := ii.LookupWithBudget([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7")}, nil, time.Nanosecond)
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Equal(t, []model.Fingerprint{7}, fps)
+
+	_, _, err = ii.LookupWithBudget(nil, &shard.Annotation{Shard: 0, Of: 3}, time.Hour)
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LookupDetailed(t *testing.T) {
+	ii := NewWithShards(8)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), 1)
+
+	result, err := ii.LookupDetailed(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, LookupResult{Fingerprints: []model.Fingerprint{1}, ShardsQueried: 8, ShardsWithResults: 1}, result)
+
+	s := ii.ShardForLabels(phlaremodel.LabelsFromStrings("foo", "bar"))
+	result, err = ii.LookupDetailed(
+		[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar")},
+		&shard.Annotation{Shard: int(s) % 2, Of: 2},
+	)
+	require.NoError(t, err)
+	require.Equal(t, LookupResult{Fingerprints: []model.Fingerprint{1}, ShardsQueried: 4, ShardsWithResults: 1}, result)
+
+	result, err = ii.LookupDetailed(
+		[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "baz")},
+		&shard.Annotation{Shard: 0, Of: 4},
+	)
+	require.NoError(t, err)
+	require.Equal(t, LookupResult{ShardsQueried: 2}, result)
+
+	_, err = ii.LookupDetailed(nil, &shard.Annotation{Shard: 0, Of: 16})
+	require.ErrorIs(t, err, ErrShardTooLarge)
+}
+
+func Test_MaxRegexpProgramSize(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{MaxRegexpProgramSize: 100})
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), 1)
+
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "foo", "ba.")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+
+	tooComplex := labels.MustNewMatcher(labels.MatchNotRegexp, "foo", "(a|b){50}")
+	_, err = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar"), tooComplex}, nil)
+	require.ErrorIs(t, err, ErrRegexpTooComplex)
+	require.ErrorIs(t, err, ErrInvalidMatcher)
+	_, err = ii.MatchSeries([][]*labels.Matcher{{tooComplex}}, nil)
+	require.ErrorIs(t, err, ErrRegexpTooComplex)
+
+	// the default limit lets it through, as does disabling the check
+	for _, max := range []int{0, -1} {
+		ii := NewWithOptions(4, IndexOptions{MaxRegexpProgramSize: max})
+		ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), 1)
+		fps, err := ii.Lookup([]*labels.Matcher{tooComplex}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []model.Fingerprint{1}, fps)
+	}
+}
+
+func Test_LabelValuesSorted(t *testing.T) {
+	ii := NewWithShards(4)
+	for i, version := range []string{"v1.9", "v1.10", "v1.2", "v2.0", "v1.10", "v01.2"} {
+		ii.Add(phlaremodel.LabelsFromStrings("version", version, "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	parse := func(v string) (major, minor int) {
+		_, err := fmt.Sscanf(v, "v%d.%d", &major, &minor)
+		require.NoError(t, err)
+		return major, minor
+	}
+	semver := func(a, b string) bool {
+		amajor, aminor := parse(a)
+		bmajor, bminor := parse(b)
+		if amajor != bmajor {
+			return amajor < bmajor
+		}
+		return aminor < bminor
+	}
+
+	values, err := ii.LabelValuesSorted("version", nil, semver)
+	require.NoError(t, err)
+	// v01.2 and v1.2 are equivalent and remain in lexicographic order
+	require.Equal(t, []string{"v01.2", "v1.2", "v1.9", "v1.10", "v2.0"}, values)
+
+	values, err = ii.LabelValues("version", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"v01.2", "v1.10", "v1.2", "v1.9", "v2.0"}, values)
+
+	_, err = ii.LabelValuesSorted("version", &shard.Annotation{Shard: 0, Of: 3}, semver)
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_ProfileTypes(t *testing.T) {
+	ii := NewWithShards(4)
+	types, err := ii.ProfileTypes(nil)
+	require.NoError(t, err)
+	require.Empty(t, types)
+
+	for i, profileType := range []string{"memory", "cpu", "memory", "goroutine", "cpu"} {
+		ii.Add(phlaremodel.LabelsFromStrings(phlaremodel.LabelNameProfileType, profileType, "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	ii.Add(phlaremodel.LabelsFromStrings("pod", "other"), model.Fingerprint(10))
+
+	types, err = ii.ProfileTypes(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cpu", "goroutine", "memory"}, types)
+
+	_, err = ii.ProfileTypes(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LookupNonNil(t *testing.T) {
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("foo", "bar"), model.Fingerprint(1))
+
+	fps, err := ii.LookupNonNil([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "baz")}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, fps)
+	require.Empty(t, fps)
+
+	fps, err = ii.LookupNonNil([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "foo", "bar")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+
+	fps, err = ii.LookupNonNil(nil, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+	require.Nil(t, fps)
+}
+
+func Test_LookupByMetricName(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		lbs := phlaremodel.LabelsFromStrings(labels.MetricName, fmt.Sprint("metric-", i%3), "pod", fmt.Sprint("pod-", i))
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+
+	extra := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")}
+	expected, err := ii.Lookup(append([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "metric-1")}, extra...), nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, expected)
+	fps, err := ii.LookupByMetricName("metric-1", extra, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, fps)
+
+	fps, err = ii.LookupByMetricName("metric-2", nil, &shard.Annotation{Shard: 0, Of: 1})
+	require.NoError(t, err)
+	require.Len(t, fps, 33)
+	require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] < fps[j] }))
+
+	fps, err = ii.LookupByMetricName("unknown", nil, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+
+	_, err = ii.LookupByMetricName("metric-1", []*labels.Matcher{nil}, nil)
+	require.ErrorIs(t, err, ErrInvalidMatcher)
+}
+
+func Test_LookupGrouped(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i))
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+
+	for _, tt := range []struct {
+		matchers []*labels.Matcher
+		shard    *shard.Annotation
+	}{
+		{nil, nil},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")}, nil},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")}, &shard.Annotation{Shard: 1, Of: 2}},
+	} {
+		groups, err := ii.LookupGrouped(tt.matchers, tt.shard)
+		require.NoError(t, err)
+		expected, err := ii.Lookup(tt.matchers, tt.shard)
+		require.NoError(t, err)
+
+		var all [][]model.Fingerprint
+		for s, fps := range groups {
+			require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] < fps[j] }))
+			for _, fp := range fps {
+				require.True(t, ii.shards[s].exists(fp))
+			}
+			if tt.shard != nil {
+				require.Equal(t, tt.shard.Shard, int(s)%tt.shard.Of)
+			}
+			all = append(all, fps)
+		}
+		require.Equal(t, expected, mergeFingerprintSlices(all))
+	}
+
+	groups, err := ii.LookupGrouped([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "none")}, nil)
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
+
+func Test_LabelsHasherPooling(t *testing.T) {
+	h := newLabelsHasher(100, 2000)
+	long := phlaremodel.LabelsFromStrings("foo", strings.Repeat("x", 10000))
+	require.Equal(t, labelsSeriesIDHash(long), h.hash(long))
+
+	// the grown buffer must not have been recycled
+	buf := h.buffers.Get().(*bytes.Buffer)
+	require.LessOrEqual(t, buf.Cap(), 2000)
+
+	ii := NewWithOptions(8, IndexOptions{HashBufferSize: 10, MaxPooledHashBufferSize: 20})
+	require.Equal(t, labelsSeriesIDHash(long)%8, ii.ShardForLabels(long))
+}
+
+// BenchmarkLabelsHashLongLabels hashes label sets of increasing sizes,
+// where recycling grown buffers makes the pool retain the largest ones.
+func BenchmarkLabelsHashLongLabels(b *testing.B) {
+	series := make([]phlaremodel.Labels, 100)
+	for i := range series {
+		series[i] = phlaremodel.LabelsFromStrings("foo", strings.Repeat("x", i*1000))
+	}
+	for _, maxPooledSize := range []int{defaultMaxPooledHashBufferSize, math.MaxInt} {
+		b.Run(fmt.Sprintf("max_pooled=%d", maxPooledSize), func(b *testing.B) {
+			h := newLabelsHasher(0, maxPooledSize)
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				h.hash(series[n%len(series)])
+			}
+		})
+	}
+}
+
+func Test_LabelPairs(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 20; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i%3)), model.Fingerprint(i))
+	}
+
+	pairs, err := ii.LabelPairs(nil)
+	require.NoError(t, err)
+	require.Equal(t, []LabelPair{
+		{"env", "env-0"}, {"env", "env-1"},
+		{"pod", "pod-0"}, {"pod", "pod-1"}, {"pod", "pod-2"},
+	}, pairs)
+
+	var visited []LabelPair
+	require.NoError(t, ii.VisitLabelPairs(nil, func(pair LabelPair) bool {
+		visited = append(visited, pair)
+		return len(visited) < 3
+	}))
+	require.Equal(t, pairs[:3], visited)
+
+	pairs, err = NewWithShards(8).LabelPairs(nil)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+	_, err = ii.LabelPairs(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_CanonicalizeLabels(t *testing.T) {
+	sorted := phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "prod", "pod", "a")
+	require.Equal(t, sorted, CanonicalizeLabels(sorted))
+
+	unsorted := phlaremodel.Labels{
+		{Name: "pod", Value: "a"},
+		{Name: "empty", Value: ""},
+		{Name: "env", Value: "prod"},
+		{Name: "__name__", Value: "cpu"},
+	}
+	require.Equal(t, sorted, CanonicalizeLabels(unsorted))
+	// the input is left untouched
+	require.Equal(t, "pod", unsorted[0].Name)
+	require.Len(t, unsorted, 4)
+
+	// the hashing contract
+	hash := labelsSeriesIDHash(sorted)
+	require.Equal(t, hash, labelsSeriesIDHash(unsorted))
+	withoutName := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a")
+	require.Equal(t, labelsSeriesIDHash(withoutName), labelsSeriesIDHash(phlaremodel.Labels{
+		{Name: "pod", Value: "a"},
+		{Name: "__name__", Value: ""},
+		{Name: "env", Value: "prod"},
+	}))
+	require.NotEqual(t, hash, labelsSeriesIDHash(withoutName))
+
+	// series added with labels in any order are found and deleted
+	ii := NewWithShards(DefaultIndexShards)
+	ii.Add(unsorted, 1)
+	ii.Delete(phlaremodel.Labels{unsorted[3], unsorted[2], unsorted[1], unsorted[0]}, 1)
+	require.False(t, ii.Exists(1))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_MetricNameAsLabel(t *testing.T) {
+	var buf bytes.Buffer
+	lbs := phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "prod", "pod", "a")
+	labelSetString(&buf, lbs)
+	require.Equal(t, `{__name__="cpu", env="prod", pod="a"}`, buf.String())
+	buf.Reset()
+	labelsString(&buf, lbs)
+	require.Equal(t, `cpu{env="prod", pod="a"}`, buf.String())
+
+	ii := NewWithOptions(32, IndexOptions{MetricNameAsLabel: true})
+	// series without a metric name are routed as by default
+	withoutName := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a")
+	require.Equal(t, labelsSeriesIDHash(withoutName)%32, ii.ShardForLabels(withoutName))
+
+	var moved int
+	for i := 0; i < 100; i++ {
+		lbs := phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", fmt.Sprint("pod-", i))
+		if ii.ShardForLabels(lbs) != labelsSeriesIDHash(lbs)%32 {
+			moved++
+		}
+		ii.Add(lbs, model.Fingerprint(i))
+	}
+	require.NotZero(t, moved)
+
+	lbs = phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", "pod-7")
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7")}, &shard.Annotation{Shard: int(ii.ShardForLabels(lbs)), Of: 32})
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{7}, fps)
+	ii.Delete(lbs, 7)
+	require.False(t, ii.Exists(7))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_DuplicateLabelNames(t *testing.T) {
+	dup := phlaremodel.Labels{
+		{Name: "pod", Value: "a"},
+		{Name: "env", Value: "dev"},
+		{Name: "pod", Value: "b"},
+	}
+	expected := phlaremodel.LabelsFromStrings("env", "dev", "pod", "b")
+	require.Equal(t, expected, CanonicalizeLabels(dup))
+	require.Equal(t, labelsSeriesIDHash(expected), labelsSeriesIDHash(dup))
+
+	ii := NewWithShards(DefaultIndexShards)
+	_, err := ii.AddStrict(dup, 1)
+	require.ErrorIs(t, err, ErrDuplicateLabelName)
+	require.False(t, ii.Exists(1))
+
+	// the last value is kept, and the series is reachable by normalized queries
+	require.Equal(t, expected, ii.Add(dup, 1))
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "b")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+	fps, err = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "a")}, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+	series, err := ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "env", "dev")}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []phlaremodel.Labels{expected}, series)
+	// the input is left untouched
+	require.Equal(t, "a", dup[0].Value)
+
+	ii.Delete(dup, 1)
+	require.False(t, ii.Exists(1))
+	require.NoError(t, ii.Validate())
+
+	stored, err := ii.AddStrict(expected, 2)
+	require.NoError(t, err)
+	require.Equal(t, expected, stored)
+
+	// as well as when bypassing the routing
+	stored, err = ii.AddToShard(0, dup, 3)
+	require.NoError(t, err)
+	require.Equal(t, expected, stored)
+	require.Equal(t, expected, ii.shards[0].series[3])
+	fps, err = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "a")}, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+	require.Equal(t, "a", dup[0].Value)
+	require.NoError(t, ii.Validate())
+	require.Empty(t, ii.SelfCheck())
+}
+
+func Test_FingerprintBuckets(t *testing.T) {
+	ii := NewWithShards(4)
+	for i, fp := range []uint64{0, 1, 1 << 62, 1<<63 | 5, 1<<63 | 1<<62, math.MaxUint64} {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(fp))
+	}
+
+	buckets, err := ii.FingerprintBuckets(1, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]int{0: 3, 1: 3}, buckets)
+
+	buckets, err = ii.FingerprintBuckets(2, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[uint64]int{0: 2, 1: 1, 2: 1, 3: 2}, buckets)
+
+	buckets, err = ii.FingerprintBuckets(64, nil)
+	require.NoError(t, err)
+	require.Len(t, buckets, 6)
+	require.Equal(t, 1, buckets[math.MaxUint64])
+
+	for _, bits := range []int{0, -1, 65} {
+		_, err = ii.FingerprintBuckets(bits, nil)
+		require.ErrorIs(t, err, ErrInvalidBucketBits)
+	}
+	_, err = ii.FingerprintBuckets(8, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_LookupFingerprintRange(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(i*10))
+	}
+
+	fps, err := ii.LookupFingerprintRange(95, 140, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{100, 110, 120, 130, 140}, fps)
+
+	fps, err = ii.LookupFingerprintRange(0, math.MaxUint64, nil)
+	require.NoError(t, err)
+	all, err := ii.Lookup(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, all, fps)
+
+	fps, err = ii.LookupFingerprintRange(1, 9, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+
+	// shards partition the range
+	var parts [][]model.Fingerprint
+	for i := 0; i < 4; i++ {
+		fps, err := ii.LookupFingerprintRange(200, 600, &shard.Annotation{Shard: i, Of: 4})
+		require.NoError(t, err)
+		parts = append(parts, fps)
+	}
+	fps, err = ii.LookupFingerprintRange(200, 600, nil)
+	require.NoError(t, err)
+	require.Len(t, fps, 41)
+	require.Equal(t, fps, mergeFingerprintSlices(parts))
+}
+
+func Test_OnEvict(t *testing.T) {
+	var ii *InvertedIndex
+	evicted := map[model.Fingerprint]phlaremodel.Labels{}
+	ii = NewWithOptions(4, IndexOptions{OnEvict: func(fp model.Fingerprint, lbs phlaremodel.Labels) {
+		// the index can be used from the callback
+		require.False(t, ii.Exists(fp))
+		evicted[fp] = lbs
+	}})
+
+	lbs := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a")
+	ii.Add(lbs, 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "b"), 2)
+
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "c"), 1)
+	require.Empty(t, evicted)
+	ii.Delete(lbs, 1)
+	require.Equal(t, map[model.Fingerprint]phlaremodel.Labels{1: lbs}, evicted)
+
+	// unknown fingerprints are not evicted
+	ii.Delete(lbs, 1)
+	ii.Delete(lbs, 3)
+	require.Len(t, evicted, 1)
+	require.True(t, ii.Exists(2))
+}
+
+func Test_FingerprintRefs(t *testing.T) {
+	var evicted []phlaremodel.Labels
+	ii := NewWithOptions(1, IndexOptions{OnEvict: func(_ model.Fingerprint, lbs phlaremodel.Labels) {
+		evicted = append(evicted, lbs)
+	}})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a", "zone", "z1"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a", "zone", "z1"), 1)
+	require.Equal(t, 3, ii.shards[0].refs[1])
+
+	// a partial delete keeps the fingerprint with its remaining labels
+	ii.Delete(phlaremodel.LabelsFromStrings("pod", "a"), 1)
+	require.True(t, ii.Exists(1))
+	require.Empty(t, evicted)
+	require.NoError(t, ii.Validate())
+	series, err := ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []phlaremodel.Labels{phlaremodel.LabelsFromStrings("env", "prod", "zone", "z1")}, series)
+
+	require.Equal(t, 1, ii.DropLabel("zone"))
+	require.True(t, ii.Exists(1))
+	require.NoError(t, ii.Validate())
+
+	// the last posting evicts it
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 1)
+	require.False(t, ii.Exists(1))
+	require.Equal(t, []phlaremodel.Labels{phlaremodel.LabelsFromStrings("env", "prod")}, evicted)
+	require.Empty(t, ii.shards[0].refs)
+	require.NoError(t, ii.Validate())
+}
+
+func Test_LabelEnricher(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{LabelEnricher: func(lbs phlaremodel.Labels) phlaremodel.Labels {
+		for _, l := range lbs {
+			if l.Name == "namespace" {
+				l.Value = strings.ToUpper(l.Value)
+			}
+		}
+		return append(lbs, &commonv1.LabelPair{Name: "environment", Value: lbs.Get("namespace")})
+	}})
+	stored := ii.Add(phlaremodel.LabelsFromStrings("namespace", "prod", "pod", "a"), 1)
+	expected := phlaremodel.Labels{
+		{Name: "namespace", Value: "PROD"},
+		{Name: "pod", Value: "a"},
+		{Name: "environment", Value: "PROD"},
+	}
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "namespace", "prod")}
+
+	for i := 0; i < 2; i++ {
+		series, err := ii.MatchSeries([][]*labels.Matcher{matchers}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []phlaremodel.Labels{expected}, series)
+	}
+	promSeries, err := ii.SeriesAsPromLabels(matchers, nil)
+	require.NoError(t, err)
+	require.Equal(t, "PROD", promSeries[0].Get("environment"))
+	ch, err := ii.StreamSeries(context.Background(), matchers, nil)
+	require.NoError(t, err)
+	for res := range ch {
+		require.Equal(t, expected, res.Labels)
+	}
+
+	// the stored labels are untouched
+	require.Equal(t, phlaremodel.LabelsFromStrings("namespace", "prod", "pod", "a"), stored)
+	require.NoError(t, ii.Validate())
+}
+
+func Test_Symbols(t *testing.T) {
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "job", "api"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "dev", "job", "env"), 2)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "region", "eu"), 3)
+
+	symbols, err := ii.Symbols(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"api", "dev", "env", "eu", "job", "prod", "region"}, symbols)
+
+	var visited []string
+	require.NoError(t, ii.VisitSymbols(nil, func(symbol string) bool {
+		visited = append(visited, symbol)
+		return len(visited) < 3
+	}))
+	require.Equal(t, symbols[:3], visited)
+
+	empty, err := NewWithShards(2).Symbols(nil)
+	require.NoError(t, err)
+	require.Empty(t, empty)
+
+	_, err = ii.Symbols(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_DeleteFallbackSearch(t *testing.T) {
+	added := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a")
+	// labels drifting from the added ones, routed to another shard
+	var drifted phlaremodel.Labels
+	for i := 0; drifted == nil; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a", "zone", fmt.Sprint(i))
+		if labelsSeriesIDHash(lbs)%8 != labelsSeriesIDHash(added)%8 {
+			drifted = lbs
+		}
+	}
+
+	ii := NewWithShards(8)
+	ii.Add(added, 1)
+	ii.Delete(drifted, 1)
+	require.True(t, ii.Exists(1))
+
+	type mismatch struct {
+		fp            model.Fingerprint
+		routed, found uint32
+	}
+	var mismatches []mismatch
+	var evicted []model.Fingerprint
+	ii = NewWithOptions(8, IndexOptions{
+		DeleteFallbackSearch: true,
+		OnDeleteMismatch: func(fp model.Fingerprint, labels phlaremodel.Labels, routed, found uint32) {
+			require.Equal(t, drifted, labels)
+			mismatches = append(mismatches, mismatch{fp: fp, routed: routed, found: found})
+		},
+		OnEvict: func(fp model.Fingerprint, _ phlaremodel.Labels) {
+			evicted = append(evicted, fp)
+		},
+	})
+	ii.Add(added, 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "b"), 2)
+	ii.Delete(drifted, 1)
+	require.False(t, ii.Exists(1))
+	require.Equal(t, []mismatch{{fp: 1, routed: ii.ShardForLabels(drifted), found: ii.ShardForLabels(added)}}, mismatches)
+	require.Equal(t, []model.Fingerprint{1}, evicted)
+	require.NoError(t, ii.Validate())
+
+	// unknown fingerprints and matching labels aren't mismatches
+	ii.Delete(drifted, 1)
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "b"), 2)
+	require.Len(t, mismatches, 1)
+	require.Equal(t, []model.Fingerprint{1, 2}, evicted)
+	require.True(t, ii.IsEmpty())
+}
+
+func Test_MaxValuesPerLabel(t *testing.T) {
+	type pair struct {
+		fp          model.Fingerprint
+		name, value string
+	}
+	var dropped []pair
+	ii := NewWithOptions(1, IndexOptions{
+		MaxValuesPerLabel: 3,
+		OnDroppedPair: func(fp model.Fingerprint, name, value string) {
+			dropped = append(dropped, pair{fp: fp, name: name, value: value})
+		},
+	})
+	for i := 0; i < 5; i++ {
+		lbs := ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+		if i >= 3 {
+			require.Equal(t, phlaremodel.LabelsFromStrings("env", "prod"), lbs)
+		}
+	}
+	require.Equal(t, []pair{{3, "pod", "pod-3"}, {4, "pod", "pod-4"}}, dropped)
+
+	values, err := ii.LabelValues("pod", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod-0", "pod-1", "pod-2"}, values)
+	// existing values are still added
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "pod-1"), 10)
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{0, 1, 2, 3, 4, 10}, fps)
+	require.Len(t, dropped, 2)
+
+	// series whose pairs are all dropped aren't indexed
+	ii.Add(phlaremodel.LabelsFromStrings("pod", "pod-5"), 11)
+	require.False(t, ii.Exists(11))
+	require.Len(t, dropped, 3)
+	require.NoError(t, ii.Validate())
+
+	// transactions and replacements drop pairs too
+	require.NoError(t, ii.Txn(func(tx *IndexTxn) error {
+		tx.Add(phlaremodel.LabelsFromStrings("env", "dev", "pod", "pod-6"), 12)
+		return nil
+	}))
+	_, err = ii.ReplaceSeries(12, phlaremodel.LabelsFromStrings("env", "dev", "pod", "pod-7"))
+	require.NoError(t, err)
+	require.Equal(t, []pair{{12, "pod", "pod-6"}, {12, "pod", "pod-7"}}, dropped[3:])
+	require.NoError(t, ii.Validate())
+}
+
+func Test_DeleteLabelValue(t *testing.T) {
+	var evicted []model.Fingerprint
+	ii := NewWithOptions(4, IndexOptions{OnEvict: func(fp model.Fingerprint, _ phlaremodel.Labels) {
+		evicted = append(evicted, fp)
+	}})
+	for i := 0; i < 20; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"instance", fmt.Sprint("instance-", i%4),
+			"pod", fmt.Sprint("pod-", i),
+		), model.Fingerprint(i))
+	}
+
+	require.Equal(t, 5, ii.DeleteLabelValue("instance", "instance-1"))
+	require.ElementsMatch(t, []model.Fingerprint{1, 5, 9, 13, 17}, evicted)
+	for i := 0; i < 20; i++ {
+		require.Equal(t, i%4 != 1, ii.Exists(model.Fingerprint(i)), i)
+	}
+	values, err := ii.LabelValues("instance", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"instance-0", "instance-2", "instance-3"}, values)
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-5")}, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+	require.NoError(t, ii.Validate())
+
+	require.Equal(t, 0, ii.DeleteLabelValue("instance", "instance-1"))
+	require.Equal(t, 0, ii.DeleteLabelValue("unknown", "instance-1"))
+
+	// series whose stored labels lost a name are still deleted entirely
+	ii.DropLabel("pod")
+	require.Equal(t, 5, ii.DeleteLabelValue("instance", "instance-2"))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_ValueNormalizer(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{ValueNormalizer: func(name, value string) string {
+		if name == "__name__" {
+			return value
+		}
+		return strings.ToLower(strings.TrimSpace(value))
+	}})
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "CPU", "env", "Prod"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "CPU", "env", " prod "), 2)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "CPU", "env", "dev"), 3)
+
+	values, err := ii.LabelValues("env", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"dev", "prod"}, values)
+	names, err := ii.LabelValues("__name__", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"CPU"}, names)
+
+	for _, tt := range []struct {
+		matcher  *labels.Matcher
+		expected []model.Fingerprint
+	}{
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "PROD"), []model.Fingerprint{1, 2}},
+		{labels.MustNewMatcher(labels.MatchNotEqual, "env", " Prod"), []model.Fingerprint{3}},
+		// regexps are evaluated against the normalized values
+		{labels.MustNewMatcher(labels.MatchRegexp, "env", "p.*"), []model.Fingerprint{1, 2}},
+		{labels.MustNewMatcher(labels.MatchRegexp, "env", "P.*"), nil},
+	} {
+		fps, err := ii.Lookup([]*labels.Matcher{tt.matcher}, nil)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, fps, tt.matcher)
+	}
+
+	series, err := ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "env", "DEV")}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []phlaremodel.Labels{phlaremodel.LabelsFromStrings("__name__", "CPU", "env", "dev")}, series)
+
+	// shard routing and postings similarity see the normalized pairs
+	shards, err := ii.ShardsForMatchers([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "PROD")})
+	require.NoError(t, err)
+	expected, err := ii.ShardsForMatchers([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")})
+	require.NoError(t, err)
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, shards)
+	similarity, err := ii.PostingsSimilarity("env", "PROD", "__name__", "CPU", nil)
+	require.NoError(t, err)
+	require.InDelta(t, 2.0/3, similarity, 1e-9)
+
+	// deletes find the normalized series
+	ii.Delete(phlaremodel.LabelsFromStrings("__name__", "CPU", "env", "PROD"), 1)
+	require.False(t, ii.Exists(1))
+	require.Equal(t, 1, ii.DeleteLabelValue("env", "Prod "))
+	require.False(t, ii.Exists(2))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_DescendingPostings(t *testing.T) {
+	build := func(opts IndexOptions) *InvertedIndex {
+		ii := NewWithOptions(8, opts)
+		for i := 0; i < 100; i++ {
+			ii.Add(phlaremodel.LabelsFromStrings(
+				"env", fmt.Sprint("env-", i%2),
+				"service", fmt.Sprint("svc-", i%3),
+				"pod", fmt.Sprint("pod-", i),
+			), model.Fingerprint(i*7%100))
+		}
+		return ii
+	}
+	matchers := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "env", "env-0"),
+		labels.MustNewMatcher(labels.MatchRegexp, "service", "svc-(0|2)"),
+	}
+	reversed := func(fps []model.Fingerprint) []model.Fingerprint {
+		result := append([]model.Fingerprint(nil), fps...)
+		reverseFingerprints(result)
+		return result
+	}
+
+	for _, opts := range []IndexOptions{
+		{},
+		{BitmapPostings: true},
+		{ImmutablePostings: true},
+		{LookupCacheSize: 16},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			asc := build(opts)
+			opts.DescendingPostings = true
+			desc := build(opts)
+
+			expected, err := asc.Lookup(matchers, nil)
+			require.NoError(t, err)
+			require.NotEmpty(t, expected)
+			require.True(t, sort.SliceIsSorted(expected, func(i, j int) bool { return expected[i] < expected[j] }))
+			for i := 0; i < 2; i++ {
+				// twice to go through the lookup cache
+				fps, err := desc.Lookup(matchers, nil)
+				require.NoError(t, err)
+				require.Equal(t, reversed(expected), fps)
+			}
+
+			it, err := desc.LookupIter(matchers, nil)
+			require.NoError(t, err)
+			var iterated []model.Fingerprint
+			for it.Next() {
+				iterated = append(iterated, it.At())
+			}
+			require.Equal(t, reversed(expected), iterated)
+
+			grouped, err := desc.LookupGrouped(matchers, nil)
+			require.NoError(t, err)
+			for _, fps := range grouped {
+				require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] > fps[j] }))
+			}
+
+			ranged, err := desc.LookupFingerprintRange(10, 20, nil)
+			require.NoError(t, err)
+			require.Equal(t, []model.Fingerprint{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10}, ranged)
+
+			ascSeries, err := asc.MatchSeries([][]*labels.Matcher{matchers}, nil)
+			require.NoError(t, err)
+			descSeries, err := desc.MatchSeries([][]*labels.Matcher{matchers}, nil)
+			require.NoError(t, err)
+			for i := range ascSeries {
+				require.Equal(t, ascSeries[i], descSeries[len(descSeries)-1-i])
+			}
+
+			ch, err := desc.StreamSeries(context.Background(), matchers, nil)
+			require.NoError(t, err)
+			var streamed []model.Fingerprint
+			for r := range ch {
+				require.NoError(t, r.Err)
+				streamed = append(streamed, r.Fingerprint)
+			}
+			require.Equal(t, reversed(expected), streamed)
+		})
+	}
+}
+
+func Test_IsEmpty(t *testing.T) {
+	ii := NewWithShards(4)
+	require.True(t, ii.IsEmpty())
+	lbs := phlaremodel.LabelsFromStrings("env", "prod")
+	ii.Add(lbs, 1)
+	require.False(t, ii.IsEmpty())
+	ii.Delete(lbs, 1)
+	require.True(t, ii.IsEmpty())
+}
+
+func Test_LookupByNamePattern(t *testing.T) {
+	ii := NewWithShards(8)
+	ii.Add(phlaremodel.LabelsFromStrings("job_a", "x", "job_b", "x"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("job_a", "y"), 2)
+	ii.Add(phlaremodel.LabelsFromStrings("job_c", "x"), 3)
+	ii.Add(phlaremodel.LabelsFromStrings("other", "x"), 4)
+
+	for _, tt := range []struct {
+		pattern  string
+		matcher  *labels.Matcher
+		expected []model.Fingerprint
+	}{
+		{"^job_", labels.MustNewMatcher(labels.MatchEqual, "", "x"), []model.Fingerprint{1, 3}},
+		{"^job_", nil, []model.Fingerprint{1, 2, 3}},
+		{"job_(a|b)", labels.MustNewMatcher(labels.MatchRegexp, "", "x|y"), []model.Fingerprint{1, 2}},
+		{"", labels.MustNewMatcher(labels.MatchNotEqual, "ignored", "x"), []model.Fingerprint{2}},
+		{"^none$", nil, nil},
+	} {
+		fps, err := ii.LookupByNamePattern(regexp.MustCompile(tt.pattern), tt.matcher, nil)
+		require.NoError(t, err)
+		require.Equal(t, tt.expected, fps, tt.pattern)
+	}
+}
+
+func Test_DropLabel(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 20; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", fmt.Sprint("pod-", i), "env", "prod"), model.Fingerprint(i))
+	}
+	ii.Add(phlaremodel.LabelsFromStrings("pod", "alone"), 20)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu"), 21)
+
+	require.Equal(t, 21, ii.DropLabel("pod"))
+	require.Zero(t, ii.DropLabel("pod"))
+	require.NoError(t, ii.Validate())
+
+	names, err := ii.LabelNames(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "env"}, names)
+	require.True(t, ii.Exists(0))
+	require.False(t, ii.Exists(20))
+	require.True(t, ii.Exists(21))
+
+	res, err := ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}}, nil)
+	require.NoError(t, err)
+	require.Len(t, res, 20)
+	require.Equal(t, phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "prod"), res[0])
+
+	// series are still deleted with their original labels
+	ii.Delete(phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", "pod-0", "env", "prod"), 0)
+	require.False(t, ii.Exists(0))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_EmptyMatchMeansAbsent(t *testing.T) {
+	for _, tt := range []struct {
+		opts     IndexOptions
+		expected []model.Fingerprint
+	}{
+		{IndexOptions{}, []model.Fingerprint{2}},
+		{IndexOptions{EmptyMatchMeansAbsent: true}, []model.Fingerprint{1, 2}},
+		{IndexOptions{EmptyMatchMeansAbsent: true, ImmutablePostings: true}, []model.Fingerprint{1, 2}},
+	} {
+		t.Run(fmt.Sprintf("%+v", tt.opts), func(t *testing.T) {
+			ii := NewWithOptions(4, tt.opts)
+			ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+			ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", ""), 2)
+			ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 3)
+			ii.Add(phlaremodel.LabelsFromStrings("env", "dev"), 4)
+
+			fps, err := ii.Lookup([]*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "env", "prod"),
+				labels.MustNewMatcher(labels.MatchEqual, "pod", ""),
+			}, nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, fps)
+		})
+	}
+
+	ii := NewWithOptions(4, IndexOptions{EmptyMatchMeansAbsent: true})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "dev"), 2)
+	// no series has the label at all
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{1, 2}, fps)
+	fps, err = ii.Lookup([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "pod", ""),
+		labels.MustNewMatcher(labels.MatchEqual, "env", "dev"),
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{2}, fps)
+}
+
+func Test_AnyValuePatterns(t *testing.T) {
+	series := []phlaremodel.Labels{
+		phlaremodel.LabelsFromStrings("env", "prod"),
+		phlaremodel.LabelsFromStrings("env", "prod", "pod", ""),
+		phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"),
+		phlaremodel.LabelsFromStrings("env", "dev", "pod", "line\nbreak"),
+		phlaremodel.LabelsFromStrings("env", "dev", "pod", "xa"),
+	}
+	for _, opts := range []IndexOptions{
+		{},
+		{ImmutablePostings: true},
+		{EmptyMatchMeansAbsent: true},
+		{EmptyMatchMeansAbsent: true, ImmutablePostings: true},
+	} {
+		ii := NewWithOptions(4, opts)
+		for i, lbs := range series {
+			ii.Add(lbs, model.Fingerprint(i))
+		}
+		for _, tt := range []struct {
+			pattern  string
+			anyValue bool
+			expected []model.Fingerprint
+		}{
+			{pattern: ".+", anyValue: true, expected: []model.Fingerprint{2, 4}},
+			{pattern: "(?s:.+)", anyValue: true, expected: []model.Fingerprint{2, 3, 4}},
+			{pattern: ".*", anyValue: true, expected: []model.Fingerprint{1, 2, 4}},
+			{pattern: "(?s).*", anyValue: true, expected: []model.Fingerprint{1, 2, 3, 4}},
+			// look alike patterns go through the regexp
+			{pattern: ".+a", expected: []model.Fingerprint{4}},
+			{pattern: ".*a", expected: []model.Fingerprint{2, 4}},
+			{pattern: "a.*", expected: []model.Fingerprint{2}},
+			{pattern: ".", expected: []model.Fingerprint{2}},
+			{pattern: `\.+`, expected: nil},
+			{pattern: "a?", expected: []model.Fingerprint{1, 2}},
+		} {
+			t.Run(fmt.Sprintf("%+v/%s", opts, tt.pattern), func(t *testing.T) {
+				m := labels.MustNewMatcher(labels.MatchRegexp, "pod", tt.pattern)
+				_, ok := parseAnyValuePattern(m)
+				require.Equal(t, tt.anyValue, ok)
+
+				expected := tt.expected
+				if tt.anyValue && m.Matches("") {
+					// the series without the label match too, regardless
+					// of EmptyMatchMeansAbsent
+					expected = append([]model.Fingerprint{0}, expected...)
+				}
+				fps, err := ii.Lookup([]*labels.Matcher{m}, nil)
+				require.NoError(t, err)
+				require.Equal(t, expected, fps)
+			})
+		}
+	}
+}
+
+func Test_PostingsLengthHistogram(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 150; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"env", "prod",
+			"service", fmt.Sprint("svc-", i%20),
+			"pod", fmt.Sprint("pod-", i),
+		), model.Fingerprint(i))
+	}
+
+	buckets, err := ii.PostingsLengthHistogram(nil)
+	require.NoError(t, err)
+	require.Equal(t, []PostingsLengthBucket{
+		{Min: 1, Max: 1, Pairs: 150},
+		{Min: 2, Max: 10, Pairs: 20},
+		{Min: 11, Max: 100},
+		// env=prod is spread across shards but counted once
+		{Min: 101, Max: 1000, Pairs: 1},
+	}, buckets)
+
+	buckets, err = NewWithShards(8).PostingsLengthHistogram(nil)
+	require.NoError(t, err)
+	require.Empty(t, buckets)
+}
+
+func Test_LookupWithMatchedValues(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 30; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"env", []string{"prod-eu", "prod-us", "dev"}[i%3],
+			"pod", fmt.Sprint("pod-", i),
+		), model.Fingerprint(i))
+	}
+
+	for _, matchers := range [][]*labels.Matcher{
+		{labels.MustNewMatcher(labels.MatchRegexp, "env", "prod.*")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "env", "prod.*"), labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")},
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "dev")},
+		nil,
+	} {
+		fps, _, err := ii.LookupWithMatchedValues(matchers, nil)
+		require.NoError(t, err)
+		expected, err := ii.Lookup(matchers, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, fps)
+	}
+
+	_, values, err := ii.LookupWithMatchedValues([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchRegexp, "env", "prod.*"),
+		labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1."),
+		labels.MustNewMatcher(labels.MatchNotEqual, "pod", "pod-10"),
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"env": {"prod-eu", "prod-us"},
+		"pod": {"pod-12", "pod-13", "pod-15", "pod-16", "pod-18", "pod-19"},
+	}, values)
+}
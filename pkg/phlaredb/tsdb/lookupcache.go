@@ -0,0 +1,171 @@
+package tsdb
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// lookupCache memoizes lookup results per matcher set and shard annotation,
+// see IndexOptions.LookupCacheSize. A nil cache caches nothing.
+//
+// Entries are versioned rather than evicted on writes: each one records the
+// generations of the label names its result depends on when it was
+// computed, and is ignored once any of them changed. Matchers only match
+// the series having their label name, so a result can only change when a
+// series carrying the name of one of its matchers is written. Results of
+// matchers all matching absent labels, see
+// IndexOptions.EmptyMatchMeansAbsent, or of no matcher depend on every
+// write.
+type lookupCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+	gens  *labelGenerations
+}
+
+type lookupCacheEntry struct {
+	result  LookupResult
+	expires time.Time
+	// gens are the generations of the dependencies of the entry when the
+	// result was computed.
+	gens []uint64
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	if size <= 0 {
+		return nil
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		// only returned for a non-positive size
+		panic(err)
+	}
+	return &lookupCache{cache: cache, ttl: ttl, gens: &labelGenerations{names: map[string]uint64{}}}
+}
+
+// lookupCacheKey identifies a lookup and lists the label names its result
+// depends on, none meaning every write.
+func (ii *InvertedIndex) lookupCacheKey(matchers []*labels.Matcher, shard *shard.Annotation) (key string, deps []string) {
+	var b strings.Builder
+	if shard != nil {
+		b.WriteString(shard.String())
+	}
+	for _, m := range matchers {
+		b.WriteByte(',')
+		b.WriteString(m.String())
+		// all shards share the options of the index
+		if !ii.shards[0].matchesAbsent(m) {
+			deps = append(deps, m.Name)
+		}
+	}
+	return b.String(), deps
+}
+
+// get returns a copy of the cached result of the lookup, if it's still valid.
+func (c *lookupCache) get(key string, deps []string) (LookupResult, bool) {
+	if c == nil {
+		return LookupResult{}, false
+	}
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return LookupResult{}, false
+	}
+	entry := v.(*lookupCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.cache.Remove(key)
+		return LookupResult{}, false
+	}
+	for i, gen := range c.gens.get(deps) {
+		if gen != entry.gens[i] {
+			return LookupResult{}, false
+		}
+	}
+	result := entry.result
+	result.Fingerprints = append([]model.Fingerprint(nil), result.Fingerprints...)
+	return result, true
+}
+
+// put caches the result of a lookup computed once the dependencies had the
+// generations gens, as returned by a prior call to generations.
+func (c *lookupCache) put(key string, gens []uint64, result LookupResult) {
+	result.Fingerprints = append([]model.Fingerprint(nil), result.Fingerprints...)
+	c.cache.Add(key, &lookupCacheEntry{
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+		gens:    gens,
+	})
+}
+
+// generations returns the current generations of deps, it must be called
+// before computing the result to cache.
+func (c *lookupCache) generations(deps []string) []uint64 {
+	return c.gens.get(deps)
+}
+
+// labelGenerations counts the writes to the series carrying each label name,
+// as well as all writes. It is shared by the shards of an index, which bump
+// it under their write lock. A nil receiver tracks nothing.
+type labelGenerations struct {
+	mtx   sync.Mutex
+	all   uint64
+	names map[string]uint64
+}
+
+// get returns the generation of each name, or of all writes if names is
+// empty.
+func (g *labelGenerations) get(names []string) []uint64 {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if len(names) == 0 {
+		return []uint64{g.all}
+	}
+	gens := make([]uint64, len(names))
+	for i, name := range names {
+		gens[i] = g.names[name]
+	}
+	return gens
+}
+
+// bump records a write to a series carrying the given labels.
+func (g *labelGenerations) bump(ls []*commonv1.LabelPair) {
+	if g == nil {
+		return
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.all++
+	for _, l := range ls {
+		g.names[l.Name]++
+	}
+}
+
+// bumpName records a write to all the series carrying the given name.
+func (g *labelGenerations) bumpName(name string) {
+	if g == nil {
+		return
+	}
+	g.bump([]*commonv1.LabelPair{{Name: name}})
+}
+
+// WarmCache computes and caches the results of Lookup for each matcher set,
+// so that subsequent identical lookups are served from the cache until a
+// write invalidates them or they expire. It is a no-op unless
+// IndexOptions.LookupCacheSize is set.
+func (ii *InvertedIndex) WarmCache(matcherSets [][]*labels.Matcher, shard *shard.Annotation) error {
+	if ii.lookupCache == nil {
+		return nil
+	}
+	for _, matchers := range matcherSets {
+		if _, err := ii.LookupDetailed(matchers, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
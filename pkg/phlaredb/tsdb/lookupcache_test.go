@@ -0,0 +1,102 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_LookupCache(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{LookupCacheSize: 8})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "dev", "pod", "b"), 2)
+
+	prod := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}
+	notProd := []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "env", "prod")}
+	require.NoError(t, ii.WarmCache([][]*labels.Matcher{prod, notProd, nil}, nil))
+	require.Equal(t, 3, ii.lookupCache.cache.Len())
+
+	lookup := func(matchers []*labels.Matcher) []model.Fingerprint {
+		t.Helper()
+		fps, err := ii.Lookup(matchers, nil)
+		require.NoError(t, err)
+		return fps
+	}
+	fps := lookup(prod)
+	require.Equal(t, []model.Fingerprint{1}, fps)
+	// results are copied out of the cache
+	fps[0] = 42
+	require.Equal(t, []model.Fingerprint{1}, lookup(prod))
+	require.Equal(t, []model.Fingerprint{2}, lookup(notProd))
+
+	// a series without env only invalidates the lookups not depending on it
+	key, deps := ii.lookupCacheKey(prod, nil)
+	ii.Add(phlaremodel.LabelsFromStrings("pod", "c"), 3)
+	_, ok := ii.lookupCache.get(key, deps)
+	require.True(t, ok)
+	require.Equal(t, []model.Fingerprint{1}, lookup(prod))
+	require.Equal(t, []model.Fingerprint{2}, lookup(notProd))
+	require.Equal(t, []model.Fingerprint{1, 2, 3}, lookup(nil))
+
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "d"), 4)
+	require.Equal(t, []model.Fingerprint{1, 4}, lookup(prod))
+	ii.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 1)
+	require.Equal(t, []model.Fingerprint{4}, lookup(prod))
+	ii.DropLabel("env")
+	require.Empty(t, lookup(prod))
+	require.Empty(t, lookup(notProd))
+
+	// entries are keyed by shard annotation too
+	all, err := ii.Lookup(nil, nil)
+	require.NoError(t, err)
+	var sharded []model.Fingerprint
+	for i := 0; i < 2; i++ {
+		fps, err := ii.Lookup(nil, &shard.Annotation{Shard: i, Of: 2})
+		require.NoError(t, err)
+		sharded = append(sharded, fps...)
+	}
+	require.ElementsMatch(t, all, sharded)
+
+	require.ErrorIs(t, ii.WarmCache([][]*labels.Matcher{prod}, &shard.Annotation{Shard: 0, Of: 8}), ErrShardTooLarge)
+}
+
+func Test_LookupCacheEmptyMatchMeansAbsent(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{LookupCacheSize: 8, EmptyMatchMeansAbsent: true})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	noEnv := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "")}
+	fps, err := ii.Lookup(noEnv, nil)
+	require.NoError(t, err)
+	require.Empty(t, fps)
+
+	ii.Add(phlaremodel.LabelsFromStrings("pod", "a"), 2)
+	fps, err = ii.Lookup(noEnv, nil)
+	require.NoError(t, err)
+	require.Equal(t, []model.Fingerprint{2}, fps)
+}
+
+func Test_LookupCacheTTL(t *testing.T) {
+	ii := NewWithOptions(4, IndexOptions{LookupCacheSize: 8, LookupCacheTTL: time.Millisecond})
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod"), 1)
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}
+	require.NoError(t, ii.WarmCache([][]*labels.Matcher{matchers}, nil))
+
+	key, deps := ii.lookupCacheKey(matchers, nil)
+	_, ok := ii.lookupCache.get(key, deps)
+	require.True(t, ok)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = ii.lookupCache.get(key, deps)
+	require.False(t, ok)
+	require.Equal(t, 0, ii.lookupCache.cache.Len())
+}
+
+func Test_LookupCacheDisabled(t *testing.T) {
+	ii := NewWithShards(4)
+	require.Nil(t, ii.lookupCache)
+	require.NoError(t, ii.WarmCache([][]*labels.Matcher{nil}, nil))
+}
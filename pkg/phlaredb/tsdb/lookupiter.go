@@ -0,0 +1,106 @@
+package tsdb
+
+import (
+	"container/heap"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// LookupIter is like Lookup but returns an iterator over the matching
+// fingerprints in ascending order, or descending with
+// IndexOptions.DescendingPostings. The results of each shard are merged
+// incrementally with a k-way merge instead of being combined into a single
+// slice first, see BenchmarkLookupIter.
+func (ii *InvertedIndex) LookupIter(matchers []*labels.Matcher, shard *shard.Annotation) (iter.Iterator[model.Fingerprint], error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return nil, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+	results, err := ii.lookupShards(ii.getShards(shard), matchers)
+	if err != nil {
+		return nil, err
+	}
+	if ii.opts.DescendingPostings {
+		for _, fps := range results {
+			reverseFingerprints(fps)
+		}
+	}
+	return newMergeFingerprintsIterator(results, ii.opts.DescendingPostings), nil
+}
+
+// mergeFingerprintsIterator merges lists of fingerprints sorted in the same
+// order, skipping duplicates, using a heap ordered by the head of each list.
+type mergeFingerprintsIterator struct {
+	heap    fingerprintsHeap
+	curr    model.Fingerprint
+	started bool
+}
+
+func newMergeFingerprintsIterator(ss [][]model.Fingerprint, descending bool) *mergeFingerprintsIterator {
+	h := fingerprintsHeap{lists: make([][]model.Fingerprint, 0, len(ss)), descending: descending}
+	for _, fps := range ss {
+		if len(fps) > 0 {
+			h.lists = append(h.lists, fps)
+		}
+	}
+	heap.Init(&h)
+	return &mergeFingerprintsIterator{heap: h}
+}
+
+func (it *mergeFingerprintsIterator) Next() bool {
+	for len(it.heap.lists) > 0 {
+		fp := it.heap.lists[0][0]
+		if it.heap.lists[0] = it.heap.lists[0][1:]; len(it.heap.lists[0]) == 0 {
+			heap.Pop(&it.heap)
+		} else {
+			heap.Fix(&it.heap, 0)
+		}
+		if it.started && fp == it.curr {
+			continue
+		}
+		it.curr, it.started = fp, true
+		return true
+	}
+	return false
+}
+
+func (it *mergeFingerprintsIterator) At() model.Fingerprint { return it.curr }
+
+func (it *mergeFingerprintsIterator) Err() error { return nil }
+
+func (it *mergeFingerprintsIterator) Close() error { return nil }
+
+// fingerprintsHeap is a heap of non-empty sorted lists of fingerprints,
+// ordered by their first fingerprint: a min heap of ascending lists, or a
+// max heap of descending ones.
+type fingerprintsHeap struct {
+	lists      [][]model.Fingerprint
+	descending bool
+}
+
+func (h fingerprintsHeap) Len() int { return len(h.lists) }
+func (h fingerprintsHeap) Less(i, j int) bool {
+	if h.descending {
+		return h.lists[i][0] > h.lists[j][0]
+	}
+	return h.lists[i][0] < h.lists[j][0]
+}
+func (h fingerprintsHeap) Swap(i, j int) { h.lists[i], h.lists[j] = h.lists[j], h.lists[i] }
+
+func (h *fingerprintsHeap) Push(x interface{}) {
+	h.lists = append(h.lists, x.([]model.Fingerprint))
+}
+
+func (h *fingerprintsHeap) Pop() interface{} {
+	n := len(h.lists)
+	x := h.lists[n-1]
+	h.lists = h.lists[:n-1]
+	return x
+}
@@ -0,0 +1,61 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_LookupIter(t *testing.T) {
+	ii := NewWithShards(8)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%2), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+
+	for _, tt := range []struct {
+		matchers []*labels.Matcher
+		shard    *shard.Annotation
+	}{
+		{nil, nil},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")}, nil},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")}, &shard.Annotation{Shard: 1, Of: 2}},
+		{[]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "none")}, nil},
+	} {
+		expected, err := ii.Lookup(tt.matchers, tt.shard)
+		require.NoError(t, err)
+		it, err := ii.LookupIter(tt.matchers, tt.shard)
+		require.NoError(t, err)
+		var fps []model.Fingerprint
+		for it.Next() {
+			fps = append(fps, it.At())
+		}
+		require.NoError(t, it.Err())
+		require.NoError(t, it.Close())
+		require.Equal(t, expected, fps)
+	}
+
+	_, err := ii.LookupIter(nil, &shard.Annotation{Shard: 1, Of: 16})
+	require.ErrorIs(t, err, ErrShardTooLarge)
+}
+
+func Test_MergeFingerprintsIterator(t *testing.T) {
+	it := newMergeFingerprintsIterator([][]model.Fingerprint{{1, 4, 7}, nil, {2, 4, 9}, {3}, {}}, false)
+	var fps []model.Fingerprint
+	for it.Next() {
+		fps = append(fps, it.At())
+	}
+	require.Equal(t, []model.Fingerprint{1, 2, 3, 4, 7, 9}, fps)
+
+	it = newMergeFingerprintsIterator([][]model.Fingerprint{{7, 4, 1}, nil, {9, 4, 2}, {3}, {}}, true)
+	fps = fps[:0]
+	for it.Next() {
+		fps = append(fps, it.At())
+	}
+	require.Equal(t, []model.Fingerprint{9, 7, 4, 3, 2, 1}, fps)
+}
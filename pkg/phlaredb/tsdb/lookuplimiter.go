@@ -0,0 +1,99 @@
+package tsdb
+
+import (
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"go.uber.org/atomic"
+)
+
+// lookupLimiter bounds the goroutines evaluating shards across all the
+// lookups of an index, see IndexOptions.MaxLookupGoroutines.
+type lookupLimiter struct {
+	slots chan struct{}
+}
+
+func newLookupLimiter(size int) *lookupLimiter {
+	if size <= 0 {
+		return nil
+	}
+	return &lookupLimiter{slots: make(chan struct{}, size)}
+}
+
+// tryAcquire takes a slot without waiting and reports whether it did.
+func (l *lookupLimiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *lookupLimiter) release() {
+	<-l.slots
+}
+
+func (l *lookupLimiter) inFlight() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// InFlightLookupGoroutines returns the number of goroutines currently
+// evaluating shards for lookups, at most IndexOptions.MaxLookupGoroutines.
+func (ii *InvertedIndex) InFlightLookupGoroutines() int {
+	return ii.lookupLimiter.inFlight()
+}
+
+// lookupShardsParallel is lookupShards evaluating the shards concurrently
+// within the bounds of the lookup limiter. Shards are evaluated in the
+// calling goroutine when no slot is available, and so is the last one. As
+// for sequential lookups, the lookup limit is checked as each shard
+// completes: once exceeded, the shards not started yet are skipped and
+// the lookup fails as soon as the ones in flight complete.
+func (ii *InvertedIndex) lookupShardsParallel(shards []*indexShard, eval func(*indexShard) []model.Fingerprint) ([][]model.Fingerprint, error) {
+	perShard := make([][]model.Fingerprint, len(shards))
+	var (
+		wg       sync.WaitGroup
+		count    atomic.Int64
+		exceeded atomic.Bool
+	)
+	run := func(i int) {
+		if exceeded.Load() {
+			return
+		}
+		perShard[i] = eval(shards[i])
+		if n := count.Add(int64(len(perShard[i]))); ii.checkLookupLimit(int(n)) != nil {
+			exceeded.Store(true)
+		}
+	}
+	for i := range shards {
+		if exceeded.Load() {
+			break
+		}
+		if i < len(shards)-1 && ii.lookupLimiter.tryAcquire() {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer ii.lookupLimiter.release()
+				run(i)
+			}(i)
+			continue
+		}
+		run(i)
+	}
+	wg.Wait()
+	if err := ii.checkLookupLimit(int(count.Load())); err != nil {
+		return nil, err
+	}
+
+	results := perShard[:0]
+	for _, fps := range perShard {
+		if len(fps) > 0 {
+			results = append(results, fps)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,111 @@
+package tsdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_MaxLookupGoroutines(t *testing.T) {
+	build := func(opts IndexOptions) *InvertedIndex {
+		ii := NewWithOptions(16, opts)
+		for i := 0; i < 500; i++ {
+			ii.Add(phlaremodel.LabelsFromStrings("env", fmt.Sprint("env-", i%3), "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+		}
+		return ii
+	}
+	sequential := build(IndexOptions{})
+	parallel := build(IndexOptions{MaxLookupGoroutines: 4})
+	require.Zero(t, sequential.InFlightLookupGoroutines())
+
+	queries := [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*"), labels.MustNewMatcher(labels.MatchNotEqual, "env", "env-2")},
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-7")},
+		{labels.MustNewMatcher(labels.MatchEqual, "pod", "unknown")},
+	}
+	var wg sync.WaitGroup
+	var mismatch error
+	var mtx sync.Mutex
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, matchers := range queries {
+				expected, err1 := sequential.Lookup(matchers, nil)
+				actual, err2 := parallel.Lookup(matchers, nil)
+				if err1 != nil || err2 != nil || fmt.Sprint(expected) != fmt.Sprint(actual) {
+					mtx.Lock()
+					mismatch = fmt.Errorf("%v: got %v, %v, expected %v, %v", matchers, actual, err2, expected, err1)
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, mismatch)
+	require.Zero(t, parallel.InFlightLookupGoroutines())
+
+	// the limit applies to the total of the shards
+	limited := build(IndexOptions{MaxLookupGoroutines: 4, MaxLookupResults: 100})
+	_, err := limited.Lookup(queries[1], nil)
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, err, &limitErr)
+	require.Greater(t, limitErr.Count, 100)
+	require.LessOrEqual(t, limitErr.Count, 167)
+
+	// lookups don't wait for slots once all of them are taken
+	for parallel.lookupLimiter.tryAcquire() {
+	}
+	require.Equal(t, 4, parallel.InFlightLookupGoroutines())
+	fps, err := parallel.Lookup(queries[1], nil)
+	require.NoError(t, err)
+	require.Len(t, fps, 167)
+}
+
+func Test_LookupShardsParallelLimit(t *testing.T) {
+	ii := NewWithOptions(16, IndexOptions{MaxLookupGoroutines: 1, MaxLookupResults: 2})
+	var evaluated atomic.Int64
+	_, err := ii.lookupShardsParallel(ii.shards, func(s *indexShard) []model.Fingerprint {
+		evaluated.Inc()
+		return []model.Fingerprint{model.Fingerprint(s.shard)}
+	})
+	var limitErr *LimitExceededError
+	require.ErrorAs(t, err, &limitErr)
+	// the shards left once the limit is exceeded are skipped, at most one
+	// being in flight besides the calling goroutine
+	require.Less(t, evaluated.Load(), int64(6))
+	require.Zero(t, ii.InFlightLookupGoroutines())
+}
+
+func Test_LookupShardsParallel(t *testing.T) {
+	ii := NewWithOptions(16, IndexOptions{MaxLookupGoroutines: 3})
+	var mtx sync.Mutex
+	var maxInFlight int
+	results, err := ii.lookupShardsParallel(ii.shards, func(s *indexShard) []model.Fingerprint {
+		mtx.Lock()
+		if n := ii.InFlightLookupGoroutines(); n > maxInFlight {
+			maxInFlight = n
+		}
+		mtx.Unlock()
+		if s.shard%2 == 0 {
+			return nil
+		}
+		return []model.Fingerprint{model.Fingerprint(s.shard)}
+	})
+	require.NoError(t, err)
+	require.LessOrEqual(t, maxInFlight, 3)
+	require.Len(t, results, 8)
+	for i, fps := range results {
+		require.Equal(t, []model.Fingerprint{model.Fingerprint(2*i + 1)}, fps)
+	}
+	require.Zero(t, ii.InFlightLookupGoroutines())
+}
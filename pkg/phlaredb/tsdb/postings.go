@@ -0,0 +1,441 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync/atomic"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/prometheus/common/model"
+)
+
+// postings is the set of fingerprints of the series carrying a label pair.
+// Implementations are not safe for concurrent use and rely on the lock of
+// the shard owning them.
+type postings interface {
+	// add inserts fp, which is a no-op if it's already present.
+	add(fp model.Fingerprint)
+	// remove deletes fp and reports whether it was present.
+	remove(fp model.Fingerprint) bool
+	contains(fp model.Fingerprint) bool
+	len() int
+	// appendTo appends the fingerprints in ascending order to dst.
+	appendTo(dst []model.Fingerprint) []model.Fingerprint
+	// intersect returns the fingerprints of the sorted list fps which are
+	// also part of the postings.
+	intersect(fps []model.Fingerprint) []model.Fingerprint
+	// iterate calls f for each fingerprint in ascending order until f
+	// returns false.
+	iterate(f func(model.Fingerprint) bool)
+}
+
+// slicePostings is the default postings implementation, a sorted slice.
+type slicePostings struct {
+	fps []model.Fingerprint
+}
+
+func (p *slicePostings) search(fp model.Fingerprint) int {
+	return sort.Search(len(p.fps), func(i int) bool {
+		return p.fps[i] >= fp
+	})
+}
+
+func (p *slicePostings) add(fp model.Fingerprint) {
+	// Most values of high cardinality labels are carried by a single
+	// series, skip the search for empty and singleton postings.
+	switch len(p.fps) {
+	case 0:
+		p.fps = append(p.fps, fp)
+		return
+	case 1:
+		switch {
+		case fp > p.fps[0]:
+			p.fps = append(p.fps, fp)
+		case fp < p.fps[0]:
+			p.fps = append(p.fps, p.fps[0])
+			p.fps[0] = fp
+		}
+		return
+	}
+	// Insert into the right position to keep fingerprints sorted
+	j := p.search(fp)
+	if j < len(p.fps) && p.fps[j] == fp {
+		return
+	}
+	p.fps = append(p.fps, 0)
+	copy(p.fps[j+1:], p.fps[j:])
+	p.fps[j] = fp
+}
+
+func (p *slicePostings) remove(fp model.Fingerprint) bool {
+	j := p.search(fp)
+	if j >= len(p.fps) || p.fps[j] != fp {
+		return false
+	}
+	p.fps = p.fps[:j+copy(p.fps[j:], p.fps[j+1:])]
+	return true
+}
+
+func (p *slicePostings) contains(fp model.Fingerprint) bool {
+	j := p.search(fp)
+	return j < len(p.fps) && p.fps[j] == fp
+}
+
+func (p *slicePostings) len() int { return len(p.fps) }
+
+func (p *slicePostings) appendTo(dst []model.Fingerprint) []model.Fingerprint {
+	return append(dst, p.fps...)
+}
+
+func (p *slicePostings) intersect(fps []model.Fingerprint) []model.Fingerprint {
+	return intersect(fps, p.fps)
+}
+
+func (p *slicePostings) iterate(f func(model.Fingerprint) bool) {
+	for _, fp := range p.fps {
+		if !f(fp) {
+			return
+		}
+	}
+}
+
+// bitmapPostings stores fingerprints in a roaring bitmap. Intersecting
+// large postings with a few fingerprints is much cheaper than with slices,
+// and removal doesn't shift memory. However fingerprints are hashes spread
+// over the whole 64-bit space, so most of them end up in their own bitmap
+// container: memory usage and full scans are more expensive than slices.
+// See BenchmarkPostings to compare both implementations.
+type bitmapPostings struct {
+	bitmap *roaring64.Bitmap
+}
+
+func newBitmapPostings() *bitmapPostings {
+	return &bitmapPostings{bitmap: roaring64.New()}
+}
+
+func (p *bitmapPostings) add(fp model.Fingerprint) {
+	p.bitmap.Add(uint64(fp))
+}
+
+func (p *bitmapPostings) remove(fp model.Fingerprint) bool {
+	return p.bitmap.CheckedRemove(uint64(fp))
+}
+
+func (p *bitmapPostings) contains(fp model.Fingerprint) bool {
+	return p.bitmap.Contains(uint64(fp))
+}
+
+func (p *bitmapPostings) len() int { return int(p.bitmap.GetCardinality()) }
+
+func (p *bitmapPostings) appendTo(dst []model.Fingerprint) []model.Fingerprint {
+	for _, fp := range p.bitmap.ToArray() {
+		dst = append(dst, model.Fingerprint(fp))
+	}
+	return dst
+}
+
+func (p *bitmapPostings) intersect(fps []model.Fingerprint) []model.Fingerprint {
+	result := []model.Fingerprint{}
+	for _, fp := range fps {
+		if p.bitmap.Contains(uint64(fp)) {
+			result = append(result, fp)
+		}
+	}
+	return result
+}
+
+func (p *bitmapPostings) iterate(f func(model.Fingerprint) bool) {
+	it := p.bitmap.Iterator()
+	for it.HasNext() {
+		if !f(model.Fingerprint(it.Next())) {
+			return
+		}
+	}
+}
+
+// immutablePostings is a sorted slice which is never modified once
+// published: add and remove build a new slice and atomically swap it in.
+// Readers loading a snapshot can therefore keep using it without holding
+// the shard lock, while writers still serialize on it. The price is a copy
+// of the whole postings on every add and remove, and superseded snapshots
+// staying alive as long as readers reference them.
+type immutablePostings struct {
+	v atomic.Value // []model.Fingerprint
+}
+
+func newImmutablePostings() *immutablePostings {
+	p := &immutablePostings{}
+	p.v.Store([]model.Fingerprint(nil))
+	return p
+}
+
+// snapshot returns the current fingerprints, which must not be modified.
+func (p *immutablePostings) snapshot() []model.Fingerprint {
+	return p.v.Load().([]model.Fingerprint)
+}
+
+func (p *immutablePostings) search(fps []model.Fingerprint, fp model.Fingerprint) int {
+	return sort.Search(len(fps), func(i int) bool {
+		return fps[i] >= fp
+	})
+}
+
+func (p *immutablePostings) add(fp model.Fingerprint) {
+	fps := p.snapshot()
+	j := p.search(fps, fp)
+	if j < len(fps) && fps[j] == fp {
+		return
+	}
+	next := make([]model.Fingerprint, len(fps)+1)
+	copy(next, fps[:j])
+	next[j] = fp
+	copy(next[j+1:], fps[j:])
+	p.v.Store(next)
+}
+
+func (p *immutablePostings) remove(fp model.Fingerprint) bool {
+	fps := p.snapshot()
+	j := p.search(fps, fp)
+	if j >= len(fps) || fps[j] != fp {
+		return false
+	}
+	next := make([]model.Fingerprint, 0, len(fps)-1)
+	next = append(next, fps[:j]...)
+	p.v.Store(append(next, fps[j+1:]...))
+	return true
+}
+
+func (p *immutablePostings) contains(fp model.Fingerprint) bool {
+	fps := p.snapshot()
+	j := p.search(fps, fp)
+	return j < len(fps) && fps[j] == fp
+}
+
+func (p *immutablePostings) len() int { return len(p.snapshot()) }
+
+func (p *immutablePostings) appendTo(dst []model.Fingerprint) []model.Fingerprint {
+	return append(dst, p.snapshot()...)
+}
+
+func (p *immutablePostings) intersect(fps []model.Fingerprint) []model.Fingerprint {
+	return intersect(fps, p.snapshot())
+}
+
+func (p *immutablePostings) iterate(f func(model.Fingerprint) bool) {
+	for _, fp := range p.snapshot() {
+		if !f(fp) {
+			return
+		}
+	}
+}
+
+// deltaPostingsBlockSize is the maximum number of fingerprints per block of
+// deltaPostings, bounding the decoding work of point operations.
+const deltaPostingsBlockSize = 128
+
+// deltaPostings stores fingerprints in blocks of delta-varint encoded bytes,
+// decoded on demand. Only the first and last fingerprint of each block are
+// kept decoded, to locate the block a fingerprint belongs to. Memory savings
+// depend on the gaps between fingerprints: hashes spread over the whole
+// 64-bit space only get close to each other in dense postings. Every read
+// pays for decoding, see BenchmarkPostings and BenchmarkPostingsMemory.
+type deltaPostings struct {
+	blocks []deltaBlock
+	n      int
+}
+
+type deltaBlock struct {
+	first, last model.Fingerprint
+	n           int
+	// data holds the deltas between consecutive fingerprints after first.
+	data []byte
+}
+
+func encodeDeltaBlock(fps []model.Fingerprint) deltaBlock {
+	b := deltaBlock{first: fps[0], last: fps[len(fps)-1], n: len(fps)}
+	for i := 1; i < len(fps); i++ {
+		b.data = appendUvarint(b.data, uint64(fps[i]-fps[i-1]))
+	}
+	return b
+}
+
+func appendUvarint(dst []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func (b *deltaBlock) decode(dst []model.Fingerprint) []model.Fingerprint {
+	fp := b.first
+	dst = append(dst, fp)
+	for data := b.data; len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		fp += model.Fingerprint(delta)
+		dst = append(dst, fp)
+	}
+	return dst
+}
+
+// block returns the index of the block fp belongs to: the last one starting
+// at or before fp, or the first one.
+func (p *deltaPostings) block(fp model.Fingerprint) int {
+	i := sort.Search(len(p.blocks), func(i int) bool {
+		return p.blocks[i].first > fp
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+func (p *deltaPostings) add(fp model.Fingerprint) {
+	if len(p.blocks) == 0 {
+		p.blocks = append(p.blocks, encodeDeltaBlock([]model.Fingerprint{fp}))
+		p.n++
+		return
+	}
+	i := p.block(fp)
+	b := &p.blocks[i]
+	if fp > b.last {
+		// fp lies between this block and the next one, append it
+		if b.n < deltaPostingsBlockSize {
+			b.data = appendUvarint(b.data, uint64(fp-b.last))
+			b.last = fp
+			b.n++
+			p.n++
+			return
+		}
+		if i == len(p.blocks)-1 {
+			p.blocks = append(p.blocks, encodeDeltaBlock([]model.Fingerprint{fp}))
+			p.n++
+			return
+		}
+	}
+
+	fps := b.decode(make([]model.Fingerprint, 0, b.n+1))
+	j := sort.Search(len(fps), func(j int) bool { return fps[j] >= fp })
+	if j < len(fps) && fps[j] == fp {
+		return
+	}
+	fps = append(fps, 0)
+	copy(fps[j+1:], fps[j:])
+	fps[j] = fp
+	p.n++
+	if len(fps) <= deltaPostingsBlockSize {
+		*b = encodeDeltaBlock(fps)
+		return
+	}
+	half := len(fps) / 2
+	p.blocks = append(p.blocks, deltaBlock{})
+	copy(p.blocks[i+2:], p.blocks[i+1:])
+	p.blocks[i] = encodeDeltaBlock(fps[:half])
+	p.blocks[i+1] = encodeDeltaBlock(fps[half:])
+}
+
+func (p *deltaPostings) remove(fp model.Fingerprint) bool {
+	if len(p.blocks) == 0 {
+		return false
+	}
+	i := p.block(fp)
+	b := &p.blocks[i]
+	if fp < b.first || fp > b.last {
+		return false
+	}
+	fps := b.decode(make([]model.Fingerprint, 0, b.n))
+	j := sort.Search(len(fps), func(j int) bool { return fps[j] >= fp })
+	if j >= len(fps) || fps[j] != fp {
+		return false
+	}
+	fps = fps[:j+copy(fps[j:], fps[j+1:])]
+	p.n--
+	if len(fps) == 0 {
+		p.blocks = p.blocks[:i+copy(p.blocks[i:], p.blocks[i+1:])]
+		return true
+	}
+	*b = encodeDeltaBlock(fps)
+	return true
+}
+
+func (p *deltaPostings) contains(fp model.Fingerprint) bool {
+	if len(p.blocks) == 0 {
+		return false
+	}
+	b := &p.blocks[p.block(fp)]
+	if fp < b.first || fp > b.last {
+		return false
+	}
+	found := false
+	b.iterate(func(v model.Fingerprint) bool {
+		found = v == fp
+		return v < fp
+	})
+	return found
+}
+
+func (p *deltaPostings) len() int { return p.n }
+
+func (p *deltaPostings) appendTo(dst []model.Fingerprint) []model.Fingerprint {
+	for i := range p.blocks {
+		dst = p.blocks[i].decode(dst)
+	}
+	return dst
+}
+
+func (p *deltaPostings) intersect(fps []model.Fingerprint) []model.Fingerprint {
+	result := []model.Fingerprint{}
+	var decoded []model.Fingerprint
+	for i := range p.blocks {
+		b := &p.blocks[i]
+		for len(fps) > 0 && fps[0] < b.first {
+			fps = fps[1:]
+		}
+		if len(fps) == 0 {
+			break
+		}
+		if fps[0] > b.last {
+			continue
+		}
+		decoded = b.decode(decoded[:0])
+		for j, k := 0, 0; j < len(decoded) && k < len(fps); {
+			switch {
+			case decoded[j] == fps[k]:
+				result = append(result, fps[k])
+				j++
+				k++
+			case decoded[j] < fps[k]:
+				j++
+			default:
+				k++
+			}
+		}
+	}
+	return result
+}
+
+func (p *deltaPostings) iterate(f func(model.Fingerprint) bool) {
+	for i := range p.blocks {
+		stopped := false
+		p.blocks[i].iterate(func(fp model.Fingerprint) bool {
+			stopped = !f(fp)
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+func (b *deltaBlock) iterate(f func(model.Fingerprint) bool) {
+	fp := b.first
+	if !f(fp) {
+		return
+	}
+	for data := b.data; len(data) > 0; {
+		delta, n := binary.Uvarint(data)
+		data = data[n:]
+		fp += model.Fingerprint(delta)
+		if !f(fp) {
+			return
+		}
+	}
+}
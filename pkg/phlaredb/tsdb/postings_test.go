@@ -0,0 +1,303 @@
+package tsdb
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+)
+
+var postingsImplementations = map[string]func() postings{
+	"slice":     func() postings { return &slicePostings{} },
+	"bitmap":    func() postings { return newBitmapPostings() },
+	"immutable": func() postings { return newImmutablePostings() },
+	"delta":     func() postings { return &deltaPostings{} },
+}
+
+func Test_Postings(t *testing.T) {
+	for name, newPostings := range postingsImplementations {
+		t.Run(name, func(t *testing.T) {
+			p := newPostings()
+			for _, fp := range []model.Fingerprint{5, 1, 3, 1 << 63, 3} {
+				p.add(fp)
+			}
+			require.Equal(t, 4, p.len())
+			require.Equal(t, []model.Fingerprint{1, 3, 5, 1 << 63}, p.appendTo(nil))
+			require.True(t, p.contains(3))
+			require.False(t, p.contains(4))
+			require.Equal(t, []model.Fingerprint{1, 5}, p.intersect([]model.Fingerprint{0, 1, 2, 5, 6}))
+			require.Empty(t, p.intersect([]model.Fingerprint{2}))
+
+			var iterated []model.Fingerprint
+			p.iterate(func(fp model.Fingerprint) bool {
+				iterated = append(iterated, fp)
+				return len(iterated) < 2
+			})
+			require.Equal(t, []model.Fingerprint{1, 3}, iterated)
+
+			require.True(t, p.remove(3))
+			require.False(t, p.remove(3))
+			require.Equal(t, []model.Fingerprint{1, 5, 1 << 63}, p.appendTo(nil))
+		})
+	}
+}
+
+func Test_SlicePostingsSingleton(t *testing.T) {
+	for _, tt := range []struct {
+		fps      []model.Fingerprint
+		expected []model.Fingerprint
+	}{
+		{[]model.Fingerprint{2}, []model.Fingerprint{2}},
+		{[]model.Fingerprint{2, 2}, []model.Fingerprint{2}},
+		{[]model.Fingerprint{2, 3}, []model.Fingerprint{2, 3}},
+		{[]model.Fingerprint{2, 1}, []model.Fingerprint{1, 2}},
+		{[]model.Fingerprint{2, 1, 1, 3}, []model.Fingerprint{1, 2, 3}},
+	} {
+		p := &slicePostings{}
+		for _, fp := range tt.fps {
+			p.add(fp)
+		}
+		require.Equal(t, tt.expected, p.fps)
+	}
+}
+
+func Test_BitmapPostingsIndex(t *testing.T) {
+	for _, opts := range []IndexOptions{{}, {EmptyMatchMeansAbsent: true}} {
+		slices := NewWithOptions(4, opts)
+		opts.BitmapPostings = true
+		bitmaps := NewWithOptions(4, opts)
+		for i := 0; i < 100; i++ {
+			lbs := []*commonv1.LabelPair{
+				{Name: "env", Value: fmt.Sprint("env-", i%2)},
+				{Name: "pod", Value: fmt.Sprint("pod-", i)},
+			}
+			switch i % 10 {
+			case 5:
+				lbs = lbs[:1]
+			case 7:
+				lbs[1].Value = ""
+			}
+			slices.Add(lbs, model.Fingerprint(i))
+			bitmaps.Add(lbs, model.Fingerprint(i))
+			if i%3 == 0 {
+				slices.Delete(lbs, model.Fingerprint(i))
+				bitmaps.Delete(lbs, model.Fingerprint(i))
+			}
+		}
+		require.NoError(t, bitmaps.Validate())
+
+		for _, matchers := range [][]*labels.Matcher{
+			nil,
+			{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")},
+			{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0"), labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")},
+			{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+			{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1|pod-2|pod-4"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")},
+			{labels.MustNewMatcher(labels.MatchNotEqual, "pod", "pod-2"), labels.MustNewMatcher(labels.MatchNotRegexp, "env", "env-1")},
+			{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".+")},
+			{labels.MustNewMatcher(labels.MatchRegexp, "pod", ".*"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+			{labels.MustNewMatcher(labels.MatchEqual, "pod", "")},
+			{labels.MustNewMatcher(labels.MatchEqual, "missing", "a")},
+			{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+		} {
+			expected, err := slices.Lookup(matchers, nil)
+			require.NoError(t, err)
+			actual, err := bitmaps.Lookup(matchers, nil)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual, "%v", matchers)
+		}
+	}
+}
+
+func Test_ImmutablePostings(t *testing.T) {
+	p := newImmutablePostings()
+	p.add(1)
+	p.add(3)
+	snapshot := p.snapshot()
+	p.add(2)
+	p.remove(3)
+	require.Equal(t, []model.Fingerprint{1, 3}, snapshot)
+	require.Equal(t, []model.Fingerprint{1, 2}, p.snapshot())
+
+	slices := NewWithShards(4)
+	immutable := NewWithOptions(4, IndexOptions{ImmutablePostings: true})
+	for i := 0; i < 100; i++ {
+		lbs := []*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%2)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}
+		slices.Add(lbs, model.Fingerprint(i))
+		immutable.Add(lbs, model.Fingerprint(i))
+		if i%3 == 0 {
+			slices.Delete(lbs, model.Fingerprint(i))
+			immutable.Delete(lbs, model.Fingerprint(i))
+		}
+	}
+	require.NoError(t, immutable.Validate())
+
+	for _, matchers := range [][]*labels.Matcher{
+		nil,
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0")},
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "none")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "^(?:pod-1|pod-2|pod-3)$")},
+		{labels.MustNewMatcher(labels.MatchEqual, "env", "env-0"), labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*")},
+		{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1.*"), labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")},
+	} {
+		expected, err := slices.Lookup(matchers, nil)
+		require.NoError(t, err)
+		actual, err := immutable.Lookup(matchers, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	// results never alias the postings
+	fps, err := immutable.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "pod", "pod-1")}, nil)
+	require.NoError(t, err)
+	fps[0] = 42
+	require.NoError(t, immutable.Validate())
+}
+
+// Test_PostingsRandomOps checks all implementations against the slice one,
+// with enough fingerprints to split delta blocks.
+func Test_PostingsRandomOps(t *testing.T) {
+	for name, newPostings := range postingsImplementations {
+		t.Run(name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			expected, p := &slicePostings{}, newPostings()
+			for i := 0; i < 5000; i++ {
+				// a small universe so that removals hit
+				fp := model.Fingerprint(rnd.Intn(2000)) * 1e12
+				if rnd.Intn(3) == 0 {
+					require.Equal(t, expected.remove(fp), p.remove(fp))
+				} else {
+					expected.add(fp)
+					p.add(fp)
+				}
+				require.Equal(t, expected.contains(fp), p.contains(fp))
+			}
+			require.Equal(t, expected.len(), p.len())
+			require.Equal(t, expected.appendTo(nil), p.appendTo(nil))
+
+			other := make([]model.Fingerprint, 0, 500)
+			for i := 0; i < 500; i++ {
+				other = append(other, model.Fingerprint(i*4)*1e12)
+			}
+			require.Equal(t, expected.intersect(other), p.intersect(other))
+		})
+	}
+}
+
+// BenchmarkPostings compares the postings implementations.
+// Fingerprints are random hashes, as they are in practice.
+func BenchmarkPostings(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		fps := make([]model.Fingerprint, size)
+		for i := range fps {
+			fps[i] = model.Fingerprint(rand.Uint64())
+		}
+		// a selective list to intersect with, half of it matching.
+		other := make([]model.Fingerprint, 0, 20)
+		for i := 0; i < 10; i++ {
+			other = append(other, fps[rand.Intn(size)], model.Fingerprint(rand.Uint64()))
+		}
+		sort.Sort(model.Fingerprints(other))
+
+		for name, newPostings := range postingsImplementations {
+			p := newPostings()
+			for _, fp := range fps {
+				p.add(fp)
+			}
+			b.Run(fmt.Sprintf("%s/size=%d/add-remove", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					fp := fps[n%size]
+					p.remove(fp)
+					p.add(fp)
+				}
+			})
+			b.Run(fmt.Sprintf("%s/size=%d/contains", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					p.contains(fps[n%size])
+				}
+			})
+			b.Run(fmt.Sprintf("%s/size=%d/intersect", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					p.intersect(other)
+				}
+			})
+			b.Run(fmt.Sprintf("%s/size=%d/union", name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					union(p.appendTo(nil), other)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkPostingsMemory reports the heap size per fingerprint of each
+// postings implementation, for random fingerprints as well as dense ones.
+func BenchmarkPostingsMemory(b *testing.B) {
+	const size = 20000
+	for _, dense := range []bool{false, true} {
+		fps := make([]model.Fingerprint, size)
+		for i := range fps {
+			if dense {
+				fps[i] = model.Fingerprint(i * 100)
+			} else {
+				fps[i] = model.Fingerprint(rand.Uint64())
+			}
+		}
+		for name, newPostings := range postingsImplementations {
+			b.Run(fmt.Sprintf("%s/dense=%v", name, dense), func(b *testing.B) {
+				var before, after runtime.MemStats
+				var p postings
+				for n := 0; n < b.N; n++ {
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					p = newPostings()
+					for _, fp := range fps {
+						p.add(fp)
+					}
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+				}
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/size, "bytes/fp")
+				runtime.KeepAlive(p)
+			})
+		}
+	}
+}
+
+// BenchmarkSinglePostings adds fingerprints to empty and singleton postings,
+// as for high cardinality labels whose values are carried by a single series.
+func BenchmarkSinglePostings(b *testing.B) {
+	fps := make([]model.Fingerprint, 1024)
+	for i := range fps {
+		fps[i] = model.Fingerprint(rand.Uint64())
+	}
+	buf := make([]model.Fingerprint, 2)
+	b.Run("empty", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			p := slicePostings{fps: buf[:0]}
+			p.add(fps[n%len(fps)])
+		}
+	})
+	b.Run("singleton", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			p := slicePostings{fps: buf[:1]}
+			p.fps[0] = fps[n%len(fps)]
+			p.add(fps[(n+1)%len(fps)])
+			// adding again is a no-op
+			p.add(p.fps[0])
+		}
+	})
+}
@@ -0,0 +1,180 @@
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// PromQuerier exposes the series labels of an index as a Prometheus
+// storage.Querier. The index holds no samples: the series selected have
+// empty sample iterators and the time ranges of the hints are ignored.
+// Pairs with an empty value are treated as absent, as in Prometheus.
+type PromQuerier struct {
+	index *InvertedIndex
+	shard *shard.Annotation
+}
+
+var _ storage.Querier = (*PromQuerier)(nil)
+
+// NewPromQuerier returns a querier over the given shard of the index, or
+// over all of it if shard is nil. Closing the querier doesn't close the
+// index.
+func NewPromQuerier(index *InvertedIndex, shard *shard.Annotation) *PromQuerier {
+	return &PromQuerier{index: index, shard: shard}
+}
+
+// Select returns the series matching all the matchers, ordered by
+// fingerprint unless sortSeries is set.
+func (q *PromQuerier) Select(sortSeries bool, _ *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	series, err := q.index.SeriesAsPromLabels(matchers, q.shard)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	if sortSeries {
+		sort.Slice(series, func(i, j int) bool {
+			return labels.Compare(series[i], series[j]) < 0
+		})
+	}
+	return &promSeriesSet{series: series, cur: -1}
+}
+
+// LabelValues returns the sorted values of the given label name, restricted
+// to the series matching all the matchers if any.
+func (q *PromQuerier) LabelValues(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	if len(matchers) == 0 {
+		values, err := q.index.LabelValues(name, q.shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := values[:0]
+		for _, v := range values {
+			if v != "" {
+				result = append(result, v)
+			}
+		}
+		return result, nil, nil
+	}
+	series, err := q.index.SeriesAsPromLabels(matchers, q.shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	return distinctSorted(series, func(ls labels.Labels, add func(string)) {
+		if v := ls.Get(name); v != "" {
+			add(v)
+		}
+	}), nil, nil
+}
+
+// LabelNames returns the sorted label names, restricted to the series
+// matching all the matchers if any.
+func (q *PromQuerier) LabelNames(matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	if len(matchers) == 0 {
+		names, err := q.index.LabelNames(q.shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := names[:0]
+		for _, name := range names {
+			values, err := q.index.LabelValues(name, q.shard)
+			if err != nil {
+				return nil, nil, err
+			}
+			// values are sorted: skip the names only stored with an empty value
+			if len(values) > 0 && values[len(values)-1] != "" {
+				result = append(result, name)
+			}
+		}
+		return result, nil, nil
+	}
+	series, err := q.index.SeriesAsPromLabels(matchers, q.shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	return distinctSorted(series, func(ls labels.Labels, add func(string)) {
+		for _, l := range ls {
+			add(l.Name)
+		}
+	}), nil, nil
+}
+
+// Close is a no-op.
+func (q *PromQuerier) Close() error {
+	return nil
+}
+
+// distinctSorted returns the sorted distinct strings extracted from series.
+func distinctSorted(series []labels.Labels, extract func(labels.Labels, func(string))) []string {
+	seen := map[string]struct{}{}
+	for _, ls := range series {
+		extract(ls, func(s string) {
+			seen[s] = struct{}{}
+		})
+	}
+	result := make([]string, 0, len(seen))
+	for s := range seen {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// SelectSeriesSet returns the series matching all the matchers as a
+// Prometheus storage.SeriesSet ordered by fingerprint, for use as the
+// series discovery half of a Prometheus storage. The series have empty
+// sample iterators, and their labels are only converted to Prometheus
+// labels as the set is iterated.
+func (ii *InvertedIndex) SelectSeriesSet(matchers []*labels.Matcher, shard *shard.Annotation) (storage.SeriesSet, error) {
+	series, err := ii.series([][]*labels.Matcher{matchers}, shard)
+	if err != nil {
+		return nil, err
+	}
+	return &lazySeriesSet{series: series, cur: -1}, nil
+}
+
+// lazySeriesSet iterates over series without samples, converting their
+// labels on access.
+type lazySeriesSet struct {
+	series []fingerprintLabels
+	cur    int
+}
+
+func (s *lazySeriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *lazySeriesSet) At() storage.Series {
+	return &storage.SeriesEntry{
+		Lset:             toPromLabels(s.series[s.cur].labels),
+		SampleIteratorFn: chunkenc.NewNopIterator,
+	}
+}
+
+func (s *lazySeriesSet) Err() error                 { return nil }
+func (s *lazySeriesSet) Warnings() storage.Warnings { return nil }
+
+// promSeriesSet iterates over series without samples.
+type promSeriesSet struct {
+	series []labels.Labels
+	cur    int
+}
+
+func (s *promSeriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *promSeriesSet) At() storage.Series {
+	return &storage.SeriesEntry{
+		Lset:             s.series[s.cur],
+		SampleIteratorFn: chunkenc.NewNopIterator,
+	}
+}
+
+func (s *promSeriesSet) Err() error                 { return nil }
+func (s *promSeriesSet) Warnings() storage.Warnings { return nil }
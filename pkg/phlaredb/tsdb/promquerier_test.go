@@ -0,0 +1,84 @@
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_PromQuerier(t *testing.T) {
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "prod", "pod", "b"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "dev", "pod", "a"), 2)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "mem", "env", "prod", "zone", ""), 3)
+
+	var q storage.Querier = NewPromQuerier(ii, nil)
+	defer func() { require.NoError(t, q.Close()) }()
+
+	set := q.Select(true, &storage.SelectHints{Start: 0, End: 1000}, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu"))
+	var selected []labels.Labels
+	for set.Next() {
+		s := set.At()
+		selected = append(selected, s.Labels())
+		require.False(t, s.Iterator().Next())
+	}
+	require.NoError(t, set.Err())
+	require.Empty(t, set.Warnings())
+	require.Equal(t, []labels.Labels{
+		labels.FromStrings("__name__", "cpu", "env", "dev", "pod", "a"),
+		labels.FromStrings("__name__", "cpu", "env", "prod", "pod", "b"),
+	}, selected)
+
+	names, _, err := q.LabelNames()
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "env", "pod"}, names)
+	names, _, err = q.LabelNames(labels.MustNewMatcher(labels.MatchEqual, "__name__", "mem"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"__name__", "env"}, names)
+
+	values, _, err := q.LabelValues("zone")
+	require.NoError(t, err)
+	require.Empty(t, values)
+	values, _, err = q.LabelValues("pod", labels.MustNewMatcher(labels.MatchEqual, "env", "dev"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, values)
+
+	set = NewPromQuerier(ii, &shard.Annotation{Shard: 0, Of: 3}).Select(false, nil)
+	require.False(t, set.Next())
+	require.ErrorIs(t, set.Err(), ErrInvalidShardQuery)
+}
+
+func Test_SelectSeriesSet(t *testing.T) {
+	ii := NewWithShards(4)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "prod", "pod", "b"), 1)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "cpu", "env", "dev", "pod", "a"), 2)
+	ii.Add(phlaremodel.LabelsFromStrings("__name__", "mem", "env", "prod"), 3)
+
+	set, err := ii.SelectSeriesSet([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}, nil)
+	require.NoError(t, err)
+	var selected []labels.Labels
+	for set.Next() {
+		s := set.At()
+		selected = append(selected, s.Labels())
+		require.False(t, s.Iterator().Next())
+	}
+	require.NoError(t, set.Err())
+	require.Empty(t, set.Warnings())
+	// ordered by fingerprint
+	require.Equal(t, []labels.Labels{
+		labels.FromStrings("__name__", "cpu", "env", "prod", "pod", "b"),
+		labels.FromStrings("__name__", "mem", "env", "prod"),
+	}, selected)
+
+	set, err = ii.SelectSeriesSet([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "staging")}, nil)
+	require.NoError(t, err)
+	require.False(t, set.Next())
+
+	_, err = ii.SelectSeriesSet(nil, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
@@ -0,0 +1,122 @@
+package tsdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// Test_ConcurrentReadWrite hammers writes and reads of all shards
+// concurrently. It is mostly useful with -race, and checks that the index
+// is consistent once the writers are done.
+func Test_ConcurrentReadWrite(t *testing.T) {
+	for name, opts := range map[string]IndexOptions{
+		"default":   {},
+		"pooled":    {PoolPostings: true, SortedValues: true, SetMatchesCacheSize: 8},
+		"bitmap":    {BitmapPostings: true, TrackLastWrite: true},
+		"immutable": {ImmutablePostings: true, EmptyMatchMeansAbsent: true},
+		"delta":     {DeltaPostings: true, CacheLabelValues: true},
+		"cached":    {LookupCacheSize: 16, LookupCacheTTL: time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ii := NewWithOptions(8, opts)
+			series := func(writer, i int) phlaremodel.Labels {
+				return phlaremodel.LabelsFromStrings(
+					"env", fmt.Sprint("env-", i%3),
+					"pod", fmt.Sprintf("pod-%d-%d", writer, i),
+				)
+			}
+			const writers, seriesPerWriter = 4, 200
+
+			var wg sync.WaitGroup
+			done := make(chan struct{})
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < seriesPerWriter; i++ {
+						fp := model.Fingerprint(w*seriesPerWriter + i)
+						ii.Add(series(w, i), fp)
+						// delete every other series shortly after adding it
+						if i%2 == 1 {
+							ii.Delete(series(w, i-1), fp-1)
+						}
+					}
+				}(w)
+			}
+
+			var readers sync.WaitGroup
+			for _, read := range []func(){
+				func() {
+					_, _ = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")}, nil)
+				},
+				func() {
+					_, _ = ii.Lookup([]*labels.Matcher{
+						labels.MustNewMatcher(labels.MatchRegexp, "env", "^(?:env-0|env-2)$"),
+						labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-1-.*"),
+					}, &shard.Annotation{Shard: 1, Of: 2})
+				},
+				func() { _, _ = ii.Lookup(nil, nil) },
+				func() { _, _ = ii.LabelValues("pod", nil) },
+				func() {
+					_, _ = ii.MatchSeries([][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchEqual, "pod", "")}}, nil)
+				},
+				func() { _, _ = ii.LookupNumericRange("env", 0, 1, nil) },
+				func() { ii.Compact() },
+			} {
+				readers.Add(1)
+				go func(read func()) {
+					defer readers.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+							read()
+						}
+					}
+				}(read)
+			}
+
+			wg.Wait()
+			close(done)
+			readers.Wait()
+
+			require.NoError(t, ii.Validate())
+			fps, err := ii.Lookup(nil, nil)
+			require.NoError(t, err)
+			require.Len(t, fps, writers*seriesPerWriter/2)
+			for _, fp := range fps {
+				require.Equal(t, model.Fingerprint(1), fp%2)
+			}
+
+			// purging and dropping labels while reading
+			done = make(chan struct{})
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						_, _ = ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")}, nil)
+					}
+				}
+			}()
+			ii.DropLabel("pod")
+			ii.PurgeOlderThan(time.Now().Add(time.Hour))
+			close(done)
+			readers.Wait()
+			require.NoError(t, ii.Validate())
+		})
+	}
+}
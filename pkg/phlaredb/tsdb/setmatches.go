@@ -0,0 +1,38 @@
+package tsdb
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// setMatchesCache memoizes FindSetMatches across lookups, as the same regex
+// matchers tend to recur, e.g. the fixed selectors of a dashboard. A nil
+// cache computes the set matches on every call.
+type setMatchesCache struct {
+	cache *lru.Cache
+}
+
+func newSetMatchesCache(size int) *setMatchesCache {
+	if size <= 0 {
+		return nil
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		// only returned for a non-positive size
+		panic(err)
+	}
+	return &setMatchesCache{cache: cache}
+}
+
+// get returns FindSetMatches(pattern). Patterns which aren't a set are
+// cached too, as a nil slice.
+func (c *setMatchesCache) get(pattern string) []string {
+	if c == nil {
+		return FindSetMatches(pattern)
+	}
+	if set, ok := c.cache.Get(pattern); ok {
+		return set.([]string)
+	}
+	set := FindSetMatches(pattern)
+	c.cache.Add(pattern, set)
+	return set
+}
@@ -0,0 +1,209 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// SetPostings installs fps as the postings of the label name=value in the
+// given shard, replacing the ones of the pair if any. Unlike adding the
+// series one at a time, building the postings from a sorted deduped slice
+// is linear: fps is sorted and deduped defensively otherwise, and never
+// retained. The stored labels of the fingerprints gain or lose the pair
+// accordingly, fingerprints new to the shard being added as series with
+// this single label, and series left without postings are evicted. It
+// fails with ErrDuplicateLabelName, without modifying the index, if one of
+// the fingerprints already carries another value for name, and with
+// ErrTooManyLabelValues if the value is new to a name already holding
+// IndexOptions.MaxValuesPerLabel values in the shard.
+// As for AddToShard, callers must keep the routing of their series
+// consistent with Add.
+func (ii *InvertedIndex) SetPostings(shardIndex uint32, name, value string, fps []model.Fingerprint) error {
+	if ii.closed.Load() {
+		return ErrClosed
+	}
+	if shardIndex >= ii.totalShards {
+		return fmt.Errorf("%w: shard %d of %d", ErrShardOutOfRange, shardIndex, ii.totalShards)
+	}
+	if ii.opts.ValueNormalizer != nil {
+		value = ii.opts.ValueNormalizer(name, value)
+	}
+	evicted, err := ii.shards[shardIndex].setPostings(name, value, sortedFingerprints(fps))
+	if err != nil {
+		return err
+	}
+	if ii.opts.OnEvict != nil {
+		for _, s := range evicted {
+			ii.opts.OnEvict(s.fp, s.labels)
+		}
+	}
+	return nil
+}
+
+// sortedFingerprints returns a sorted deduped copy of fps.
+func sortedFingerprints(fps []model.Fingerprint) []model.Fingerprint {
+	result := append([]model.Fingerprint(nil), fps...)
+	for i := 1; i < len(result); i++ {
+		if result[i-1] >= result[i] {
+			sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+			return dedupeSortedFingerprints(result)
+		}
+	}
+	return result
+}
+
+func dedupeSortedFingerprints(fps []model.Fingerprint) []model.Fingerprint {
+	j := 0
+	for i := range fps {
+		if j > 0 && fps[j-1] == fps[i] {
+			continue
+		}
+		fps[j] = fps[i]
+		j++
+	}
+	return fps[:j]
+}
+
+func (shard *indexShard) setPostings(name, value string, fps []model.Fingerprint) ([]fingerprintLabels, error) {
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+
+	for _, fp := range fps {
+		for _, l := range shard.series[fp] {
+			if l.Name == name && l.Value != value {
+				return nil, fmt.Errorf("%w: fingerprint %v already has %s=%q", ErrDuplicateLabelName, fp, name, l.Value)
+			}
+		}
+	}
+	values, ok := shard.idx[name]
+	if ok && len(fps) > 0 && shard.maxValuesPerLabel > 0 && len(values.fps) >= shard.maxValuesPerLabel {
+		if _, ok := values.fps[value]; !ok {
+			return nil, fmt.Errorf("%w: %s already has %d values", ErrTooManyLabelValues, name, len(values.fps))
+		}
+	}
+	shard.generations.bump([]*commonv1.LabelPair{{Name: name, Value: value}})
+
+	if !ok {
+		if len(fps) == 0 {
+			return nil, nil
+		}
+		values = indexEntry{
+			name: copyString(name),
+			fps:  map[string]indexValueEntry{},
+		}
+		if shard.sortedValues {
+			values.sorted = &sortedValues{}
+		}
+		if shard.cacheValues {
+			values.cache = &labelValuesCache{}
+		}
+		shard.idx[values.name] = values
+		shard.insertName(values.name)
+	}
+	entry, ok := values.fps[value]
+	if !ok {
+		if len(fps) == 0 {
+			return nil, nil
+		}
+		entry = indexValueEntry{value: copyString(value)}
+		if values.sorted != nil {
+			values.sorted.insert(entry.value)
+		}
+		values.cache.invalidate()
+	}
+	var old []model.Fingerprint
+	if entry.fps != nil {
+		old = entry.fps.appendTo(nil)
+	}
+
+	// walk both sorted lists to update the stored labels of the
+	// fingerprints leaving and joining the postings
+	var evicted []fingerprintLabels
+	pair := &commonv1.LabelPair{Name: values.name, Value: entry.value}
+	for i, j := 0, 0; i < len(old) || j < len(fps); {
+		switch {
+		case j == len(fps) || (i < len(old) && old[i] < fps[j]):
+			stored := shard.series[old[i]]
+			shard.dropSeriesLabel(old[i], name)
+			if _, ok := shard.refs[old[i]]; !ok {
+				evicted = append(evicted, fingerprintLabels{fp: old[i], labels: stored})
+			}
+			i++
+		case i == len(old) || fps[j] < old[i]:
+			shard.addSeriesLabel(fps[j], pair)
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+
+	if entry.fps != nil {
+		shard.releasePostings(entry.fps)
+	}
+	if len(fps) == 0 {
+		delete(values.fps, value)
+		values.sorted.remove(value)
+		values.cache.invalidate()
+		if len(values.fps) == 0 {
+			shard.deleteName(name)
+		}
+		return evicted, nil
+	}
+	shard.pairs.add(values.name, entry.value)
+	entry.fps = shard.postingsFrom(fps)
+	if shard.trackLastWrite {
+		entry.lastWrite = time.Now().UnixNano()
+	}
+	values.fps[entry.value] = entry
+	return evicted, nil
+}
+
+// addSeriesLabel adds the label pair to the stored labels of fp, once fp
+// was added to the postings of the pair, adding fp to the shard if needed.
+// As for dropSeriesLabel, the stored slice is replaced rather than
+// modified. Must be called under the write lock.
+func (shard *indexShard) addSeriesLabel(fp model.Fingerprint, pair *commonv1.LabelPair) {
+	shard.refs[fp]++
+	lbs := shard.series[fp]
+	j := sort.Search(len(lbs), func(i int) bool { return lbs[i].Name >= pair.Name })
+	result := make(phlaremodel.Labels, 0, len(lbs)+1)
+	result = append(result, lbs[:j]...)
+	result = append(result, pair)
+	shard.series[fp] = append(result, lbs[j:]...)
+}
+
+// postingsFrom returns postings of the shard's implementation holding the
+// sorted deduped fps, which it may retain.
+func (shard *indexShard) postingsFrom(fps []model.Fingerprint) postings {
+	switch {
+	case shard.bitmapPostings:
+		p := newBitmapPostings()
+		for _, fp := range fps {
+			p.add(fp)
+		}
+		return p
+	case shard.immutablePostings:
+		p := &immutablePostings{}
+		p.v.Store(fps)
+		return p
+	case shard.deltaPostings:
+		p := &deltaPostings{n: len(fps)}
+		for len(fps) > 0 {
+			n := deltaPostingsBlockSize
+			if n > len(fps) {
+				n = len(fps)
+			}
+			p.blocks = append(p.blocks, encodeDeltaBlock(fps[:n]))
+			fps = fps[n:]
+		}
+		return p
+	}
+	return &slicePostings{fps: fps}
+}
@@ -0,0 +1,110 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+func Test_SetPostings(t *testing.T) {
+	for _, opts := range []IndexOptions{
+		{},
+		{BitmapPostings: true},
+		{ImmutablePostings: true},
+		{DeltaPostings: true},
+		{SortedValues: true, LookupCacheSize: 16},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			var evicted []model.Fingerprint
+			opts.OnEvict = func(fp model.Fingerprint, _ phlaremodel.Labels) {
+				evicted = append(evicted, fp)
+			}
+			ii := NewWithOptions(1, opts)
+			for i := 0; i < 10; i++ {
+				ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+			}
+			lookup := func(name, value string) []model.Fingerprint {
+				fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, name, value)}, nil)
+				require.NoError(t, err)
+				return fps
+			}
+			require.Len(t, lookup("team", "a"), 0)
+
+			// a new pair over existing series and new ones, unsorted with
+			// duplicates, spanning several delta blocks
+			fps := []model.Fingerprint{3, 1}
+			for fp := model.Fingerprint(1000); fp > 700; fp-- {
+				fps = append(fps, fp, fp)
+			}
+			require.NoError(t, ii.SetPostings(0, "team", "a", fps))
+			set := lookup("team", "a")
+			require.Len(t, set, 302)
+			require.Equal(t, []model.Fingerprint{1, 3, 701}, set[:3])
+			require.Equal(t, phlaremodel.LabelsFromStrings("env", "prod", "pod", "pod-3", "team", "a"), ii.shards[0].series[3])
+			require.Equal(t, phlaremodel.LabelsFromStrings("team", "a"), ii.shards[0].series[800])
+			require.NoError(t, ii.Validate())
+
+			// replacing drops the pair from the series leaving the postings
+			require.NoError(t, ii.SetPostings(0, "team", "a", []model.Fingerprint{3, 4, 1000}))
+			require.Equal(t, []model.Fingerprint{3, 4, 1000}, lookup("team", "a"))
+			require.Equal(t, phlaremodel.LabelsFromStrings("env", "prod", "pod", "pod-1"), ii.shards[0].series[1])
+			require.Len(t, evicted, 299)
+			require.False(t, ii.Exists(800))
+			require.NoError(t, ii.Validate())
+
+			// a series has a single value per name
+			err := ii.SetPostings(0, "env", "dev", []model.Fingerprint{0, 5})
+			require.ErrorIs(t, err, ErrDuplicateLabelName)
+			require.Empty(t, lookup("env", "dev"))
+			require.NoError(t, ii.Validate())
+
+			// empty postings remove the pair
+			require.NoError(t, ii.SetPostings(0, "team", "a", nil))
+			require.Empty(t, lookup("team", "a"))
+			names, err := ii.LabelNames(nil)
+			require.NoError(t, err)
+			require.Equal(t, []string{"env", "pod"}, names)
+			require.Len(t, evicted, 300)
+			require.NoError(t, ii.Validate())
+
+			require.ErrorIs(t, ii.SetPostings(1, "team", "a", nil), ErrShardOutOfRange)
+			require.NoError(t, ii.Close())
+			require.ErrorIs(t, ii.SetPostings(0, "team", "a", nil), ErrClosed)
+		})
+	}
+}
+
+func Test_SetPostingsMaxValuesPerLabel(t *testing.T) {
+	ii := NewWithOptions(1, IndexOptions{MaxValuesPerLabel: 2})
+	require.NoError(t, ii.SetPostings(0, "pod", "pod-0", []model.Fingerprint{0}))
+	require.NoError(t, ii.SetPostings(0, "pod", "pod-1", []model.Fingerprint{1}))
+
+	err := ii.SetPostings(0, "pod", "pod-2", []model.Fingerprint{2})
+	require.ErrorIs(t, err, ErrTooManyLabelValues)
+	values, err := ii.LabelValues("pod", nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"pod-0", "pod-1"}, values)
+	require.False(t, ii.Exists(2))
+	require.NoError(t, ii.Validate())
+
+	// existing values can still be replaced or removed, and other names are
+	// capped separately
+	require.NoError(t, ii.SetPostings(0, "pod", "pod-1", []model.Fingerprint{1, 2}))
+	require.NoError(t, ii.SetPostings(0, "pod", "pod-0", nil))
+	require.NoError(t, ii.SetPostings(0, "pod", "pod-2", []model.Fingerprint{3}))
+	require.NoError(t, ii.SetPostings(0, "env", "prod", []model.Fingerprint{1, 2, 3}))
+	require.NoError(t, ii.Validate())
+}
+
+func Test_SortedFingerprints(t *testing.T) {
+	in := []model.Fingerprint{3, 1, 3, 2, 1}
+	require.Equal(t, []model.Fingerprint{1, 2, 3}, sortedFingerprints(in))
+	require.Equal(t, []model.Fingerprint{3, 1, 3, 2, 1}, in)
+	require.Equal(t, []model.Fingerprint{1, 2}, sortedFingerprints([]model.Fingerprint{1, 2}))
+	require.Empty(t, sortedFingerprints(nil))
+}
@@ -0,0 +1,97 @@
+package tsdb
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// ShardReader gives read-only access to a single shard of an index, see
+// ForEachShard. It is only valid during the call it was passed to.
+type ShardReader interface {
+	// LabelNames returns the sorted label names of the shard.
+	LabelNames() []string
+	// LabelValues returns the sorted values of the given label name.
+	LabelValues(name string) []string
+	// PostingsLen returns the number of series carrying the label pair.
+	PostingsLen(name, value string) int
+	// VisitPostings calls visit for the fingerprints of the series carrying
+	// the label pair in ascending order, until visit returns false.
+	VisitPostings(name, value string, visit func(model.Fingerprint) bool)
+	// SeriesLabels returns the labels fp was added with, if it is part of
+	// the shard. They must not be modified.
+	SeriesLabels(fp model.Fingerprint) (phlaremodel.Labels, bool)
+}
+
+// ForEachShard calls fn for each shard selected by the annotation, holding
+// the read lock of that shard for the duration of fn. It stops and returns
+// the first error returned by fn. fn must not use the index, as writes
+// waiting for the lock would deadlock it.
+func (ii *InvertedIndex) ForEachShard(shard *shard.Annotation, fn func(shardIndex uint32, r ShardReader) error) error {
+	if err := ii.validateShard(shard); err != nil {
+		return err
+	}
+	for _, s := range ii.getShards(shard) {
+		if err := s.read(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (shard *indexShard) read(fn func(shardIndex uint32, r ShardReader) error) error {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	return fn(shard.shard, shardReader{shard: shard})
+}
+
+// shardReader implements ShardReader, its shard is read locked by
+// indexShard.read.
+type shardReader struct {
+	shard *indexShard
+}
+
+func (r shardReader) LabelNames() []string {
+	return append([]string(nil), r.shard.names...)
+}
+
+func (r shardReader) LabelValues(name string) []string {
+	values, ok := r.shard.idx[name]
+	if !ok {
+		return nil
+	}
+	if values.sorted != nil {
+		return append([]string(nil), values.sorted.values...)
+	}
+	if values.cache != nil {
+		return append([]string(nil), values.cache.get(values)...)
+	}
+	results := make([]string, 0, len(values.fps))
+	for val := range values.fps {
+		results = append(results, val)
+	}
+	sort.Strings(results)
+	return results
+}
+
+func (r shardReader) PostingsLen(name, value string) int {
+	entry, ok := r.shard.idx[name].fps[value]
+	if !ok {
+		return 0
+	}
+	return entry.fps.len()
+}
+
+func (r shardReader) VisitPostings(name, value string, visit func(model.Fingerprint) bool) {
+	if entry, ok := r.shard.idx[name].fps[value]; ok {
+		entry.fps.iterate(visit)
+	}
+}
+
+func (r shardReader) SeriesLabels(fp model.Fingerprint) (phlaremodel.Labels, bool) {
+	lbs, ok := r.shard.series[fp]
+	return lbs, ok
+}
@@ -0,0 +1,62 @@
+package tsdb
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_ForEachShard(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 100; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("foo", "bar", "i", strconv.Itoa(i)), model.Fingerprint(i))
+	}
+
+	var visited []uint32
+	total := 0
+	err := ii.ForEachShard(&shard.Annotation{Shard: 1, Of: 2}, func(shardIndex uint32, r ShardReader) error {
+		visited = append(visited, shardIndex)
+		require.Equal(t, []string{"foo", "i"}, r.LabelNames())
+		require.Equal(t, []string{"bar"}, r.LabelValues("foo"))
+		require.Empty(t, r.LabelValues("unknown"))
+
+		n := 0
+		r.VisitPostings("foo", "bar", func(fp model.Fingerprint) bool {
+			lbs, ok := r.SeriesLabels(fp)
+			require.True(t, ok)
+			require.Equal(t, "bar", lbs.Get("foo"))
+			n++
+			return true
+		})
+		require.Equal(t, r.PostingsLen("foo", "bar"), n)
+		total += n
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1, 3}, visited)
+
+	fps, err := ii.Lookup(nil, &shard.Annotation{Shard: 1, Of: 2})
+	require.NoError(t, err)
+	require.Equal(t, len(fps), total)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = ii.ForEachShard(nil, func(uint32, ShardReader) error {
+		calls++
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 1, calls)
+
+	err = ii.ForEachShard(&shard.Annotation{Shard: 1, Of: 8}, func(uint32, ShardReader) error {
+		t.Fatal("unexpected call")
+		return nil
+	})
+	require.ErrorIs(t, err, ErrShardTooLarge)
+}
@@ -0,0 +1,98 @@
+package tsdb
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortedValues keeps the values of a label name sorted, for prefix and
+// numeric range scans in logarithmic time rather than scanning the values
+// map. Inserting or removing a value shifts the slices, which is linear but
+// only happens for new or emptied values, not for every add or delete.
+// It relies on the shard lock like the postings.
+type sortedValues struct {
+	values []string
+	// numeric holds the values parsing as numbers, in ascending order.
+	numeric []numericValue
+}
+
+type numericValue struct {
+	number float64
+	value  string
+}
+
+func (s *sortedValues) insert(value string) {
+	j := sort.SearchStrings(s.values, value)
+	if j < len(s.values) && s.values[j] == value {
+		return
+	}
+	s.values = append(s.values, "")
+	copy(s.values[j+1:], s.values[j:])
+	s.values[j] = value
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) {
+		return
+	}
+	n := s.searchNumeric(number, value)
+	s.numeric = append(s.numeric, numericValue{})
+	copy(s.numeric[n+1:], s.numeric[n:])
+	s.numeric[n] = numericValue{number: number, value: value}
+}
+
+// remove deletes value, it is a no-op on a nil receiver.
+func (s *sortedValues) remove(value string) {
+	if s == nil {
+		return
+	}
+	j := sort.SearchStrings(s.values, value)
+	if j >= len(s.values) || s.values[j] != value {
+		return
+	}
+	s.values = s.values[:j+copy(s.values[j:], s.values[j+1:])]
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) {
+		return
+	}
+	n := s.searchNumeric(number, value)
+	if n < len(s.numeric) && s.numeric[n].value == value {
+		s.numeric = s.numeric[:n+copy(s.numeric[n:], s.numeric[n+1:])]
+	}
+}
+
+// searchNumeric returns the position of the given value in numeric,
+// ordered by number then value.
+func (s *sortedValues) searchNumeric(number float64, value string) int {
+	return sort.Search(len(s.numeric), func(i int) bool {
+		v := s.numeric[i]
+		return v.number > number || (v.number == number && v.value >= value)
+	})
+}
+
+// withPrefix returns the sorted values starting with prefix. The result
+// aliases the sorted values and must be copied before releasing the lock.
+func (s *sortedValues) withPrefix(prefix string) []string {
+	start := sort.SearchStrings(s.values, prefix)
+	end := start + sort.Search(len(s.values)-start, func(i int) bool {
+		return !strings.HasPrefix(s.values[start+i], prefix)
+	})
+	return s.values[start:end]
+}
+
+// inRange returns the numeric values within [min, max]. The result aliases
+// the sorted values and must not be used after releasing the lock.
+func (s *sortedValues) inRange(min, max float64) []numericValue {
+	start := sort.Search(len(s.numeric), func(i int) bool {
+		return s.numeric[i].number >= min
+	})
+	end := sort.Search(len(s.numeric), func(i int) bool {
+		return s.numeric[i].number > max
+	})
+	if end < start {
+		return nil
+	}
+	return s.numeric[start:end]
+}
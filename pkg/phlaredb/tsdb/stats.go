@@ -0,0 +1,157 @@
+package tsdb
+
+import (
+	"sort"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// statsTopLabels is the number of label names reported in
+// IndexStats.TopLabels.
+const statsTopLabels = 5
+
+// IndexStats summarizes the contents of an index, see Stats.
+type IndexStats struct {
+	Series     uint64 `json:"series"`
+	LabelNames int    `json:"label_names"`
+	// Postings is the number of fingerprints over all the postings lists.
+	Postings uint64       `json:"postings"`
+	Shards   []ShardStats `json:"shards"`
+	// TopLabels are the label names with the most distinct values, from
+	// the highest to the lowest cardinality, as estimated by
+	// ApproxLabelNameCardinality.
+	TopLabels []LabelCardinality `json:"top_labels"`
+}
+
+// ShardStats is the number of series of a shard.
+type ShardStats struct {
+	Shard  uint32 `json:"shard"`
+	Series uint64 `json:"series"`
+}
+
+// LabelCardinality is the approximate number of distinct values of a label
+// name.
+type LabelCardinality struct {
+	Name        string `json:"name"`
+	Cardinality uint64 `json:"cardinality"`
+}
+
+// Stats returns the stats of the given shard of the index, or of all of it
+// if shard is nil. Each shard is visited once, under a single read lock.
+func (ii *InvertedIndex) Stats(shard *shard.Annotation) (IndexStats, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return IndexStats{}, err
+	}
+
+	var stats IndexStats
+	sketches := map[string]*hyperLogLog{}
+	for _, s := range ii.getShards(shard) {
+		series, postings := s.stats(sketches)
+		stats.Series += series
+		stats.Postings += postings
+		stats.Shards = append(stats.Shards, ShardStats{Shard: s.shard, Series: series})
+	}
+
+	stats.LabelNames = len(sketches)
+	stats.TopLabels = make([]LabelCardinality, 0, len(sketches))
+	for name, sketch := range sketches {
+		stats.TopLabels = append(stats.TopLabels, LabelCardinality{Name: name, Cardinality: sketch.estimate()})
+	}
+	sort.Slice(stats.TopLabels, func(i, j int) bool {
+		ci, cj := stats.TopLabels[i].Cardinality, stats.TopLabels[j].Cardinality
+		if ci != cj {
+			return ci > cj
+		}
+		return stats.TopLabels[i].Name < stats.TopLabels[j].Name
+	})
+	if len(stats.TopLabels) > statsTopLabels {
+		stats.TopLabels = stats.TopLabels[:statsTopLabels]
+	}
+	return stats, nil
+}
+
+// stats returns the number of series and postings of the shard, and inserts
+// its label values into the sketch of their name.
+func (shard *indexShard) stats(sketches map[string]*hyperLogLog) (series, postings uint64) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	for name, values := range shard.idx {
+		sketch, ok := sketches[name]
+		if !ok {
+			sketch = &hyperLogLog{}
+			sketches[values.name] = sketch
+		}
+		for value, entry := range values.fps {
+			sketch.insert(value)
+			postings += uint64(entry.fps.len())
+		}
+	}
+	return uint64(len(shard.series)), postings
+}
+
+// ShardMove is the estimated number of series of a shard which would be
+// routed to a given shard after resharding, see RebalancePlan.
+type ShardMove struct {
+	From   uint32 `json:"from"`
+	To     uint32 `json:"to"`
+	Series uint64 `json:"series"`
+}
+
+// RebalancePlan previews resharding the index to newTotalShards shards
+// without modifying it. It routes up to samples series of each shard as Add
+// would with newTotalShards shards, all of them if samples is not positive,
+// and extrapolates to the series count of the shard. Moves are sorted by
+// source then destination shard, and include the series whose shard index
+// stays the same. It fails with ErrInvalidShardCount unless newTotalShards
+// is within [1, MaxIndexShards].
+func (ii *InvertedIndex) RebalancePlan(newTotalShards uint32, samples int) ([]ShardMove, error) {
+	if err := validateShardCount(newTotalShards); err != nil {
+		return nil, err
+	}
+	var moves []ShardMove
+	for _, s := range ii.shards {
+		sampled, series := s.sampleSeries(samples)
+		if len(sampled) == 0 {
+			continue
+		}
+		counts := map[uint32]int{}
+		for _, lbs := range sampled {
+			counts[ii.hasher.hash(lbs)%newTotalShards]++
+		}
+		start := len(moves)
+		for to, n := range counts {
+			moves = append(moves, ShardMove{
+				From:   s.shard,
+				To:     to,
+				Series: uint64(float64(n)*float64(series)/float64(len(sampled)) + 0.5),
+			})
+		}
+		group := moves[start:]
+		sort.Slice(group, func(i, j int) bool { return group[i].To < group[j].To })
+	}
+	return moves, nil
+}
+
+// sampleSeries returns the labels of up to n series of the shard, all of
+// them if n is not positive, along with its number of series.
+func (shard *indexShard) sampleSeries(n int) ([]phlaremodel.Labels, int) {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	size := len(shard.series)
+	if n <= 0 || n > size {
+		n = size
+	}
+	// stored labels are replaced rather than modified, they can be used
+	// after releasing the lock
+	sampled := make([]phlaremodel.Labels, 0, n)
+	for _, lbs := range shard.series {
+		if len(sampled) == n {
+			break
+		}
+		sampled = append(sampled, lbs)
+	}
+	return sampled, size
+}
@@ -0,0 +1,103 @@
+package tsdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_Stats(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 40; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings(
+			"env", fmt.Sprint("env-", i%2),
+			"pod", fmt.Sprint("pod-", i),
+			"region", fmt.Sprint("region-", i%3),
+			"service", fmt.Sprint("svc-", i%10),
+			"team", fmt.Sprint("team-", i%4),
+			"zone", fmt.Sprint("zone-", i%6),
+		), model.Fingerprint(i))
+	}
+
+	stats, err := ii.Stats(nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), stats.Series)
+	require.Equal(t, 6, stats.LabelNames)
+	require.Equal(t, uint64(40*6), stats.Postings)
+	require.Len(t, stats.Shards, 4)
+	var total uint64
+	for i, s := range stats.Shards {
+		require.Equal(t, uint32(i), s.Shard)
+		total += s.Series
+	}
+	require.Equal(t, stats.Series, total)
+	require.Equal(t, []LabelCardinality{
+		{Name: "pod", Cardinality: 40},
+		{Name: "service", Cardinality: 10},
+		{Name: "zone", Cardinality: 6},
+		{Name: "team", Cardinality: 4},
+		{Name: "region", Cardinality: 3},
+	}, stats.TopLabels)
+
+	b, err := json.Marshal(stats)
+	require.NoError(t, err)
+	var decoded IndexStats
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, stats, decoded)
+
+	stats, err = ii.Stats(&shard.Annotation{Shard: 1, Of: 2})
+	require.NoError(t, err)
+	require.Len(t, stats.Shards, 2)
+	require.Equal(t, stats.Shards[0].Series+stats.Shards[1].Series, stats.Series)
+
+	_, err = ii.Stats(&shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_RebalancePlan(t *testing.T) {
+	ii := NewWithShards(8)
+	expected := map[[2]uint32]uint64{}
+	for i := 0; i < 1000; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", "prod", "pod", fmt.Sprint("pod-", i))
+		ii.Add(lbs, model.Fingerprint(i))
+		expected[[2]uint32{labelsSeriesIDHash(lbs) % 8, labelsSeriesIDHash(lbs) % 16}]++
+	}
+	stats, err := ii.Stats(nil)
+	require.NoError(t, err)
+
+	moves, err := ii.RebalancePlan(16, 0)
+	require.NoError(t, err)
+	require.Len(t, moves, len(expected))
+	for i, m := range moves {
+		require.Equal(t, expected[[2]uint32{m.From, m.To}], m.Series)
+		// doubling the shard count splits each shard in two
+		require.True(t, m.To == m.From || m.To == m.From+8)
+		if i > 0 {
+			prev := moves[i-1]
+			require.True(t, prev.From < m.From || (prev.From == m.From && prev.To < m.To))
+		}
+	}
+
+	// sampled plans are extrapolated to the shard sizes
+	moves, err = ii.RebalancePlan(16, 20)
+	require.NoError(t, err)
+	perShard := map[uint32]uint64{}
+	for _, m := range moves {
+		perShard[m.From] += m.Series
+	}
+	for _, s := range stats.Shards {
+		require.InDelta(t, s.Series, perShard[s.Shard], 1)
+	}
+
+	_, err = ii.RebalancePlan(0, 0)
+	require.ErrorIs(t, err, ErrInvalidShardCount)
+	moves, err = NewWithShards(4).RebalancePlan(8, 0)
+	require.NoError(t, err)
+	require.Empty(t, moves)
+}
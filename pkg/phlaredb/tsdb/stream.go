@@ -0,0 +1,119 @@
+package tsdb
+
+import (
+	"context"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+// SeriesResult is a single series yielded by StreamSeries.
+type SeriesResult struct {
+	Fingerprint model.Fingerprint
+	// Labels are interned by the index and must not be modified, unless
+	// they were transformed by IndexOptions.LabelEnricher.
+	Labels phlaremodel.Labels
+	Err    error
+}
+
+// streamBatchSize is the number of series whose labels a shard cursor of
+// StreamSeries resolves at a time.
+const streamBatchSize = 64
+
+// StreamSeries yields the series matching the provided matchers in
+// fingerprint order. The channel is unbuffered: the producer goroutine
+// blocks until each result is received and never runs ahead of the consumer.
+// The matchers are evaluated up front to order the series across shards,
+// but only the matching fingerprints are retained: the labels are resolved
+// shard by shard in small batches as results are received, skipping the
+// series deleted in the meantime.
+// Consumers stopping early cancel ctx and may stop receiving: the producer
+// then exits and closes the channel. A last result carrying the context
+// error is only delivered to a consumer already waiting on the channel,
+// others should check ctx.Err() once the channel is closed.
+func (ii *InvertedIndex) StreamSeries(ctx context.Context, matchers []*labels.Matcher, shard *shard.Annotation) (<-chan SeriesResult, error) {
+	if err := ii.validateShard(shard); err != nil {
+		return nil, err
+	}
+	if err := ii.checkMatchers(matchers); err != nil {
+		return nil, err
+	}
+	matchers = ii.normalizeMatchers(matchers)
+	shards := ii.getShards(shard)
+
+	ch := make(chan SeriesResult)
+	go func() {
+		defer close(ch)
+
+		cursors := make([]*seriesCursor, 0, len(shards))
+		for _, s := range shards {
+			if ctx.Err() != nil {
+				break
+			}
+			if fps := s.matchingFPs(matchers); len(fps) > 0 {
+				if ii.opts.DescendingPostings {
+					reverseFingerprints(fps)
+				}
+				cursors = append(cursors, &seriesCursor{shard: s, fps: fps})
+			}
+		}
+
+		// Fingerprints are distinct across shards, pick the first head
+		// of the shard cursors until they're all exhausted.
+	loop:
+		for ctx.Err() == nil {
+			var first *seriesCursor
+			for _, c := range cursors {
+				if c.fill() && (first == nil || ii.fingerprintsOrdered(c.batch[0].fp, first.batch[0].fp)) {
+					first = c
+				}
+			}
+			if first == nil {
+				break
+			}
+			next := first.batch[0]
+			first.batch = first.batch[1:]
+
+			select {
+			case ch <- SeriesResult{Fingerprint: next.fp, Labels: ii.enrich(next.labels)}:
+			case <-ctx.Done():
+				break loop
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			// never block: the consumer may be gone
+			select {
+			case ch <- SeriesResult{Err: err}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// seriesCursor walks the matching series of a shard, resolving their
+// labels streamBatchSize fingerprints at a time.
+type seriesCursor struct {
+	shard *indexShard
+	// fps are the matching fingerprints whose labels aren't resolved yet.
+	fps   []model.Fingerprint
+	batch []fingerprintLabels
+}
+
+// fill resolves the labels of the next fingerprints if the current batch is
+// exhausted, and reports whether a series is left.
+func (c *seriesCursor) fill() bool {
+	for len(c.batch) == 0 && len(c.fps) > 0 {
+		n := streamBatchSize
+		if n > len(c.fps) {
+			n = len(c.fps)
+		}
+		c.batch = c.shard.seriesLabels(c.fps[:n])
+		c.fps = c.fps[n:]
+	}
+	return len(c.batch) > 0
+}
@@ -0,0 +1,137 @@
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func newStreamTestIndex() *InvertedIndex {
+	ii := NewWithShards(16)
+	for i := 0; i < 100; i++ {
+		ii.Add([]*commonv1.LabelPair{
+			{Name: "env", Value: fmt.Sprint("env-", i%2)},
+			{Name: "pod", Value: fmt.Sprint("pod-", i)},
+		}, model.Fingerprint(i))
+	}
+	return ii
+}
+
+func Test_StreamSeries(t *testing.T) {
+	ii := newStreamTestIndex()
+	matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "env-1")}
+
+	ch, err := ii.StreamSeries(context.Background(), matchers, nil)
+	require.NoError(t, err)
+	var (
+		fps    []model.Fingerprint
+		series []phlaremodel.Labels
+	)
+	for res := range ch {
+		require.NoError(t, res.Err)
+		fps = append(fps, res.Fingerprint)
+		series = append(series, res.Labels)
+	}
+	expected, err := ii.Lookup(matchers, nil)
+	require.NoError(t, err)
+	require.Equal(t, expected, fps)
+	expectedSeries, err := ii.MatchSeries([][]*labels.Matcher{matchers}, nil)
+	require.NoError(t, err)
+	require.Equal(t, expectedSeries, series)
+
+	_, err = ii.StreamSeries(context.Background(), matchers, &shard.Annotation{Shard: 0, Of: 3})
+	require.ErrorIs(t, err, ErrInvalidShardQuery)
+}
+
+func Test_StreamSeriesCancel(t *testing.T) {
+	ii := newStreamTestIndex()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := ii.StreamSeries(ctx, nil, nil)
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Err)
+	require.Equal(t, model.Fingerprint(0), res.Fingerprint)
+	cancel()
+
+	// The producer closes the channel as it exits, after the error.
+	var (
+		count int
+		last  SeriesResult
+	)
+	for res := range ch {
+		if res.Err == nil {
+			count++
+		}
+		last = res
+	}
+	if last.Err != nil {
+		require.ErrorIs(t, last.Err, context.Canceled)
+	}
+	require.Less(t, count, 99)
+}
+
+func Test_StreamSeriesCancelWithoutDraining(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	ii := newStreamTestIndex()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := ii.StreamSeries(ctx, nil, nil)
+	require.NoError(t, err)
+	res := <-ch
+	require.NoError(t, res.Err)
+	// the producer exits even though the channel is never read again
+	cancel()
+}
+
+func Test_StreamSeriesCanceledBeforeReceiving(t *testing.T) {
+	ii := newStreamTestIndex()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch, err := ii.StreamSeries(ctx, nil, nil)
+	require.NoError(t, err)
+
+	// no series is produced, the error only if the consumer was waiting
+	var results []SeriesResult
+	for res := range ch {
+		results = append(results, res)
+	}
+	require.LessOrEqual(t, len(results), 1)
+	for _, res := range results {
+		require.ErrorIs(t, res.Err, context.Canceled)
+	}
+}
+
+func Test_StreamSeriesBatches(t *testing.T) {
+	ii := NewWithShards(2)
+	for i := 0; i < 3*streamBatchSize; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+	ch, err := ii.StreamSeries(context.Background(), nil, nil)
+	require.NoError(t, err)
+
+	// a series deleted after the lookup and before its labels are resolved
+	// is skipped
+	res := <-ch
+	require.Equal(t, model.Fingerprint(0), res.Fingerprint)
+	last := 3*streamBatchSize - 1
+	ii.Delete(phlaremodel.LabelsFromStrings("pod", fmt.Sprint("pod-", last)), model.Fingerprint(last))
+	var fps []model.Fingerprint
+	for res := range ch {
+		require.NoError(t, res.Err)
+		fps = append(fps, res.Fingerprint)
+	}
+	require.Len(t, fps, 3*streamBatchSize-2)
+	require.NotContains(t, fps, model.Fingerprint(last))
+	require.True(t, sort.SliceIsSorted(fps, func(i, j int) bool { return fps[i] < fps[j] }))
+}
@@ -0,0 +1,165 @@
+package tsdb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// IndexTxn buffers the writes of a transaction, see InvertedIndex.Txn.
+type IndexTxn struct {
+	ii  *InvertedIndex
+	ops []txnOp
+}
+
+type txnOp struct {
+	shard  uint32
+	labels phlaremodel.Labels
+	fp     model.Fingerprint
+	delete bool
+}
+
+// Add buffers the addition of a series, as InvertedIndex.Add.
+func (tx *IndexTxn) Add(labels phlaremodel.Labels, fp model.Fingerprint) {
+	labels, _ = dedupeLabelNames(labels)
+	labels = tx.ii.normalize(labels)
+	tx.ops = append(tx.ops, txnOp{shard: tx.ii.ShardForLabels(labels), labels: labels, fp: fp})
+}
+
+// Delete buffers the deletion of a series, as InvertedIndex.Delete.
+func (tx *IndexTxn) Delete(labels phlaremodel.Labels, fp model.Fingerprint) {
+	labels = tx.ii.normalize(labels)
+	tx.ops = append(tx.ops, txnOp{shard: tx.ii.ShardForLabels(labels), labels: labels, fp: fp, delete: true})
+}
+
+// Txn calls fn to buffer writes, then applies them in order as one unit.
+// If fn returns an error, none of them is applied and the error is
+// returned. Txn returns ErrClosed once the index is closed.
+//
+// The write locks of all the shards written to are held together while
+// the writes are applied, so readers of a shard observe either none or all
+// of its writes. They are taken in ascending shard order, while all other
+// operations hold at most one shard lock at a time, which rules out
+// deadlocks. Queries spanning several shards read them one after the
+// other, and may still read a shard before the commit and another after.
+func (ii *InvertedIndex) Txn(fn func(tx *IndexTxn) error) error {
+	if ii.closed.Load() {
+		return ErrClosed
+	}
+	tx := &IndexTxn{ii: ii}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	ii.commit(tx.ops)
+	return nil
+}
+
+func (ii *InvertedIndex) commit(ops []txnOp) {
+	shards := make([]uint32, 0, len(ops))
+	for _, op := range ops {
+		shards = append(shards, op.shard)
+	}
+	unlock := ii.lockShards(shards)
+
+	type eviction struct {
+		fp     model.Fingerprint
+		labels phlaremodel.Labels
+	}
+	var evictions []eviction
+	type drop struct {
+		shard   *indexShard
+		fp      model.Fingerprint
+		dropped []*commonv1.LabelPair
+	}
+	var drops []drop
+	for _, op := range ops {
+		shard := ii.shards[op.shard]
+		if !op.delete {
+			if _, dropped := shard.insertSeries(op.labels, op.fp, copyString); len(dropped) > 0 {
+				drops = append(drops, drop{shard: shard, fp: op.fp, dropped: dropped})
+			}
+			continue
+		}
+		if evicted := shard.deleteSeries(op.labels, op.fp); evicted != nil {
+			evictions = append(evictions, eviction{fp: op.fp, labels: evicted})
+		}
+	}
+
+	unlock()
+	for _, d := range drops {
+		d.shard.reportDropped(d.fp, d.dropped)
+	}
+	if ii.opts.OnEvict != nil {
+		for _, e := range evictions {
+			ii.opts.OnEvict(e.fp, e.labels)
+		}
+	}
+}
+
+// lockShards takes the write locks of the given shards, possibly repeated,
+// in ascending order and returns the function releasing them.
+func (ii *InvertedIndex) lockShards(indices []uint32) (unlock func()) {
+	var shards []uint32
+	locked := map[uint32]struct{}{}
+	for _, i := range indices {
+		if _, ok := locked[i]; !ok {
+			locked[i] = struct{}{}
+			shards = append(shards, i)
+		}
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i] < shards[j] })
+	for _, i := range shards {
+		ii.shards[i].mtx.Lock()
+	}
+	return func() {
+		for j := len(shards) - 1; j >= 0; j-- {
+			ii.shards[shards[j]].mtx.Unlock()
+		}
+	}
+}
+
+// ReplaceSeries replaces the labels of the series fp with newLabels, moving
+// it to the shard newLabels route to if needed, and returns the interned
+// new labels. The old labels are read from the shards holding fp, and it
+// fails with ErrSeriesNotFound if there are none. Readers observe either
+// the old or the new labels within a shard, under the same guarantees as
+// Txn; OnEvict isn't called as the series remains.
+// NOTE: memory for `newLabels` is unsafe, as for Add.
+func (ii *InvertedIndex) ReplaceSeries(fp model.Fingerprint, newLabels phlaremodel.Labels) (phlaremodel.Labels, error) {
+	if ii.closed.Load() {
+		return nil, ErrClosed
+	}
+	newLabels, _ = dedupeLabelNames(newLabels)
+	newLabels = ii.normalize(newLabels)
+	target := ii.ShardForLabels(newLabels)
+
+	var holders []uint32
+	for _, shard := range ii.shards {
+		if shard.exists(fp) {
+			holders = append(holders, shard.shard)
+		}
+	}
+	unlock := ii.lockShards(append([]uint32{target}, holders...))
+
+	// the series may have been deleted since the holders were found
+	found := false
+	for _, i := range holders {
+		shard := ii.shards[i]
+		if old, ok := shard.series[fp]; ok {
+			shard.deleteSeries(old, fp)
+			found = true
+		}
+	}
+	if !found {
+		unlock()
+		return nil, fmt.Errorf("%w: %v", ErrSeriesNotFound, fp)
+	}
+	interned, dropped := ii.shards[target].insertSeries(newLabels, fp, copyString)
+	unlock()
+	ii.shards[target].reportDropped(fp, dropped)
+	return interned, nil
+}
@@ -0,0 +1,183 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/shard"
+)
+
+func Test_Txn(t *testing.T) {
+	var evicted []model.Fingerprint
+	ii := NewWithOptions(4, IndexOptions{OnEvict: func(fp model.Fingerprint, _ phlaremodel.Labels) {
+		evicted = append(evicted, fp)
+	}})
+	for i := 0; i < 8; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", string(rune('a'+i))), model.Fingerprint(i))
+	}
+	lookup := func() []model.Fingerprint {
+		fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}, nil)
+		require.NoError(t, err)
+		return fps
+	}
+
+	errAbort := errors.New("abort")
+	err := ii.Txn(func(tx *IndexTxn) error {
+		tx.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "a"), 0)
+		tx.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "z"), 10)
+		return errAbort
+	})
+	require.ErrorIs(t, err, errAbort)
+	require.Equal(t, []model.Fingerprint{0, 1, 2, 3, 4, 5, 6, 7}, lookup())
+
+	require.NoError(t, ii.Txn(func(tx *IndexTxn) error {
+		for i := 0; i < 4; i++ {
+			tx.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", string(rune('a'+i))), model.Fingerprint(i))
+		}
+		tx.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "z"), 10)
+		// writes apply in order
+		tx.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "y"), 11)
+		tx.Delete(phlaremodel.LabelsFromStrings("env", "prod", "pod", "y"), 11)
+		return nil
+	}))
+	require.Equal(t, []model.Fingerprint{4, 5, 6, 7, 10}, lookup())
+	require.ElementsMatch(t, []model.Fingerprint{0, 1, 2, 3, 11}, evicted)
+	require.NoError(t, ii.Validate())
+
+	require.NoError(t, ii.Close())
+	require.ErrorIs(t, ii.Txn(func(tx *IndexTxn) error { return nil }), ErrClosed)
+}
+
+func Test_TxnAtomicity(t *testing.T) {
+	// with a single shard, readers observe transactions all at once
+	ii := NewWithShards(1)
+	series := func(fp model.Fingerprint) phlaremodel.Labels {
+		return phlaremodel.LabelsFromStrings("env", "prod", "gen", string(rune('a'+fp%26)))
+	}
+	ii.Add(series(0), 0)
+
+	var (
+		wg     sync.WaitGroup
+		txnErr error
+		done   = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for fp := model.Fingerprint(1); fp < 200 && txnErr == nil; fp++ {
+			txnErr = ii.Txn(func(tx *IndexTxn) error {
+				tx.Delete(series(fp-1), fp-1)
+				tx.Add(series(fp), fp)
+				return nil
+			})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			require.NoError(t, txnErr)
+			return
+		default:
+		}
+		fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")}, nil)
+		require.NoError(t, err)
+		require.Len(t, fps, 1)
+	}
+}
+
+func Test_ReplaceSeries(t *testing.T) {
+	var evicted []model.Fingerprint
+	ii := NewWithOptions(8, IndexOptions{OnEvict: func(fp model.Fingerprint, _ phlaremodel.Labels) {
+		evicted = append(evicted, fp)
+	}})
+	old := phlaremodel.LabelsFromStrings("env", "prod", "pod", "a")
+	ii.Add(old, 1)
+	ii.Add(phlaremodel.LabelsFromStrings("env", "prod", "pod", "b"), 2)
+	lookup := func(name, value string) []model.Fingerprint {
+		fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, name, value)}, nil)
+		require.NoError(t, err)
+		return fps
+	}
+
+	// find new labels for each case: same shard and another shard
+	var sameShard, otherShard phlaremodel.Labels
+	for i := 0; sameShard == nil || otherShard == nil; i++ {
+		lbs := phlaremodel.LabelsFromStrings("env", "dev", "pod", fmt.Sprint("pod-", i))
+		if ii.ShardForLabels(lbs) == ii.ShardForLabels(old) {
+			sameShard = lbs
+		} else {
+			otherShard = lbs
+		}
+	}
+	for _, newLabels := range []phlaremodel.Labels{sameShard, otherShard} {
+		interned, err := ii.ReplaceSeries(1, newLabels)
+		require.NoError(t, err)
+		require.Equal(t, newLabels, interned)
+		require.Equal(t, []model.Fingerprint{2}, lookup("env", "prod"))
+		require.Equal(t, []model.Fingerprint{1}, lookup("env", "dev"))
+		require.Equal(t, []model.Fingerprint{1}, lookup("pod", newLabels[1].Value))
+
+		fps, err := ii.Lookup(nil, &shard.Annotation{Shard: int(ii.ShardForLabels(newLabels)), Of: 8})
+		require.NoError(t, err)
+		require.Contains(t, fps, model.Fingerprint(1))
+		require.NoError(t, ii.Validate())
+	}
+	require.Empty(t, evicted)
+
+	// the series is deleted by its new labels
+	ii.Delete(otherShard, 1)
+	require.False(t, ii.Exists(1))
+	require.Equal(t, []model.Fingerprint{1}, evicted)
+
+	_, err := ii.ReplaceSeries(1, old)
+	require.ErrorIs(t, err, ErrSeriesNotFound)
+	require.False(t, ii.Exists(1))
+
+	require.NoError(t, ii.Close())
+	_, err = ii.ReplaceSeries(2, old)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func Test_ReplaceSeriesConcurrent(t *testing.T) {
+	ii := NewWithShards(4)
+	for i := 0; i < 16; i++ {
+		ii.Add(phlaremodel.LabelsFromStrings("gen", "0", "pod", fmt.Sprint("pod-", i)), model.Fingerprint(i))
+	}
+
+	var wg sync.WaitGroup
+	var replaceErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for gen := 1; gen <= 50; gen++ {
+			for i := 0; i < 16; i++ {
+				lbs := phlaremodel.LabelsFromStrings("gen", fmt.Sprint(gen), "pod", fmt.Sprint("pod-", i))
+				if _, err := ii.ReplaceSeries(model.Fingerprint(i), lbs); err != nil && replaceErr == nil {
+					replaceErr = err
+				}
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		// a series is always found under a single pod value
+		fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "pod", "pod-.*")}, nil)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(fps), 16)
+	}
+	wg.Wait()
+	require.NoError(t, replaceErr)
+
+	fps, err := ii.Lookup([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "gen", "50")}, nil)
+	require.NoError(t, err)
+	require.Len(t, fps, 16)
+	require.NoError(t, ii.Validate())
+}
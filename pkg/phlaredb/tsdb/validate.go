@@ -0,0 +1,186 @@
+package tsdb
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// Validate checks the internal invariants of the index and returns a
+// descriptive error for the first violation found:
+//   - every postings list is non-empty, sorted and free of duplicates,
+//   - label names and values without postings have been pruned,
+//   - the sorted label names match the indexed names,
+//   - the sorted label values, if maintained, match the indexed values,
+//   - the forward postings and the fingerprint to labels map agree,
+//   - the reference count of each fingerprint matches its postings.
+func (ii *InvertedIndex) Validate() error {
+	for _, shard := range ii.shards {
+		if err := shard.validate(); err != nil {
+			return fmt.Errorf("shard %d: %w", shard.shard, err)
+		}
+	}
+	return nil
+}
+
+func (shard *indexShard) validate() error {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	if len(shard.names) != len(shard.idx) {
+		return fmt.Errorf("%d sorted label names for %d indexed names", len(shard.names), len(shard.idx))
+	}
+	for i, name := range shard.names {
+		if i > 0 && shard.names[i-1] >= name {
+			return fmt.Errorf("sorted label names not sorted and distinct at %d: %q >= %q", i, shard.names[i-1], name)
+		}
+		if _, ok := shard.idx[name]; !ok {
+			return fmt.Errorf("sorted label name %q is not indexed", name)
+		}
+	}
+
+	for name, values := range shard.idx {
+		if name != values.name {
+			return fmt.Errorf("label name %q indexed under key %q", values.name, name)
+		}
+		if len(values.fps) == 0 {
+			return fmt.Errorf("label name %q has no values", name)
+		}
+		if err := values.validateSorted(); err != nil {
+			return fmt.Errorf("label name %q: %w", name, err)
+		}
+		for value, entry := range values.fps {
+			if value != entry.value {
+				return fmt.Errorf("label %s=%q indexed under key %q", name, entry.value, value)
+			}
+			if entry.fps == nil || entry.fps.len() == 0 {
+				return fmt.Errorf("label %s=%q has no postings", name, value)
+			}
+			fps := entry.fps.appendTo(nil)
+			for i, fp := range fps {
+				if i > 0 && fps[i-1] >= fp {
+					return fmt.Errorf("postings of %s=%q not sorted and distinct at %d: %v >= %v", name, value, i, fps[i-1], fp)
+				}
+				lbs, ok := shard.series[fp]
+				if !ok {
+					return fmt.Errorf("fingerprint %v of %s=%q has no labels", fp, name, value)
+				}
+				if lbs.Get(name) != value {
+					return fmt.Errorf("fingerprint %v of %s=%q has labels %s", fp, name, value, phlaremodel.LabelPairsString(lbs))
+				}
+			}
+		}
+	}
+
+	if len(shard.refs) != len(shard.series) {
+		return fmt.Errorf("%d referenced fingerprints for %d series", len(shard.refs), len(shard.series))
+	}
+	for fp, lbs := range shard.series {
+		if shard.refs[fp] != len(lbs) {
+			return fmt.Errorf("fingerprint %v with labels %s referenced by %d postings", fp, phlaremodel.LabelPairsString(lbs), shard.refs[fp])
+		}
+		for _, l := range lbs {
+			if !shard.hasPosting(l.Name, l.Value, fp) {
+				return fmt.Errorf("fingerprint %v with labels %s missing from postings of %s=%q", fp, phlaremodel.LabelPairsString(lbs), l.Name, l.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// selfCheckSamples is the number of series and of label pairs SelfCheck
+// samples per shard.
+const selfCheckSamples = 16
+
+// SelfCheck samples series and label pairs of every shard and returns the
+// discrepancies found between the fingerprint to labels map and the
+// postings: a sampled series must be found in the postings of each of its
+// labels, that is by an equality query on its own labels, and referenced
+// by as many postings as it has labels, while the first fingerprints of a
+// sampled pair must carry it. Unlike Validate it doesn't stop at the first error,
+// and its cost is bounded by the number of shards rather than of series,
+// so it can run periodically on a live index. Shards are checked one at a
+// time under their read lock, and the samples differ between calls.
+func (ii *InvertedIndex) SelfCheck() []error {
+	var errs []error
+	for _, shard := range ii.shards {
+		for _, err := range shard.selfCheck(selfCheckSamples) {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard.shard, err))
+		}
+	}
+	return errs
+}
+
+func (shard *indexShard) selfCheck(samples int) []error {
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+
+	var errs []error
+	// map iteration starts at a random position
+	n := 0
+	for fp, lbs := range shard.series {
+		if n++; n > samples {
+			break
+		}
+		for _, l := range lbs {
+			if !shard.hasPosting(l.Name, l.Value, fp) {
+				errs = append(errs, fmt.Errorf("fingerprint %v with labels %s missing from postings of %s=%q", fp, phlaremodel.LabelPairsString(lbs), l.Name, l.Value))
+			}
+		}
+		if shard.refs[fp] != len(lbs) {
+			errs = append(errs, fmt.Errorf("fingerprint %v with labels %s referenced by %d postings", fp, phlaremodel.LabelPairsString(lbs), shard.refs[fp]))
+		}
+	}
+
+	n = 0
+	for name, values := range shard.idx {
+		for value, entry := range values.fps {
+			if n++; n > samples {
+				return errs
+			}
+			if entry.fps == nil {
+				errs = append(errs, fmt.Errorf("label %s=%q has no postings", name, value))
+				continue
+			}
+			checked := 0
+			entry.fps.iterate(func(fp model.Fingerprint) bool {
+				lbs, ok := shard.series[fp]
+				if !ok {
+					errs = append(errs, fmt.Errorf("fingerprint %v of %s=%q has no labels", fp, name, value))
+				} else if lbs.Get(name) != value {
+					errs = append(errs, fmt.Errorf("fingerprint %v of %s=%q has labels %s", fp, name, value, phlaremodel.LabelPairsString(lbs)))
+				}
+				checked++
+				return checked < samples
+			})
+			// one pair per name, to sample more names
+			break
+		}
+	}
+	return errs
+}
+
+func (values indexEntry) validateSorted() error {
+	if values.sorted == nil {
+		return nil
+	}
+	if len(values.sorted.values) != len(values.fps) {
+		return fmt.Errorf("%d sorted values for %d indexed values", len(values.sorted.values), len(values.fps))
+	}
+	for i, value := range values.sorted.values {
+		if i > 0 && values.sorted.values[i-1] >= value {
+			return fmt.Errorf("sorted values not sorted and distinct at %d: %q >= %q", i, values.sorted.values[i-1], value)
+		}
+		if _, ok := values.fps[value]; !ok {
+			return fmt.Errorf("sorted value %q is not indexed", value)
+		}
+	}
+	for _, v := range values.sorted.numeric {
+		if _, ok := values.fps[v.value]; !ok {
+			return fmt.Errorf("sorted numeric value %q is not indexed", v.value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package tsdb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	commonv1 "github.com/grafana/phlare/pkg/gen/common/v1"
+)
+
+func Test_Validate(t *testing.T) {
+	newIndex := func() *InvertedIndex {
+		ii := NewWithShards(1)
+		for i := 0; i < 10; i++ {
+			ii.Add([]*commonv1.LabelPair{
+				{Name: "foo", Value: "bar"},
+				{Name: "i", Value: fmt.Sprint(i)},
+			}, model.Fingerprint(i))
+		}
+		return ii
+	}
+
+	ii := newIndex()
+	require.NoError(t, ii.Validate())
+	ii.Delete([]*commonv1.LabelPair{
+		{Name: "foo", Value: "bar"},
+		{Name: "i", Value: "3"},
+	}, 3)
+	require.NoError(t, ii.Validate())
+
+	for name, corrupt := range map[string]func(s *indexShard){
+		"unsorted": func(s *indexShard) {
+			fps := s.idx["foo"].fps["bar"].fps.(*slicePostings).fps
+			fps[0], fps[1] = fps[1], fps[0]
+		},
+		"duplicate": func(s *indexShard) {
+			fps := s.idx["foo"].fps["bar"].fps.(*slicePostings).fps
+			fps[1] = fps[0]
+		},
+		"empty postings": func(s *indexShard) {
+			s.idx["i"].fps["0"] = indexValueEntry{value: "0"}
+		},
+		"empty name": func(s *indexShard) {
+			s.idx["empty"] = indexEntry{name: "empty", fps: map[string]indexValueEntry{}}
+		},
+		"missing labels": func(s *indexShard) {
+			delete(s.series, 0)
+		},
+		"missing posting": func(s *indexShard) {
+			s.series[42] = s.series[0]
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ii := newIndex()
+			corrupt(ii.shards[0])
+			require.Error(t, ii.Validate())
+		})
+	}
+}
+
+func Test_SelfCheck(t *testing.T) {
+	newIndex := func() *InvertedIndex {
+		ii := NewWithShards(1)
+		for i := 0; i < 10; i++ {
+			ii.Add([]*commonv1.LabelPair{
+				{Name: "foo", Value: "bar"},
+				{Name: "i", Value: fmt.Sprint(i)},
+			}, model.Fingerprint(i))
+		}
+		return ii
+	}
+	require.Empty(t, newIndex().SelfCheck())
+
+	for name, corrupt := range map[string]func(s *indexShard){
+		"missing labels": func(s *indexShard) {
+			delete(s.series, 0)
+		},
+		"missing posting": func(s *indexShard) {
+			s.series[42] = s.series[0]
+		},
+		"wrong references": func(s *indexShard) {
+			s.refs[1] = 5
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ii := newIndex()
+			corrupt(ii.shards[0])
+			errs := ii.SelfCheck()
+			require.NotEmpty(t, errs)
+			require.Contains(t, errs[0].Error(), "shard 0: ")
+		})
+	}
+
+	// discrepancies are all reported
+	ii := newIndex()
+	ii.shards[0].series[42] = ii.shards[0].series[0]
+	ii.shards[0].series[43] = ii.shards[0].series[1]
+	require.Len(t, ii.SelfCheck(), 6)
+}
+
+func Test_SelfCheckUnderLoad(t *testing.T) {
+	ii := NewWithShards(4)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			lbs := []*commonv1.LabelPair{{Name: "foo", Value: fmt.Sprint(i % 7)}, {Name: "i", Value: fmt.Sprint(i)}}
+			ii.Add(lbs, model.Fingerprint(i))
+			if i%3 == 0 {
+				ii.Delete(lbs, model.Fingerprint(i))
+			}
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		require.Empty(t, ii.SelfCheck())
+	}
+}
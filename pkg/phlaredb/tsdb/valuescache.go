@@ -0,0 +1,42 @@
+package tsdb
+
+import (
+	"sort"
+	"sync"
+)
+
+// labelValuesCache holds the sorted values of a label name, built on the
+// first LabelValues call and invalidated when a value is added or removed.
+// It is filled under the shard read lock, hence its own mutex.
+type labelValuesCache struct {
+	mtx    sync.Mutex
+	values []string
+	valid  bool
+}
+
+// get returns the cached sorted values of entry, building them if needed.
+// The result must be copied before releasing the shard lock.
+func (c *labelValuesCache) get(entry indexEntry) []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.valid {
+		values := make([]string, 0, len(entry.fps))
+		for val := range entry.fps {
+			values = append(values, val)
+		}
+		sort.Strings(values)
+		c.values, c.valid = values, true
+	}
+	return c.values
+}
+
+// invalidate drops the cached values, it is a no-op on a nil receiver.
+// Must be called under the shard write lock.
+func (c *labelValuesCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	c.values, c.valid = nil, false
+	c.mtx.Unlock()
+}